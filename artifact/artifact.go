@@ -0,0 +1,456 @@
+package artifact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lulugyf/fkme/vfs"
+)
+
+/*
+带版本的制品仓库, 存放在任意 vfs 端点上(一般是 sftp)
+
+目录结构:
+  <root>/<id>/<version>/...               制品文件, 上传后不再修改
+  <root>/<id>/<version>/.fkme-manifest.json  文件列表, 大小, sha256, 元数据
+  <root>/<id>/LATEST                      最新版本号
+  <root>/<id>/.tmp-<version>/             上传中的版本
+
+上传时先写入 .tmp-<version>, 完成后改名为 <version>, 再替换 LATEST
+所以读取方不会看到不完整的版本, 也不依赖文件的修改时间
+
+	st := artifact.New(vfs.NewSFTP(client, "od"), "/models")
+	m, err := st.Push(vfs.Local{}, "./output/best", "resnet", "", map[string]string{"acc": "0.93"})
+	m, err = st.Pull("resnet", "latest", vfs.Local{}, "./model")
+*/
+const (
+	ManifestName  = ".fkme-manifest.json"
+	LatestName    = "LATEST"
+	VersionFormat = "20060102-150405"
+
+	tmpPrefix = ".tmp-"
+)
+
+var (
+	ErrExists   = errors.New("version already exists")
+	ErrNotFound = errors.New("no such version")
+)
+
+type File struct {
+	Path    string    `json:"path"` // 相对于版本目录
+	Size    int64     `json:"size"`
+	Sha256  string    `json:"sha256"`
+	ModTime time.Time `json:"mtime"`
+}
+
+type Manifest struct {
+	ID      string            `json:"id"`
+	Version string            `json:"version"`
+	Created time.Time         `json:"created"`
+	Host    string            `json:"host,omitempty"`   // 上传的机器
+	Source  string            `json:"source,omitempty"` // 上传的本地路径
+	Size    int64             `json:"size"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Files   []File            `json:"files"`
+}
+
+type Store struct {
+	FS   vfs.FS
+	Root string
+}
+
+func New(fs vfs.FS, root string) *Store {
+	return &Store{FS: fs, Root: root}
+}
+
+func checkName(kind, s string) error {
+	if s == "" || strings.HasPrefix(s, ".") || strings.HasPrefix(s, "/") || s == LatestName {
+		return fmt.Errorf("invalid %s: %q", kind, s)
+	}
+	for _, p := range strings.Split(s, "/") {
+		if p == "" || p == "." || p == ".." {
+			return fmt.Errorf("invalid %s: %q", kind, s)
+		}
+	}
+	return nil
+}
+
+// 版本号, 是版本目录名, 不能含有 /, latest 用于表示最新版本
+func checkVersion(s string) error {
+	if err := checkName("version", s); err != nil || strings.Contains(s, "/") || s == "latest" {
+		return fmt.Errorf("invalid version: %q", s)
+	}
+	return nil
+}
+
+// 清单中的文件路径, 必须是相对路径, 不能含有 .. 等, 以免下载到 dstPath 之外
+func checkPath(s string) error {
+	if s == "" || strings.HasPrefix(s, "/") || strings.Contains(s, "\\") {
+		return fmt.Errorf("invalid file path: %q", s)
+	}
+	for _, p := range strings.Split(s, "/") {
+		if p == "" || p == "." || p == ".." {
+			return fmt.Errorf("invalid file path: %q", s)
+		}
+	}
+	return nil
+}
+
+func (s *Store) dir(id string) string {
+	return path.Join(s.Root, id)
+}
+
+/*
+上传 srcPath(文件或目录)作为 id 的新版本, version 为空时使用当前时间
+上传成功后更新 LATEST
+*/
+func (s *Store) Push(src vfs.FS, srcPath, id, version string, meta map[string]string) (*Manifest, error) {
+	if version == "" {
+		version = time.Now().Format(VersionFormat)
+	}
+	if err := checkName("id", id); err != nil {
+		return nil, err
+	}
+	if err := checkVersion(version); err != nil {
+		return nil, err
+	}
+	info, err := src.Stat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	final := path.Join(s.dir(id), version)
+	if _, err := s.FS.Stat(final); err == nil {
+		return nil, fmt.Errorf("%s@%s: %w", id, version, ErrExists)
+	}
+	tmp := path.Join(s.dir(id), tmpPrefix+version)
+	if _, err := s.FS.Stat(tmp); err == nil {
+		vfs.RemoveAll(s.FS, tmp) // 上次中断留下的
+	}
+	if err := s.FS.MkdirAll(tmp); err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	m := &Manifest{ID: id, Version: version, Created: time.Now(), Host: host, Source: srcPath,
+		Meta: meta, Files: []File{}}
+	add := func(name, rel string, info os.FileInfo) error {
+		size, sum, err := copyHash(src, name, s.FS, path.Join(tmp, rel))
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, File{Path: rel, Size: size, Sha256: sum, ModTime: info.ModTime()})
+		m.Size += size
+		return nil
+	}
+	if info.IsDir() {
+		root := path.Clean(srcPath)
+		err = vfs.Walk(src, root, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel := name
+			if root != "." {
+				rel = strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+			}
+			if name == root {
+				return nil
+			}
+			if info.IsDir() {
+				return s.FS.MkdirAll(path.Join(tmp, rel))
+			}
+			return add(name, rel, info)
+		})
+	} else {
+		err = add(srcPath, path.Base(srcPath), info)
+	}
+	if err == nil {
+		err = writeJSON(s.FS, path.Join(tmp, ManifestName), m)
+	}
+	if err == nil {
+		err = s.FS.Rename(tmp, final)
+	}
+	if err != nil {
+		vfs.RemoveAll(s.FS, tmp)
+		return nil, err
+	}
+	return m, s.SetLatest(id, version)
+}
+
+// 先写临时文件再改名, 替换 LATEST 是原子的
+func (s *Store) SetLatest(id, version string) error {
+	if err := checkName("id", id); err != nil {
+		return err
+	}
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+	name := path.Join(s.dir(id), LatestName)
+	tmp := path.Join(s.dir(id), tmpPrefix+LatestName)
+	w, err := s.FS.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, version+"\n")
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return s.FS.Rename(tmp, name)
+}
+
+/*
+最新版本, 没有 LATEST 时(旧的仓库)使用创建时间最新的版本
+LATEST 的内容来自远端, 不是合法的版本号时返回错误
+*/
+func (s *Store) Latest(id string) (string, error) {
+	if err := checkName("id", id); err != nil {
+		return "", err
+	}
+	r, err := s.FS.Open(path.Join(s.dir(id), LatestName))
+	if err == nil {
+		b, err := ioutil.ReadAll(io.LimitReader(r, 256))
+		r.Close()
+		if v := strings.TrimSpace(string(b)); err == nil && v != "" {
+			if err := checkVersion(v); err != nil {
+				return "", fmt.Errorf("%s/%s: %v", id, LatestName, err)
+			}
+			return v, nil
+		}
+	}
+	list, err := s.List(id)
+	if err != nil {
+		return "", err
+	}
+	if len(list) == 0 {
+		return "", fmt.Errorf("%s: %w", id, ErrNotFound)
+	}
+	return list[len(list)-1].Version, nil
+}
+
+// version 为空或 latest 时返回最新版本
+func (s *Store) Manifest(id, version string) (*Manifest, error) {
+	version, err := s.resolve(id, version)
+	if err != nil {
+		return nil, err
+	}
+	return s.manifest(id, version)
+}
+
+// 检查 id 和 version, version 为空或 latest 时换成最新版本
+func (s *Store) resolve(id, version string) (string, error) {
+	if err := checkName("id", id); err != nil {
+		return "", err
+	}
+	if version == "" || version == "latest" {
+		return s.Latest(id)
+	}
+	return version, checkVersion(version)
+}
+
+// 读取版本目录中的清单, 清单中的版本必须与目录一致
+func (s *Store) manifest(id, version string) (*Manifest, error) {
+	m := &Manifest{}
+	if err := readJSON(s.FS, path.Join(s.dir(id), version, ManifestName), m); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s@%s: %w", id, version, ErrNotFound)
+		}
+		return nil, err
+	}
+	if m.Version != version {
+		return nil, fmt.Errorf("%s@%s: manifest has version %q", id, version, m.Version)
+	}
+	return m, nil
+}
+
+/*
+下载一个版本到 dstPath 目录, 下载时校验 sha256
+*/
+func (s *Store) Pull(id, version string, dst vfs.FS, dstPath string) (*Manifest, error) {
+	version, err := s.resolve(id, version)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.manifest(id, version)
+	if err != nil {
+		return nil, err
+	}
+	// 清单来自远端, 先检查全部路径, 有一个不合法就不下载
+	for _, f := range m.Files {
+		if err := checkPath(f.Path); err != nil {
+			return nil, err
+		}
+	}
+	vdir := path.Join(s.dir(id), version)
+	if err := dst.MkdirAll(dstPath); err != nil {
+		return nil, err
+	}
+	for _, f := range m.Files {
+		dfile := path.Join(dstPath, f.Path)
+		if err := dst.MkdirAll(path.Dir(dfile)); err != nil {
+			return nil, err
+		}
+		_, sum, err := copyHash(s.FS, path.Join(vdir, f.Path), dst, dfile)
+		if err != nil {
+			return nil, err
+		}
+		if sum != f.Sha256 {
+			return nil, fmt.Errorf("%s: sha256 mismatch, %s != %s", f.Path, sum, f.Sha256)
+		}
+	}
+	return m, nil
+}
+
+// 仓库中的所有 id
+func (s *Store) IDs() ([]string, error) {
+	files, err := s.FS.ReadDir(s.Root)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			ids = append(ids, f.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+/*
+id 的所有完整版本, 按创建时间从旧到新排列
+*/
+func (s *Store) List(id string) ([]*Manifest, error) {
+	if err := checkName("id", id); err != nil {
+		return nil, err
+	}
+	files, err := s.FS.ReadDir(s.dir(id))
+	if err != nil {
+		return nil, err
+	}
+	list := []*Manifest{}
+	for _, f := range files {
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		m := &Manifest{}
+		if err := readJSON(s.FS, path.Join(s.dir(id), f.Name(), ManifestName), m); err != nil {
+			continue // 不是制品版本
+		}
+		m.Version = f.Name()
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Created.Equal(list[j].Created) {
+			return list[i].Version < list[j].Version
+		}
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+/*
+清理旧版本: 保留最新的 keep 个, 其余的超过 maxAge 才删除(maxAge 为 0 时都删除)
+LATEST 指向的版本不会被删除, 一天以前中断的上传也一起清理
+返回删除(dryRun 时为将要删除)的版本
+*/
+func (s *Store) GC(id string, keep int, maxAge time.Duration, dryRun bool) ([]string, error) {
+	list, err := s.List(id)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := s.Latest(id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err // LATEST 不合法时不能确定哪个版本需要保留
+	}
+	removed := []string{}
+	now := time.Now()
+	for i, m := range list {
+		if i >= len(list)-keep || m.Version == latest {
+			continue
+		}
+		if maxAge > 0 && now.Sub(m.Created) < maxAge {
+			continue
+		}
+		removed = append(removed, m.Version)
+		if !dryRun {
+			if err := vfs.RemoveAll(s.FS, path.Join(s.dir(id), m.Version)); err != nil {
+				return removed, err
+			}
+		}
+	}
+	files, _ := s.FS.ReadDir(s.dir(id))
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), tmpPrefix) && f.IsDir() && now.Sub(f.ModTime()) > 24*time.Hour {
+			removed = append(removed, f.Name())
+			if !dryRun {
+				vfs.RemoveAll(s.FS, path.Join(s.dir(id), f.Name()))
+			}
+		}
+	}
+	return removed, nil
+}
+
+// 复制文件并计算 sha256, 目标支持时保留修改时间
+func copyHash(src vfs.FS, srcPath string, dst vfs.FS, dstPath string) (int64, string, error) {
+	r, err := src.Open(srcPath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer r.Close()
+	w, err := dst.Create(dstPath)
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return n, "", err
+	}
+	if ct, ok := dst.(vfs.Chtimer); ok {
+		if info, err := src.Stat(srcPath); err == nil && !info.ModTime().IsZero() {
+			ct.Chtimes(dstPath, info.ModTime())
+		}
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeJSON(fs vfs.FS, name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	w, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, bytes.NewReader(b))
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func readJSON(fs vfs.FS, name string, v interface{}) error {
+	r, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
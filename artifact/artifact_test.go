@@ -0,0 +1,178 @@
+package artifact
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lulugyf/fkme/vfs"
+)
+
+func TestCheckPath(t *testing.T) {
+	cases := []struct {
+		p  string
+		ok bool
+	}{
+		{"app", true},
+		{"bin/app", true},
+		{".env", true},
+		{"conf/..data", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"..", false},
+		{"../x", false},
+		{"a/../../x", false},
+		{"a/./b", false},
+		{"a//b", false},
+		{"a/", false},
+		{"..\\x", false},
+	}
+	for _, c := range cases {
+		if err := checkPath(c.p); (err == nil) != c.ok {
+			t.Errorf("checkPath(%q) = %v, want ok=%v", c.p, err, c.ok)
+		}
+	}
+}
+
+func newStore(t *testing.T) (*Store, string) {
+	root, err := ioutil.TempDir("", "artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	src := filepath.Join(root, "src")
+	os.MkdirAll(filepath.Join(src, "bin"), 0755)
+	return New(vfs.Local{}, filepath.ToSlash(filepath.Join(root, "store"))), filepath.ToSlash(src)
+}
+
+func readFile(t *testing.T, p string) string {
+	b, err := ioutil.ReadFile(filepath.FromSlash(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestPushPull(t *testing.T) {
+	st, src := newStore(t)
+	for _, v := range []string{"v1", "v2"} {
+		ioutil.WriteFile(filepath.FromSlash(src+"/bin/app"), []byte("app "+v), 0755)
+		ioutil.WriteFile(filepath.FromSlash(src+"/conf"), []byte("conf"), 0644)
+		m, err := st.Push(vfs.Local{}, src, "app", v, map[string]string{"v": v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Files) != 2 || m.Size != int64(len("app "+v)+len("conf")) {
+			t.Errorf("push %s: %+v", v, m)
+		}
+	}
+	if _, err := st.Push(vfs.Local{}, src, "app", "v1", nil); !errors.Is(err, ErrExists) {
+		t.Errorf("push v1 again = %v, want ErrExists", err)
+	}
+	for _, c := range []struct{ id, version string }{{"../x", "v3"}, {"app", "a/b"}, {"app", "latest"}, {"app", ".v"}} {
+		if _, err := st.Push(vfs.Local{}, src, c.id, c.version, nil); err == nil {
+			t.Errorf("push %s@%s should fail", c.id, c.version)
+		}
+	}
+
+	dst := filepath.ToSlash(filepath.Join(filepath.Dir(filepath.FromSlash(src)), "dst"))
+	for _, c := range []struct{ version, want string }{{"latest", "app v2"}, {"", "app v2"}, {"v1", "app v1"}} {
+		m, err := st.Pull("app", c.version, vfs.Local{}, dst+"/"+c.version)
+		if err != nil {
+			t.Fatalf("pull %q: %v", c.version, err)
+		}
+		if got := readFile(t, dst+"/"+c.version+"/bin/app"); got != c.want || m.Meta["v"] != c.want[4:] {
+			t.Errorf("pull %q: got %q, meta %v", c.version, got, m.Meta)
+		}
+	}
+	if _, err := st.Pull("app", "v9", vfs.Local{}, dst+"/v9"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("pull v9 = %v, want ErrNotFound", err)
+	}
+	for _, id := range []string{"../app", "/etc", ""} {
+		if _, err := st.Pull(id, "v1", vfs.Local{}, dst+"/x"); err == nil {
+			t.Errorf("pull id %q should fail", id)
+		}
+	}
+	if _, err := st.Pull("app", "../app/v1", vfs.Local{}, dst+"/x"); err == nil {
+		t.Errorf("pull version ../app/v1 should fail")
+	}
+}
+
+func TestPullTampered(t *testing.T) {
+	st, src := newStore(t)
+	ioutil.WriteFile(filepath.FromSlash(src+"/a"), []byte("a"), 0644)
+	if _, err := st.Push(vfs.Local{}, src, "app", "v1", nil); err != nil {
+		t.Fatal(err)
+	}
+	dst := src + "-dst"
+	adir := filepath.FromSlash(st.Root + "/app")
+
+	// 清单中的版本与目录不一致
+	os.Rename(filepath.Join(adir, "v1"), filepath.Join(adir, "v2"))
+	if _, err := st.Pull("app", "v2", vfs.Local{}, dst); err == nil {
+		t.Errorf("pull v2 with a v1 manifest should fail")
+	}
+	os.Rename(filepath.Join(adir, "v2"), filepath.Join(adir, "v1"))
+
+	// LATEST 指向目录之外
+	for _, latest := range []string{"../other", "a/b", ".tmp-v1", "latest"} {
+		ioutil.WriteFile(filepath.Join(adir, LatestName), []byte(latest+"\n"), 0644)
+		if _, err := st.Pull("app", "latest", vfs.Local{}, dst); err == nil {
+			t.Errorf("pull with LATEST %q should fail", latest)
+		}
+		if _, err := st.GC("app", 0, 0, true); err == nil {
+			t.Errorf("gc with LATEST %q should fail", latest)
+		}
+	}
+	if _, err := os.Stat(filepath.FromSlash(dst)); err == nil {
+		t.Errorf("%s created by a rejected pull", dst)
+	}
+}
+
+func TestGC(t *testing.T) {
+	st, src := newStore(t)
+	ioutil.WriteFile(filepath.FromSlash(src+"/a"), []byte("a"), 0644)
+	for _, v := range []string{"v1", "v2", "v3", "v4"} {
+		if _, err := st.Push(vfs.Local{}, src, "app", v, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st.SetLatest("app", "v1") // LATEST 指向的版本不删除
+	stale := filepath.FromSlash(st.Root + "/app/" + tmpPrefix + "v5")
+	os.MkdirAll(stale, 0755)
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(stale, old, old)
+	os.MkdirAll(filepath.FromSlash(st.Root+"/app/"+tmpPrefix+"v6"), 0755) // 正在上传
+
+	removed, err := st.GC("app", 1, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(removed, " "); got != "v2 v3 .tmp-v5" {
+		t.Errorf("dry run removed %q", got)
+	}
+	if list, _ := st.List("app"); len(list) != 4 {
+		t.Errorf("dry run deleted versions: %d left", len(list))
+	}
+	if removed, _ = st.GC("app", 1, time.Hour, false); len(removed) != 1 || removed[0] != ".tmp-v5" {
+		t.Errorf("gc with max age removed %v", removed)
+	}
+	if removed, err = st.GC("app", 1, 0, false); err != nil || strings.Join(removed, " ") != "v2 v3" {
+		t.Errorf("gc removed %v, %v", removed, err)
+	}
+	list, _ := st.List("app")
+	versions := []string{}
+	for _, m := range list {
+		versions = append(versions, m.Version)
+	}
+	if got := strings.Join(versions, " "); got != "v1 v4" {
+		t.Errorf("versions after gc: %q", got)
+	}
+	if _, err := os.Stat(filepath.FromSlash(st.Root + "/app/" + tmpPrefix + "v6")); err != nil {
+		t.Errorf("gc removed an upload in progress: %v", err)
+	}
+}
@@ -2,13 +2,14 @@ package cron
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/fsnotify/fsnotify"
 	"github.com/go-co-op/gocron"
 	"github.com/lulugyf/fkme/logger"
 	"github.com/lulugyf/fkme/util"
+	"github.com/lulugyf/fkme/watch"
 	"io"
 	"io/ioutil"
 	"log"
@@ -23,9 +24,11 @@ import (
 {"logdir":"/tmp/logs",
  "home":"/data",
  "once_dir":"/tmp/.app/once_proc",
+ "once_poll": 0,
  "init_tgz":{"src":"/app/init.tgz", "dst": "/tmp/.app/"},
  "apps":[
   {"name":"sshserv", "cwd":"/tmp/.app/serv", "args":["./sshserv", "serve"]},
+  {"name":"sftpd", "cwd":"/data", "args":["/app/fkme", "sftpd", "-p", "2022", "-root", "/data", "-auth", "/data/.ssh/authorized_keys"]},
   {"name":"plservice", "cwd":"/data",
     "args":["/app/anaconda3/envs/gm/bin/python", "-c", "import sitech.aipaas.gm.runner.plservice as pl; pl.main(8181)"],
     "env": {"PYTHONPATH":"/app/_app/guimod"}},
@@ -47,11 +50,12 @@ type InitTgz struct {
 	App *App   `json:"app"` // 初始化命令
 }
 type CronConf struct {
-	LogDir  string   `json:"logdir"`
-	Home    string   `json:"home"`
-	OnceDir string   `json:"once_dir"`
-	InitTgz *InitTgz `json:"init_tgz"`
-	Apps    []*App   `json:"apps"`
+	LogDir   string   `json:"logdir"`
+	Home     string   `json:"home"`
+	OnceDir  string   `json:"once_dir"`
+	OncePoll int      `json:"once_poll"` // 大于 0 时每隔这些秒扫描 once_dir, 用于没有 fsnotify 事件的文件系统
+	InitTgz  *InitTgz `json:"init_tgz"`
+	Apps     []*App   `json:"apps"`
 }
 
 func LoadConfig(fpath string) (*CronConf, error) {
@@ -171,64 +175,6 @@ func startApp(app *App, logdir string, home string) {
 	logger.Warn("%s exited with code: %v err: %v", app.Name, p_stat.ExitCode(), err)
 }
 
-type FileWriteCallback func(fpath string) error
-
-func WatchDir(basedir string, callback FileWriteCallback) {
-	fw, _ := fsnotify.NewWatcher()
-	filepath.Walk(basedir, func(path string, info os.FileInfo, err error) error {
-		if info != nil && info.IsDir() {
-			path, err := filepath.Abs(path)
-			if err != nil {
-				logger.Error("Walk filepath:%s err1:%v", path, err)
-				return nil
-			}
-			err = fw.Add(path)
-			if err != nil {
-				logger.Error("Walk filepath:%s err2:%v", path, err)
-			}
-			logger.Info("Watching path: %s", path)
-		}
-		return nil
-	})
-
-	chgfiles := make(map[string]int)
-	for {
-		select {
-		case event := <-fw.Events:
-			{
-				if (event.Op & fsnotify.Create) == fsnotify.Create {
-				}
-
-				if (event.Op & fsnotify.Write) == fsnotify.Write {
-					////log.Printf("----write event (name:%s) (op:%v)\n", event.Name, event.Op)
-					//f.Events <- FSEvent{Path: event.Name, Op: 2}
-					chgfiles[event.Name] = 1
-				}
-
-				if (event.Op & fsnotify.Remove) == fsnotify.Remove {
-				}
-			}
-		case err := <-fw.Errors:
-			{
-				logger.Error("File Watch Error: %v", err)
-			}
-		case <-time.After(time.Second * 1):
-			{ // do callback after 1 second
-				for k, _ := range chgfiles {
-					err := callback(k)
-					if err != nil {
-						logger.Error("callback on %s failed %v", k, err)
-					}
-				}
-				if len(chgfiles) > 0 { // clean the file list
-					chgfiles = make(map[string]int)
-				}
-
-			}
-		}
-	}
-}
-
 func loadOnceFile(fpath string) (*App, error) {
 	_, err := os.Stat(fpath)
 	if err != nil && os.IsNotExist(err) {
@@ -287,9 +233,11 @@ func init_tgz(t *InitTgz, base_dir, logdir, home string) error {
 }
 
 // ./fkme cron -c cron/c1.json
+// ./fkme cron -c cron/c1.json -poll 3s   # once_dir 在 NFS 上, 每 3 秒扫描一次
 func Run(args []string) {
 	cmd := flag.NewFlagSet("cron", flag.ExitOnError)
 	cfile := cmd.String("c", "cron/c1.json", "ssh private key file")
+	poll := cmd.Duration("poll", 0, "scan once_dir at this interval instead of fsnotify, overrides once_poll, e.g. 3s")
 	cmd.Parse(args)
 
 	var conf *CronConf
@@ -378,7 +326,13 @@ func Run(args []string) {
 		os.MkdirAll(conf.OnceDir, 0755)
 	}
 
-	WatchDir(conf.OnceDir, func(fpath string) error {
+	poll_interval := time.Duration(conf.OncePoll) * time.Second
+	if *poll > 0 {
+		poll_interval = *poll
+	}
+	opts := &watch.Options{Debounce: time.Second,
+		Poll: poll_interval > 0, PollInterval: poll_interval}
+	watch.Files(context.Background(), conf.OnceDir, opts, func(fpath string) error {
 		logger.Info("changed file %s", fpath)
 		jobj, err := loadOnceFile(fpath)
 		if err != nil {
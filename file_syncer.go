@@ -11,12 +11,14 @@ import (
 	"strings"
 	"time"
 
+	"github.com/lulugyf/fkme/scp"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 type FileSyncer struct {
 	sftpClient  *sftp.Client
+	versions    *scp.Versioner // nil when g_SyncCfg.Versions is off
 	syncEvent   chan string
 	removeEvent chan string
 	doneEvent   chan struct{}
@@ -127,7 +129,7 @@ func (s *FileSyncer) SyncFile(localFilePath string) error {
 	}
 	defer srcFile.Close()
 	remoteFilePath := s.JoinRemotePath(localFilePath)
-	dstFile, err := s.sftpClient.Create(remoteFilePath)
+	dstFile, err := s.versions.Create(s.sftpClient, remoteFilePath)
 	if err != nil {
 		fmt.Printf("create remote file %s failed: %v\n", remoteFilePath, err)
 		return err
@@ -175,7 +177,16 @@ func (s *FileSyncer) RemoveFile(remoteFilePath string) error {
 		fmt.Printf("ignore remove file: %s\n", remoteFilePath)
 		return nil
 	}
-	err := s.sftpClient.Remove(remoteFilePath)
+	var err error
+	if s.versions != nil {
+		err = s.versions.Backup(s.sftpClient, remoteFilePath) // moved to versions dir
+		// Backup 只移动普通文件, 符号链接等还在原处, 直接删除
+		if _, e := s.sftpClient.Lstat(remoteFilePath); err == nil && e == nil {
+			err = s.sftpClient.Remove(remoteFilePath)
+		}
+	} else {
+		err = s.sftpClient.Remove(remoteFilePath)
+	}
 	if err != nil {
 		log.Printf("remove remote file: %s err: %v\n", remoteFilePath, err)
 	} else {
@@ -195,6 +206,9 @@ func (s *FileSyncer) RemoveDir(remoteRemoveDir string) error {
 		return err
 	}
 	for _, file := range remoteFiles {
+		if file.Name() == scp.VersionsDir {
+			continue
+		}
 		subRemovePath := path.Join(remoteRemoveDir, file.Name())
 		if file.IsDir() {
 			s.RemoveDir(subRemovePath)
@@ -234,10 +248,18 @@ func (s *FileSyncer) IsIgnoreDir(dirname string) bool {
 }
 
 func newFileSyncer() *FileSyncer {
-	return &FileSyncer{
+	s := &FileSyncer{
 		sftpClient:  nil,
 		syncEvent:   make(chan string),
 		removeEvent: make(chan string),
 		doneEvent:   make(chan struct{}),
 	}
+	if g_SyncCfg.Versions {
+		keepAge, err := scp.ParseAge(g_SyncCfg.KeepAge)
+		if err != nil {
+			log.Printf("invalid KeepAge: %v\n", err)
+		}
+		s.versions = scp.NewVersioner(g_SyncCfg.RemoteDir, g_SyncCfg.KeepVersions, keepAge)
+	}
+	return s
 }
@@ -1,139 +1,21 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"flag"
 	"fmt"
-	"github.com/fsnotify/fsnotify"
+	"github.com/lulugyf/fkme/util"
+	"github.com/lulugyf/fkme/watch"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-type FSEvent struct {
-	Path string
-	Op   int // 1 - create 2 - modify  3 - remove
-}
-type FSWatcher struct {
-	handler      *fsnotify.Watcher
-	basedir      string
-	Events       chan FSEvent
-	ignore_files []string
-	ignore_dirs  []string
-	doneEvent    chan FSEvent
-}
-
-func (f *FSWatcher) Init() {
-	filepath.Walk(f.basedir, func(path string, info os.FileInfo, err error) error {
-		if info != nil && info.IsDir() {
-			path, err := filepath.Abs(path)
-			if err != nil {
-				log.Fatalf("Walk filepath:%s err1:%v\n", path, err)
-			}
-			if f.IsIgnoreDir(path) {
-				// log.Printf("Ignore path: %s\n", path)
-				return nil
-			}
-			err = f.handler.Add(path)
-			if err != nil {
-				log.Fatalf("Walk filepath:%s err2:%v\n", path, err)
-			}
-			log.Printf("Watching path: %s\n", path)
-		}
-
-		return nil
-	})
-}
-
-func (f *FSWatcher) Run() {
-	for {
-		select {
-		case event := <-f.handler.Events:
-			{
-				if (event.Op & fsnotify.Create) == fsnotify.Create {
-					//log.Printf("----create event (name:%s) (op:%v)\n", event.Name, event.Op)
-					file, err := os.Stat(event.Name)
-					if err != nil {
-						log.Printf("----create no exist path:%s (op:%v)\n", event.Name, event.Op)
-						break
-					}
-					if file.IsDir() {
-						f.handler.Add(event.Name)
-					}
-					f.Events <- FSEvent{Path: event.Name, Op: 1}
-				}
-
-				if (event.Op & fsnotify.Write) == fsnotify.Write {
-					//log.Printf("----write event (name:%s) (op:%v)\n", event.Name, event.Op)
-					f.Events <- FSEvent{Path: event.Name, Op: 2}
-				}
-
-				if (event.Op & fsnotify.Remove) == fsnotify.Remove {
-					//log.Printf("----remove event (name:%s) (op:%v)\n", event.Name, event.Op)
-					file, err := os.Stat(event.Name)
-					if err == nil && file.IsDir() {
-						f.handler.Remove(event.Name)
-					}
-					f.Events <- FSEvent{Path: event.Name, Op: 3}
-				}
-			}
-		case err := <-f.handler.Errors:
-			{
-				log.Printf("File Watch Error: %v\n", err)
-			}
-		case <-f.doneEvent:
-			{
-				return
-			}
-		}
-	}
-}
-
-func (f *FSWatcher) Done() {
-	f.doneEvent <- FSEvent{Path: ""}
-}
-
-func (f *FSWatcher) IsIgnoreFile(fpath string) bool {
-	dirname, filename := filepath.Split(fpath)
-	for _, suffix := range f.ignore_files {
-		if strings.HasSuffix(filename, suffix) {
-			return true
-		}
-	}
-	for _, prefix := range f.ignore_dirs {
-		absPrefix := filepath.Join(f.basedir, prefix)
-		if strings.HasPrefix(dirname, absPrefix) {
-			return true
-		}
-	}
-	return false
-}
-
-func (f *FSWatcher) IsIgnoreDir(dirname string) bool {
-	for _, prefix := range f.ignore_dirs {
-		absPrefix := filepath.Join(f.basedir, prefix)
-		if strings.HasPrefix(dirname, absPrefix) {
-			return true
-		}
-	}
-	return false
-}
-
-func newFSWatcher(basedir string, ignore_files []string, ignore_dirs []string) *FSWatcher {
-	fw, _ := fsnotify.NewWatcher()
-	f := &FSWatcher{
-		handler:      fw,
-		basedir:      basedir,
-		Events:       make(chan FSEvent),
-		ignore_dirs:  ignore_dirs,
-		ignore_files: ignore_files,
-	}
-	f.Init()
-	return f
-}
-
 // sftpcli -w d:\worksrc\gosrc\fkme
 
 /**
@@ -142,6 +24,11 @@ fkme watch -w d:\worksrc\gosrc\fkme -i c:/users/yuanf/.ssh/id_rsa_tr -p 2022 -ds
 
 fkme watch -w d:\worksrc\gosrc\fkme -i c:/users/yuanf/.ssh/id_rsa_tr -p 2022 -dst _base_@localhost:/fkme
 
+-- 提供状态查询, 强制同步某个文件或目录: curl -X POST 'http://127.0.0.1:8090/sync?path=scp'
+fkme watch -w d:\worksrc\gosrc\fkme -i c:/users/yuanf/.ssh/id_rsa_tr -p 2022 -dst _base_@localhost:/fkme -status-addr 127.0.0.1:8090
+
+-- 网络文件系统上没有 fsnotify 事件, 每 3 秒扫描一次
+fkme watch -w /mnt/nfs/fkme -i ~/.ssh/id_rsa_tr -p 2022 -dst _base_@localhost:/fkme -poll 3s
 */
 func Watch(args []string) {
 
@@ -151,6 +38,8 @@ func Watch(args []string) {
 	passcode := wCmd.String("pw", "", "ssh password")
 	port := wCmd.Int("p", 22, "ssh port")
 	dst_arg := wCmd.String("dst", "", "destination ssh path: {user}[/{pass}]@{host}:{remote-dir/file}")
+	status_addr := wCmd.String("status-addr", "", "serve status / resync HTTP API on this addr, e.g. 127.0.0.1:8090")
+	poll := wCmd.Duration("poll", 0, "scan for changes at this interval instead of fsnotify, for NFS/CIFS, e.g. 3s")
 	wCmd.Parse(args)
 
 	if *watch_path == "" || *dst_arg == "" {
@@ -159,9 +48,6 @@ func Watch(args []string) {
 	}
 	path := *watch_path
 
-	ignore_files := []string{"~"}
-	ignore_dirs := []string{".idea"}
-
 	dst := *dst_arg
 
 	var (
@@ -194,70 +80,74 @@ func Watch(args []string) {
 
 	log.Printf("Watching %s\n", path)
 
-	f := newFSWatcher(path, ignore_files, ignore_dirs)
-	go f.Run()
-	defer f.Done() // 关闭watcher
-
+	st := util.NewStatus("watch", path, fmt.Sprintf("%s@%s:%s", user, host, rpath))
+	st.SetConnected(true)
 	lpath_len := len(path)
-	wait := func() {
-		upfiles := make(map[string]int)
-		loop := true
-
-		for {
-			if !loop {
-				break
+	var mu sync.Mutex // 监控上传与强制同步互斥
+	upload := func(x string) {
+		mu.Lock()
+		defer mu.Unlock()
+		remote_fpath := strings.Replace(fmt.Sprintf("%s%s", rpath, x[lpath_len:]), "\\", "/", -1)
+		if err := c.Upload(x, remote_fpath); err != nil {
+			st.Error("upload %s failed: %v", x, err)
+			st.SetConnected(false)
+			if err = c.reconnect(); err != nil {
+				st.Error("reconnect failed: %v", err)
+				return
 			}
-			select {
-			case event := <-f.Events:
-				{
-					p := event.Path
-					if p == "" {
-						loop = false
-						break
-					}
-					if p[len(p)-1] == '~' || filepath.Base(p)[0] == '.' {
-						continue
-					}
-					if event.Op == 1 || event.Op == 2 {
-						st, _ := os.Stat(p)
-						if st.IsDir() {
-							continue
-						} else {
-							upfiles[p] = 0
-						}
-					}
-				}
-			case <-time.After(time.Second * 2):
-				{ // 延迟2秒再上传
-					for x, _ := range upfiles {
-						//  sftp operations!  upload
-						remote_fpath := strings.Replace(fmt.Sprintf("%s%s", rpath, x[lpath_len:]), "\\", "/", -1)
-						//log.Printf("--UPLOAD: %s to %s\n", x, remote_fpath)
-						c.Upload(x, remote_fpath)
-					}
-					if len(upfiles) > 0 {
-						upfiles = make(map[string]int)
-					}
-
-				}
+			st.SetConnected(true)
+			if err = c.Upload(x, remote_fpath); err != nil { // 只重试一次
+				st.Error("reupload %s failed: %v", x, err)
+				return
 			}
 		}
+		st.Synced(x)
 	}
-	go wait()
-
-	inputReader := bufio.NewReader(os.Stdin)
-	for {
-		input, err := inputReader.ReadString('\n')
-		if err != nil {
-			log.Printf("read input:%s error:%v\n", input, err)
-			break
-		}
-		input = strings.TrimSpace(input)
-		if input == "quit" {
-			log.Printf("---quit!")
-			break
-		}
-		log.Printf("---[%s]\n", input)
+	if *status_addr != "" {
+		st.OnSync(func(p string) error {
+			fpath, err := util.JoinUnder(path, p)
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stat(fpath); err != nil {
+				return err
+			}
+			return filepath.Walk(fpath, func(fp string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					upload(fp)
+				}
+				return nil
+			})
+		})
+		st.Serve(*status_addr)
 	}
 
+	// 延迟2秒再上传, 忽略编辑器备份文件, 隐藏文件和 .idea 目录
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // 关闭watcher
+	errc := make(chan error, 1)
+	go func() {
+		errc <- watch.Files(ctx, path, &watch.Options{
+			Debounce:     2 * time.Second,
+			Ignore:       []watch.Matcher{watch.IgnoreSuffix("~"), watch.IgnoreHidden(), watch.IgnorePrefix(path, ".idea")},
+			Queue:        st.SetQueue,
+			Poll:         *poll > 0,
+			PollInterval: *poll,
+		}, func(x string) error {
+			upload(x)
+			return nil
+		})
+	}()
+
+	// 等待退出信号, 强制同步通过 -status-addr 的 POST /sync 进行; 监控失败时退出
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case s := <-sig:
+		log.Printf("---quit on %v", s)
+	case err := <-errc:
+		log.Printf("watch %s failed: %v\n", path, err)
+		cancel()
+		os.Exit(1)
+	}
 }
@@ -19,9 +19,13 @@ require (
 require (
 	git.torproject.org/pluggable-transports/goptlib.git v1.0.0
 	github.com/awnumar/memguard v0.22.3
+	github.com/creack/pty v1.1.18
 	github.com/elazarl/goproxy v0.0.0-20220529153421-8ea89ba92021
 	github.com/kevinburke/ssh_config v1.2.0
+	github.com/klauspost/compress v1.15.15
 	github.com/sirupsen/logrus v1.9.0
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
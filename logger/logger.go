@@ -3,16 +3,21 @@ package logger
 import (
 	"fmt"
 	"github.com/phachon/go-logger"
+	"io"
+	"os"
 	"path"
 	"runtime"
 	"sync"
+	"time"
 )
 
 type WriterFunc func(string, ...interface{})
 
 var (
-	logger *go_logger.Logger = nil
-	lock                     = &sync.Mutex{}
+	logger      *go_logger.Logger = nil
+	lock                          = &sync.Mutex{}
+	cur_logfile string
+	to_stderr   bool
 
 	Info  WriterFunc
 	Error WriterFunc
@@ -21,19 +26,22 @@ var (
 )
 
 func _initLogger(logfile string) {
+	cur_logfile = logfile
 	logger = go_logger.NewLogger()
 	//fmt.Printf("logger %v\n", logger)
 
 	logger.Detach("console")
 
-	// console adapter config
-	consoleConfig := &go_logger.ConsoleConfig{
-		Color:      true,                                                       // Does the text display the color
-		JsonFormat: false,                                                      // Whether or not formatted into a JSON string
-		Format:     "%timestamp_format% [%level_string%] %file%:%line% %body%", // JsonFormat is false, logger message output to console format string
+	if !to_stderr {
+		// console adapter config
+		consoleConfig := &go_logger.ConsoleConfig{
+			Color:      true,                                                       // Does the text display the color
+			JsonFormat: false,                                                      // Whether or not formatted into a JSON string
+			Format:     "%timestamp_format% [%level_string%] %file%:%line% %body%", // JsonFormat is false, logger message output to console format string
+		}
+		// add output to the console
+		logger.Attach("console", go_logger.LOGGER_LEVEL_DEBUG, consoleConfig)
 	}
-	// add output to the console
-	logger.Attach("console", go_logger.LOGGER_LEVEL_DEBUG, consoleConfig)
 
 	if logfile != "" {
 		// file adapter config
@@ -59,6 +67,26 @@ func _initLogger(logfile string) {
 	Error = logger.Errorf
 	Debug = logger.Debugf
 	Warn = logger.Warningf
+	if to_stderr {
+		Info = consoleTo(os.Stderr, "Info", Info)
+		Error = consoleTo(os.Stderr, "Error", Error)
+		Debug = consoleTo(os.Stderr, "Debug", Debug)
+		Warn = consoleTo(os.Stderr, "Warning", Warn)
+	}
+}
+
+// console adapter 只能写到 os.Stdout, 写到 w 时由这里输出控制台格式的一行, 然后交给 next(日志文件)
+func consoleTo(w io.Writer, level string, next WriterFunc) WriterFunc {
+	return func(format string, v ...interface{}) {
+		_, file, line, ok := runtime.Caller(1)
+		if !ok {
+			file = "null"
+		}
+		msg := fmt.Sprintf("%s [%s] %s:%d %s\n", time.Now().Format("2006-01-02 15:04:05"), level,
+			path.Base(file), line, fmt.Sprintf(format, v...))
+		io.WriteString(w, msg)
+		next(format, v...)
+	}
 }
 
 func InitLogger(logfile string) {
@@ -75,6 +103,18 @@ func InitLogger(logfile string) {
 	}
 }
 
+// 标准输出用于数据时(如 scp -archive -), 控制台日志改为输出到标准错误
+func UseStderr() {
+	lock.Lock()
+	defer lock.Unlock()
+	to_stderr = true
+	if logger != nil {
+		logger.Detach("console")
+		logger.Detach("file")
+	}
+	_initLogger(cur_logfile)
+}
+
 func write(w WriterFunc, format string, v ...interface{}) {
 	msg := fmt.Sprintf(format, v...)
 	_, file, line, ok := runtime.Caller(2)
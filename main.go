@@ -16,7 +16,9 @@ import (
 	"github.com/lulugyf/fkme/cron"
 	"github.com/lulugyf/fkme/logger"
 	"github.com/lulugyf/fkme/scp"
+	"github.com/lulugyf/fkme/sshd"
 	"github.com/lulugyf/fkme/util"
+	"github.com/lulugyf/fkme/vault"
 	"github.com/lulugyf/fkme/w"
 	"github.com/lulugyf/fkme/ws"
 )
@@ -33,6 +35,10 @@ type SyncConfig struct { //json.Unmarshal struct must public var
 	IgnoreFiles []string
 	IgnoreDirs  []string //relative path to LocalDir
 	ReplaceRule map[string]string
+
+	Versions     bool   // keep old versions in RemoteDir/.fkme-versions before overwrite or remove
+	KeepVersions int    // versions to keep per file, 0 for unlimited
+	KeepAge      string // max age of versions, e.g. 30d
 }
 
 var (
@@ -88,6 +94,9 @@ func main() {
 	logger.InitLogger("")
 	cmdlist := []*CmdItem{
 		&CmdItem{name: "scp", cmd: scp.SCP, desc: "File / Directory synchronize through sftp"},
+		&CmdItem{name: "sftp", cmd: scp.Shell, desc: "Interactive sftp shell"},
+		&CmdItem{name: "sftpd", cmd: sshd.Run, desc: "Embedded ssh server with sftp subsystem"},
+		&CmdItem{name: "sshd", cmd: sshd.RunSSHD, desc: "Embedded ssh server with shell, exec and port forwarding"},
 		&CmdItem{name: "watch", cmd: Watch},
 		&CmdItem{name: "cron", cmd: cron.Run, desc: "A daemon process manager"},
 		&CmdItem{name: "w", cmd: w.Run, desc: "a simple static file webserver"},
@@ -99,8 +108,13 @@ func main() {
 		&CmdItem{name: "pm", cmd: util.PM, desc: "A simple port mapper"},
 		&CmdItem{name: "ws", cmd: ws.Run, desc: "A socks5 server through websocket"},
 		&CmdItem{name: "mtime", cmd: util.Mtime, desc: "Check file modify time"},
+		&CmdItem{name: "untar", cmd: util.Untar, desc: "Extract tar, tar.gz, tar.zst or zip archive"},
 		&CmdItem{name: "azj", cmd: util.AZJ, desc: "Mark encrypted files(to *.c_c.c) and rename Decrypted files(from *.c_c.c_txt)"},
 		&CmdItem{name: "tunnel", cmd: scp.SSHTunnel, desc: "SSH tunnel from config"},
+		&CmdItem{name: "ssh", cmd: scp.SSH, desc: "Interactive ssh client over tcp, socks5, jump hosts or ws"},
+		&CmdItem{name: "run", cmd: scp.RunHosts, desc: "Run a command on many hosts in parallel"},
+		&CmdItem{name: "artifact", cmd: scp.Artifact, desc: "Push / pull versioned artifacts"},
+		&CmdItem{name: "vault", cmd: vault.Run, desc: "Encrypted credential store, referenced as vault:<name>"},
 		&CmdItem{name: "wsmid", cmd: ws.WSMidServ, desc: "Port mapper through web-socket"},
 	}
 	if len(os.Args) < 2 || os.Args[1] == "-h" {
@@ -141,6 +155,9 @@ func main() {
 
 	sargs := os.Args[2:]
 	cmdname := os.Args[1]
+	if stdoutIsData(sargs) {
+		logger.UseStderr()
+	}
 	for _, c := range cmdlist {
 		if c.name == cmdname {
 			logger.Info("starting %s...", cmdname)
@@ -150,3 +167,13 @@ func main() {
 	}
 	logger.Warn("nothing to do!")
 }
+
+// scp -archive - 等把数据写到标准输出的参数
+func stdoutIsData(args []string) bool {
+	for i, s := range args {
+		if s == "-archive=-" || (s == "-archive" && i+1 < len(args) && args[i+1] == "-") {
+			return true
+		}
+	}
+	return false
+}
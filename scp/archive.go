@@ -0,0 +1,372 @@
+package scp
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/lulugyf/fkme/logger"
+	"github.com/lulugyf/fkme/util"
+)
+
+/*
+远端目录与归档文件之间的传输, 格式见 util/archive.go: tar, tar.gz, tar.zst, zip
+
+-archive <file | ->   把远端目录打包到本地文件或标准输出
+-extract <file | ->   把本地归档(或标准输入)解压到远端目录
+-via auto             auto: 远端有 fkme(-extract)或 tar 时在远端执行, 否则通过 sftp 逐个读写文件
+                      也可以指定 fkme, tar, sftp
+
+-- 远端实验目录打包为 exp.tar.zst
+fkme scp -f ~ -archive exp.tar.zst od:train/exp1
+-- 输出到标准输出, 交给其它命令
+fkme scp -f ~ -archive - -format tgz od:train/exp1 | tar tzf -
+-- 只打包 1 天内修改的文件(此时使用 sftp), 见 filter.go
+fkme scp -f ~ -newer-than 1d -archive exp.zip od:train/exp1
+-- 上传并在远端解压, 远端的 fkme 不在 PATH 中时用 -remote-fkme 指定
+fkme scp -f ~ -extract data.tar.zst -remote-fkme /data/bin/fkme od:train/data
+*/
+type archive_args struct {
+	archive     *string
+	extract     *string
+	format      *string
+	via         *string
+	remote_fkme *string
+}
+
+func hasArchiveArg(args []string) bool {
+	for _, s := range args {
+		for _, f := range []string{"-archive", "-extract"} {
+			if s == f || strings.HasPrefix(s, f+"=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 单引号包含, 用于远端命令行
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// 执行远端命令, stdin 为空时不提供输入
+func (c *Cli) remoteRun(command string, stdin io.Reader, stdout io.Writer) error {
+	session, err := c.Ssh.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stderr := &bytes.Buffer{}
+	session.Stdin, session.Stdout, session.Stderr = stdin, stdout, stderr
+	if err := session.Run(command); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// 远端是否有这个命令
+func (c *Cli) remoteHas(name string) bool {
+	return c.remoteRun("command -v "+shellQuote(name), nil, io.Discard) == nil
+}
+
+func RunArchive(args []string) {
+	a := &cmd_args{}
+	cmd := flag.NewFlagSet("scp", flag.ExitOnError)
+	a.define(cmd)
+	a.filter = &Filter{}
+	a.filter.define(cmd)
+	aa := &archive_args{
+		archive:     cmd.String("archive", "", "pack remote dir into this local archive file, - for stdout"),
+		extract:     cmd.String("extract", "", "extract this local archive file into remote dir, - for stdin"),
+		format:      cmd.String("format", "", "tar, tar.gz, tar.zst or zip, default by file name, tar for stdin/stdout"),
+		via:         cmd.String("via", "auto", "auto, fkme, tar or sftp"),
+		remote_fkme: cmd.String("remote-fkme", "fkme", "fkme on remote host, used to extract zip and tar.zst"),
+	}
+	cmd.Parse(args)
+	if cmd.NArg() != 1 || (*aa.archive == "") == (*aa.extract == "") {
+		fmt.Println("fkme scp [-f ~] -archive <file | -> [-format tar.zst] <host:dir>")
+		fmt.Println("fkme scp [-f ~] -extract <file | -> [-format tar.zst] <host:dir>")
+		os.Exit(2)
+	}
+	if err := a.filter.parse(); err != nil {
+		logger.Error("%v", err)
+		os.Exit(2)
+	}
+	name := *aa.archive + *aa.extract
+	format := util.ArchiveFormat(name)
+	if *aa.format != "" {
+		var err error
+		if format, err = util.ParseFormat(*aa.format); err != nil {
+			logger.Error("%v", err)
+			os.Exit(2)
+		}
+	} else if format == "" {
+		format = util.FormatTar
+	}
+
+	c := &Cli{}
+	rpath, err := a.connectHost(c, cmd.Arg(0))
+	if err != nil {
+		logger.Error("connect failed: %v", err)
+		os.Exit(2)
+	}
+	defer c.Close()
+	if rpath == "" {
+		rpath = "."
+	}
+
+	if *aa.archive != "" {
+		err = c.packArchive(rpath, name, format, *aa.via, a.filter)
+	} else {
+		err = c.unpackArchive(name, rpath, format, *aa.via, *aa.remote_fkme)
+	}
+	if err != nil {
+		logger.Error("%v", err)
+		os.Exit(3)
+	}
+}
+
+/*
+打包远端目录 rpath 到本地文件 name
+没有过滤条件且远端有 tar 时使用 tar 命令, 否则通过 sftp 遍历
+写文件时先写 .part, 完成后改名
+*/
+func (c *Cli) packArchive(rpath, name, format, via string, filter *Filter) error {
+	if st, err := c.Sftp.Stat(rpath); err != nil {
+		return err
+	} else if !st.IsDir() {
+		return fmt.Errorf("%s is not a directory", rpath)
+	}
+	out := os.Stdout
+	if name != "-" {
+		f, err := os.Create(name + ".part")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(name + ".part")
+		defer f.Close()
+		out = f
+	}
+	aw, err := util.NewArchiveWriter(out, format)
+	if err != nil {
+		return err
+	}
+
+	use_tar := false
+	switch via {
+	case "tar":
+		use_tar = true
+	case "auto":
+		use_tar = filter.empty() && c.remoteHas("tar")
+	}
+	files, bytes := 0, int64(0)
+	if use_tar {
+		logger.Info("pack %s with remote tar", rpath)
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			var err error
+			files, bytes, err = util.CopyTar(aw, pr)
+			if err == nil {
+				io.Copy(io.Discard, pr) // 归档结束标记之后的填充
+			}
+			pr.CloseWithError(err)
+			done <- err
+		}()
+		err = c.remoteRun("tar -C "+shellQuote(rpath)+" -cf - .", nil, pw)
+		pw.CloseWithError(err)
+		if err1 := <-done; err == nil {
+			err = err1
+		}
+	} else {
+		logger.Info("pack %s with sftp", rpath)
+		files, bytes, err = c.walkArchive(aw, rpath, filter)
+	}
+	if err1 := aw.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	if name != "-" {
+		if err := out.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(name+".part", name); err != nil {
+			return err
+		}
+	}
+	logger.Info("%s:%s => %s, %d files, %d bytes", c.remote, rpath, name, files, bytes)
+	return nil
+}
+
+func (c *Cli) walkArchive(aw util.ArchiveWriter, rpath string, filter *Filter) (int, int64, error) {
+	files, bytes := 0, int64(0)
+	filter = filter.walk()
+	walker := c.Sftp.Walk(rpath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return files, bytes, err
+		}
+		p, info := walker.Path(), walker.Stat()
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, rpath), "/")
+		if rel == "" {
+			continue
+		}
+		if isVersionPath(rel) || !filter.Match(path.Dir(p), info, c.remoteReadDir) {
+			if info.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			l, err := c.Sftp.ReadLink(p)
+			if err != nil {
+				return files, bytes, err
+			}
+			link = l
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return files, bytes, err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := aw.WriteHeader(hdr); err != nil {
+			return files, bytes, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		f, err := c.Sftp.Open(p)
+		if err != nil {
+			return files, bytes, err
+		}
+		n, err := io.Copy(aw, f)
+		f.Close()
+		if err != nil {
+			return files, bytes, err
+		}
+		files++
+		bytes += n
+	}
+	return files, bytes, nil
+}
+
+/*
+把本地归档 name 解压到远端目录 rpath:
+  fkme  远端有 fkme 时, 数据传给 fkme untar, 支持所有格式
+  tar   远端有 tar 且格式为 tar / tar.gz 时, 传给 tar
+  sftp  在本地读取归档, 逐个写入远端文件
+*/
+func (c *Cli) unpackArchive(name, rpath, format, via, remote_fkme string) error {
+	in := os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	if via == "auto" {
+		switch {
+		case c.remoteHas(remote_fkme):
+			via = "fkme"
+		case (format == util.FormatTar || format == util.FormatTgz) && c.remoteHas("tar"):
+			via = "tar"
+		default:
+			via = "sftp"
+		}
+	}
+	logger.Info("extract %s to %s:%s with %s", name, c.remote, rpath, via)
+	switch via {
+	case "fkme":
+		return c.remoteRun(fmt.Sprintf("%s untar -C %s -format %s -", shellQuote(remote_fkme),
+			shellQuote(rpath), format), in, os.Stderr)
+	case "tar":
+		flags := "-xf"
+		if format == util.FormatTgz {
+			flags = "-xzf"
+		} else if format != util.FormatTar {
+			return fmt.Errorf("remote tar does not support %s, use -via fkme or sftp", format)
+		}
+		return c.remoteRun(fmt.Sprintf("mkdir -p %s && tar -C %s %s -", shellQuote(rpath), shellQuote(rpath), flags),
+			in, os.Stderr)
+	case "sftp":
+		if err := c.Sftp.MkdirAll(rpath); err != nil {
+			return err
+		}
+		return util.ReadArchive(in, format, func(hdr *tar.Header, r io.Reader) error {
+			return c.extractEntry(rpath, hdr, r)
+		})
+	}
+	return fmt.Errorf("unknown -via %s", via)
+}
+
+// 与 util.Extract 相同, 写入远端
+func (c *Cli) extractEntry(rpath string, hdr *tar.Header, r io.Reader) error {
+	name := path.Clean("/" + hdr.Name) // 不允许跳出 rpath
+	if name == "/" {
+		return nil
+	}
+	p := path.Join(rpath, name)
+	// 与 util.SafeJoin 相同, rpath 下的上级目录不能是符号链接
+	dir := rpath
+	for _, s := range strings.Split(path.Dir(name), "/")[1:] {
+		if s == "" { // 在 rpath 下, rpath 本身可以是符号链接
+			break
+		}
+		dir = path.Join(dir, s)
+		fi, err := c.Sftp.Lstat(dir)
+		if err != nil {
+			break
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("illegal path in archive: %s, %s is a symlink", hdr.Name, dir)
+		}
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return c.Sftp.MkdirAll(p)
+	case tar.TypeSymlink:
+		c.Sftp.MkdirAll(path.Dir(p))
+		c.Sftp.Remove(p)
+		return c.Sftp.Symlink(hdr.Linkname, p)
+	case tar.TypeReg, tar.TypeRegA:
+	default:
+		return nil
+	}
+	if fi, err := c.Sftp.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		c.Sftp.Remove(p) // 不跟随已有的符号链接写入
+	}
+	c.Sftp.MkdirAll(path.Dir(p))
+	f, err := c.Sftp.Create(p)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	c.Sftp.Chmod(p, hdr.FileInfo().Mode().Perm())
+	if !hdr.ModTime.IsZero() {
+		c.Sftp.Chtimes(p, hdr.ModTime, hdr.ModTime)
+	}
+	return nil
+}
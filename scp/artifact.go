@@ -0,0 +1,257 @@
+package scp
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lulugyf/fkme/artifact"
+	"github.com/lulugyf/fkme/logger"
+	"github.com/lulugyf/fkme/vault"
+	"github.com/lulugyf/fkme/vfs"
+)
+
+/*
+带版本的制品上传下载, 见 artifact 包
+仓库地址与 scp 的端点相同: host:dir, user[/pass]@host:dir, sftp://, webdav(s)://, 本地目录
+
+-- 上传 output/best 作为 resnet 的新版本, 并设为最新版本
+fkme artifact push -f ~ -meta acc=0.93 -meta epoch=40 ./output/best od:/models resnet
+-- 上传 output 下修改时间最新的文件或目录(原来 sftpcli -op send 的方式)
+fkme artifact push -f ~ -newest ./output od:/models resnet
+-- 下载最新版本, 或指定版本
+fkme artifact pull -f ~ od:/models resnet ./model
+fkme artifact pull -f ~ od:/models resnet@20221020-153000 ./model
+-- 列出仓库中的 id, 以及 id 的所有版本
+fkme artifact list -f ~ od:/models
+fkme artifact list -f ~ od:/models resnet
+-- 只保留最新的 5 个版本, 以及 7 天内的版本
+fkme artifact gc -f ~ -keep 5 -keep-age 7d od:/models resnet
+-- 把某个版本设为最新版本(回滚)
+fkme artifact latest -f ~ od:/models resnet 20221020-153000
+
+-serv 为凭据库中的服务器地址 host:port:user:pass(见 vault 包), 此时仓库为其中的 /models, 命令行中不再写仓库地址
+fkme artifact pull -serv vault:models resnet ./model
+*/
+type metaFlags map[string]string
+
+func (m metaFlags) String() string {
+	return fmt.Sprintf("%v", map[string]string(m))
+}
+
+func (m metaFlags) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return errors.New("meta must be key=value")
+	}
+	m[kv[0]] = kv[1]
+	return nil
+}
+
+func artifactUsage() {
+	fmt.Println("fkme artifact push [-f ~] [-version v] [-meta k=v] [-newest] <local-path> <store> <id>")
+	fmt.Println("fkme artifact pull [-f ~] <store> <id>[@version] <local-dir>")
+	fmt.Println("fkme artifact list [-f ~] <store> [id]")
+	fmt.Println("fkme artifact gc [-f ~] [-keep n] [-keep-age 30d] [-n] <store> <id>")
+	fmt.Println("fkme artifact latest [-f ~] <store> <id> [version]")
+	fmt.Println("  store: host:dir, user[/pass]@host:dir, sftp://, webdav(s)://, local dir, omitted when -serv is given")
+}
+
+func Artifact(args []string) {
+	if len(args) < 1 {
+		artifactUsage()
+		os.Exit(2)
+	}
+	op := args[0]
+	a := &cmd_args{}
+	cmd := flag.NewFlagSet("artifact "+op, flag.ExitOnError)
+	a.define(cmd)
+	serv := cmd.String("serv", "", "encoded sftp server address of old sftpcli, store is /models on it")
+	version := cmd.String("version", "", "push: version name, default current time")
+	newest := cmd.Bool("newest", false, "push: upload the newest file or dir under local-path")
+	meta := metaFlags{}
+	cmd.Var(meta, "meta", "push: key=value metadata, can be repeated")
+	keep := cmd.Int("keep", 5, "gc: number of newest versions to keep")
+	keep_age := cmd.String("keep-age", "", "gc: also keep versions younger than this, e.g. 30d")
+	dry_run := cmd.Bool("n", false, "gc: only print versions to remove")
+	cmd.Parse(args[1:])
+
+	rest := cmd.Args()
+	local := ""
+	if op == "push" && len(rest) > 0 {
+		// push 的本地路径写在仓库之前
+		local, rest = rest[0], rest[1:]
+	}
+	store_spec := ""
+	if *serv != "" {
+		addr, err := servURL(*serv)
+		if err != nil {
+			logger.Error("invalid -serv: %v", err)
+			os.Exit(2)
+		}
+		store_spec = addr
+	} else if len(rest) > 0 {
+		store_spec, rest = rest[0], rest[1:]
+	}
+	if store_spec == "" {
+		artifactUsage()
+		os.Exit(2)
+	}
+
+	ep, err := a.openEndpoint(store_spec)
+	if err != nil {
+		logger.Error("open %s failed: %v", store_spec, err)
+		os.Exit(2)
+	}
+	defer ep.Close()
+	st := artifact.New(ep.fs, ep.path)
+
+	switch {
+	case op == "push" && len(rest) == 1:
+		if *newest {
+			if local, err = newestEntry(local); err != nil {
+				logger.Error("%v", err)
+				os.Exit(3)
+			}
+		}
+		m, err := st.Push(vfs.Local{}, filepath.ToSlash(local), rest[0], *version, meta)
+		if err != nil {
+			logger.Error("push failed: %v", err)
+			os.Exit(3)
+		}
+		logger.Info("pushed %s => %v/%s@%s, %d files, %d bytes", local, ep, m.ID, m.Version, len(m.Files), m.Size)
+		fmt.Println(m.Version)
+	case op == "pull" && len(rest) == 2:
+		id, ver := rest[0], ""
+		if i := strings.LastIndex(id, "@"); i > 0 {
+			id, ver = id[:i], id[i+1:]
+		}
+		m, err := st.Pull(id, ver, vfs.Local{}, filepath.ToSlash(rest[1]))
+		if err != nil {
+			logger.Error("pull failed: %v", err)
+			os.Exit(3)
+		}
+		logger.Info("pulled %s@%s => %s, %d files, %d bytes", m.ID, m.Version, rest[1], len(m.Files), m.Size)
+		fmt.Println(m.Version)
+	case op == "list" && len(rest) == 0:
+		ids, err := st.IDs()
+		if err != nil {
+			logger.Error("%v", err)
+			os.Exit(3)
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+	case op == "list" && len(rest) == 1:
+		list, err := st.List(rest[0])
+		if err != nil {
+			logger.Error("%v", err)
+			os.Exit(3)
+		}
+		latest, _ := st.Latest(rest[0])
+		for _, m := range list {
+			mark := " "
+			if m.Version == latest {
+				mark = "*"
+			}
+			fmt.Printf("%s %-20s %s %6d files %12d bytes  %v\n", mark, m.Version,
+				m.Created.Format("2006-01-02 15:04:05"), len(m.Files), m.Size, metaString(m.Meta))
+		}
+	case op == "gc" && len(rest) == 1:
+		age, err := ParseAge(*keep_age)
+		if err != nil {
+			logger.Error("%v", err)
+			os.Exit(2)
+		}
+		removed, err := st.GC(rest[0], *keep, age, *dry_run)
+		for _, v := range removed {
+			fmt.Println("remove", v)
+		}
+		if err != nil {
+			logger.Error("gc failed: %v", err)
+			os.Exit(3)
+		}
+	case op == "latest" && len(rest) == 1:
+		v, err := st.Latest(rest[0])
+		if err != nil {
+			logger.Error("%v", err)
+			os.Exit(3)
+		}
+		fmt.Println(v)
+	case op == "latest" && len(rest) == 2:
+		if _, err := st.Manifest(rest[0], rest[1]); err != nil {
+			logger.Error("%v", err)
+			os.Exit(3)
+		}
+		if err := st.SetLatest(rest[0], rest[1]); err != nil {
+			logger.Error("%v", err)
+			os.Exit(3)
+		}
+	default:
+		artifactUsage()
+		os.Exit(2)
+	}
+}
+
+func metaString(meta map[string]string) string {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ss := make([]string, len(keys))
+	for i, k := range keys {
+		ss[i] = k + "=" + meta[k]
+	}
+	return strings.Join(ss, " ")
+}
+
+/*
+目录中修改时间最新的文件或目录
+*/
+func newestEntry(local_dir string) (string, error) {
+	files, err := localReadDir(local_dir)
+	if err != nil {
+		return "", err
+	}
+	var newest os.FileInfo
+	for _, f := range files {
+		if newest == nil || f.ModTime().After(newest.ModTime()) {
+			newest = f
+		}
+	}
+	if newest == nil {
+		return "", fmt.Errorf("no file(s) found in %s", local_dir)
+	}
+	return path.Join(filepath.ToSlash(local_dir), newest.Name()), nil
+}
+
+/*
+-serv 转为 sftp:// 地址, 值为 vault:<name> 时从凭据库中读取 host:port:user:pass
+原来的加密地址仍然可以使用, 但密钥是公开的, 建议用 fkme vault add -serv 导入
+*/
+func servURL(serv string) (string, error) {
+	addr := ""
+	if vault.IsRef(serv) {
+		s, err := vault.Resolve(serv)
+		if err != nil {
+			return "", err
+		}
+		addr = s
+	} else {
+		logger.Warn("encoded -serv is deprecated, import it with: fkme vault add -serv <encoded> <name>")
+		addr = vault.DecodeServ(serv)
+	}
+	xx := strings.SplitN(addr, ":", 4)
+	if len(xx) != 4 {
+		return "", errors.New("expect host:port:user:pass")
+	}
+	u := &url.URL{Scheme: "sftp", User: url.UserPassword(xx[2], xx[3]), Host: xx[0] + ":" + xx[1], Path: "/models"}
+	return u.String(), nil
+}
@@ -0,0 +1,220 @@
+package scp
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lulugyf/fkme/logger"
+)
+
+/*
+按文件属性过滤传输的文件, 用于 UploadDir / DownloadDir / ChanUpload / ChanDownload 和守护模式
+
+-max-size 100M          跳过大于 100M 的文件, 单位 K/M/G/T, 不带单位为字节
+-min-size 1K            跳过小于 1K 的文件
+-newer-than 12h         只传输 12 小时内修改过的文件, 单位同 time.ParseDuration, 另外支持 d(天)
+-older-than 7d          只传输 7 天之前修改的文件
+-latest-per-glob *.ckpt 同一目录中匹配 *.ckpt 的最新文件总是传输, 不受其它条件限制, 较旧的仍按其它条件过滤, 可用逗号分隔多个
+-regular                只传输普通文件, 跳过符号链接/设备等
+
+-- 跳过大于 1G 的文件, 但 *.ckpt 中最新的一个总是传输
+fkme scp -f ~ -max-size 1G -latest-per-glob '*.ckpt' od:train/output ./output
+*/
+type Filter struct {
+	MaxSize       int64
+	MinSize       int64
+	NewerThan     time.Duration
+	OlderThan     time.Duration
+	LatestPerGlob []string
+	Regular       bool
+
+	newest *newestCache // 见 walk
+
+	max_size, min_size, newer_than, older_than, latest *string
+}
+
+// 注册过滤参数, 解析后需要调用 parse
+func (f *Filter) define(cmd *flag.FlagSet) {
+	f.max_size = cmd.String("max-size", "", "skip files larger than this, e.g. 100M")
+	f.min_size = cmd.String("min-size", "", "skip files smaller than this, e.g. 1K")
+	f.newer_than = cmd.String("newer-than", "", "only files modified within this duration, e.g. 12h, 2d")
+	f.older_than = cmd.String("older-than", "", "only files modified before this duration, e.g. 7d")
+	f.latest = cmd.String("latest-per-glob", "", "only the newest file per directory matching the glob(s), comma separated")
+	cmd.BoolVar(&f.Regular, "regular", false, "only regular files")
+}
+
+func (f *Filter) parse() error {
+	var err error
+	if f.MaxSize, err = ParseSize(*f.max_size); err != nil {
+		return err
+	}
+	if f.MinSize, err = ParseSize(*f.min_size); err != nil {
+		return err
+	}
+	if f.NewerThan, err = ParseAge(*f.newer_than); err != nil {
+		return err
+	}
+	if f.OlderThan, err = ParseAge(*f.older_than); err != nil {
+		return err
+	}
+	if *f.latest != "" {
+		f.LatestPerGlob = strings.Split(*f.latest, ",")
+	}
+	for _, g := range f.LatestPerGlob {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("invalid glob %s", g)
+		}
+	}
+	return nil
+}
+
+// 没有设置任何条件
+func (f *Filter) empty() bool {
+	return f == nil || (f.MaxSize == 0 && f.MinSize == 0 && f.NewerThan == 0 &&
+		f.OlderThan == 0 && len(f.LatestPerGlob) == 0 && !f.Regular)
+}
+
+// 解析大小: 100 / 10K / 1.5M / 2G / 1T
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(s, "B")
+	mul := int64(1)
+	for i, u := range "KMGT" {
+		if strings.HasSuffix(s, string(u)) {
+			mul = int64(1) << (10 * uint(i+1))
+			s = s[:len(s)-1]
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %s", s)
+	}
+	return int64(v * float64(mul)), nil
+}
+
+// 解析时长, time.ParseDuration 的格式, 另外支持 d 表示天
+func ParseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		v, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", s)
+		}
+		return time.Duration(v * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %s", s)
+	}
+	return d, nil
+}
+
+func localReadDir(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dir)
+}
+
+func (c *Cli) remoteReadDir(dir string) ([]os.FileInfo, error) {
+	return c.Sftp.ReadDir(dir)
+}
+
+// 每个 (目录, glob) 中匹配的文件的最新修改时间, 只在一次遍历中有效
+type newestCache struct {
+	mu sync.Mutex
+	m  map[string]time.Time
+}
+
+/*
+用于一次目录遍历的 Filter, latest-per-glob 每个目录只列出一次
+遍历之间目录可能变化, 每次遍历开始时调用, 单个文件的检查(守护模式)直接用 f
+*/
+func (f *Filter) walk() *Filter {
+	if f.empty() || len(f.LatestPerGlob) == 0 {
+		return f
+	}
+	w := *f
+	w.newest = &newestCache{m: map[string]time.Time{}}
+	return &w
+}
+
+// dir 中匹配 g 的文件的最新修改时间, 列目录失败时返回零值(全部通过)
+func (f *Filter) newestIn(dir, g string, readDir func(string) ([]os.FileInfo, error)) time.Time {
+	key := dir + "\x00" + g
+	if f.newest != nil {
+		f.newest.mu.Lock()
+		defer f.newest.mu.Unlock()
+		if t, ok := f.newest.m[key]; ok {
+			return t
+		}
+	}
+	var newest time.Time
+	if files, err := readDir(dir); err != nil {
+		logger.Warn("filter: read dir %s failed %v", dir, err)
+	} else {
+		for _, fi := range files {
+			if ok, _ := path.Match(g, fi.Name()); ok && !fi.IsDir() && fi.ModTime().After(newest) {
+				newest = fi.ModTime()
+			}
+		}
+	}
+	if f.newest != nil {
+		f.newest.m[key] = newest
+	}
+	return newest
+}
+
+/*
+检查文件是否需要传输, dir 为文件所在目录(本地或远端), readDir 用于 latest-per-glob 列出同目录的文件
+目录总是返回 true
+*/
+func (f *Filter) Match(dir string, info os.FileInfo, readDir func(string) ([]os.FileInfo, error)) bool {
+	if f.empty() || info.IsDir() {
+		return true
+	}
+	name := info.Name()
+	for _, g := range f.LatestPerGlob {
+		if ok, _ := path.Match(g, name); !ok {
+			continue
+		}
+		// 同目录中匹配的最新文件, 不受其它条件限制; 较旧的继续检查其它条件
+		if !f.newestIn(dir, g, readDir).After(info.ModTime()) {
+			return true
+		}
+	}
+	if f.Regular && !info.Mode().IsRegular() {
+		return false
+	}
+	if f.MaxSize > 0 && info.Size() > f.MaxSize {
+		return false
+	}
+	if f.MinSize > 0 && info.Size() < f.MinSize {
+		return false
+	}
+	age := time.Since(info.ModTime())
+	if f.NewerThan > 0 && age > f.NewerThan {
+		return false
+	}
+	if f.OlderThan > 0 && age < f.OlderThan {
+		return false
+	}
+	return true
+}
+
+// 本地文件是否需要传输
+func (f *Filter) matchLocal(fpath string, info os.FileInfo) bool {
+	return f.Match(filepath.Dir(fpath), info, localReadDir)
+}
@@ -0,0 +1,117 @@
+package scp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"100", 100, true},
+		{"10K", 10 << 10, true},
+		{"10kb", 10 << 10, true},
+		{"1.5M", 3 << 19, true},
+		{"2G", 2 << 30, true},
+		{"1T", 1 << 40, true},
+		{"-1K", 0, false},
+		{"abc", 0, false},
+		{"1X", 0, false},
+	}
+	for _, c := range cases {
+		v, err := ParseSize(c.s)
+		if (err == nil) != c.ok || v != c.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d ok=%v", c.s, v, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	cases := []struct {
+		s    string
+		want time.Duration
+		ok   bool
+	}{
+		{"", 0, true},
+		{"12h", 12 * time.Hour, true},
+		{"90s", 90 * time.Second, true},
+		{"2d", 48 * time.Hour, true},
+		{"0.5d", 12 * time.Hour, true},
+		{"xd", 0, false},
+		{"7", 0, false},
+	}
+	for _, c := range cases {
+		v, err := ParseAge(c.s)
+		if (err == nil) != c.ok || v != c.want {
+			t.Errorf("ParseAge(%q) = %v, %v, want %v ok=%v", c.s, v, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	files := []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{"a.ckpt", 2048, 3 * time.Hour},
+		{"b.ckpt", 2048, 2 * time.Hour}, // 最新的 ckpt
+		{"c.ckpt", 10, 5 * time.Hour},
+		{"small.txt", 10, time.Hour},
+		{"big.txt", 2048, time.Hour},
+		{"old.txt", 10, 48 * time.Hour},
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, f.name)
+		ioutil.WriteFile(p, make([]byte, f.size), 0644)
+		os.Chtimes(p, now.Add(-f.age), now.Add(-f.age))
+	}
+	os.Symlink("small.txt", filepath.Join(dir, "link.txt"))
+
+	cases := []struct {
+		filter Filter
+		want   string // 通过的文件
+	}{
+		{Filter{}, "a.ckpt b.ckpt big.txt c.ckpt link.txt old.txt small.txt"},
+		{Filter{MaxSize: 1024}, "c.ckpt link.txt old.txt small.txt"},
+		{Filter{MinSize: 1024}, "a.ckpt b.ckpt big.txt"},
+		{Filter{NewerThan: 4 * time.Hour}, "a.ckpt b.ckpt big.txt link.txt small.txt"},
+		{Filter{OlderThan: 4 * time.Hour}, "c.ckpt old.txt"},
+		{Filter{Regular: true}, "a.ckpt b.ckpt big.txt c.ckpt old.txt small.txt"},
+		// 最新的 ckpt 总是通过, 较旧的按其它条件过滤
+		{Filter{LatestPerGlob: []string{"*.ckpt"}}, "a.ckpt b.ckpt big.txt c.ckpt link.txt old.txt small.txt"},
+		{Filter{LatestPerGlob: []string{"*.ckpt"}, MaxSize: 1024}, "b.ckpt c.ckpt link.txt old.txt small.txt"},
+		{Filter{LatestPerGlob: []string{"*.ckpt"}, NewerThan: time.Minute}, "b.ckpt link.txt"},
+		{Filter{LatestPerGlob: []string{"*.txt"}, MinSize: 1024}, "a.ckpt b.ckpt big.txt link.txt"}, // link.txt 是最新的 txt
+	}
+	for _, c := range cases {
+		f := c.filter.walk()
+		infos, _ := ioutil.ReadDir(dir)
+		got := ""
+		for _, fi := range infos {
+			if l, _ := os.Lstat(filepath.Join(dir, fi.Name())); f.Match(dir, l, localReadDir) {
+				if got != "" {
+					got += " "
+				}
+				got += fi.Name()
+			}
+		}
+		if got != c.want {
+			t.Errorf("%+v: got %q, want %q", c.filter, got, c.want)
+		}
+	}
+}
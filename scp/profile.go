@@ -0,0 +1,391 @@
+package scp
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lulugyf/fkme/logger"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+项目根目录下的 .fkme.yaml, 定义命名的同步配置, 用 fkme scp @name 执行
+
+profiles:
+  train:
+    src: .                     # 本地路径相对于 .fkme.yaml 所在目录
+    dst: ud7:gosrc/fkme        # ssh config 中的名称, 或者 user[/pass]@host:path
+    ssh_config: "~"            # 同 -f
+    key: ~/.ssh/id_rsa_tr      # 同 -i
+    port: 22                   # 同 -p
+    s5: 127.0.0.1:8007         # 同 -s5
+    concurrency: 4             # 同 -c
+    mode: daemon               # push / pull / mirror / daemon, 默认根据远端所在的一侧决定 push 或 pull
+    status_addr: 127.0.0.1:8090  # daemon 模式下的状态 HTTP 地址, 同 -status-addr
+    poll: 3s                   # daemon 模式下定时扫描代替 fsnotify, 同 -poll
+    versions:                  # 覆盖或删除远端文件前保留旧版本, 见 versions.go
+      enable: true
+      keep: 10
+      keep_age: 30d
+    ignores: [".git/", "*.pyc", "__pycache__/"]
+    filter:                    # 见 filter.go
+      max_size: 1G
+      newer_than: 2d
+      latest_per_glob: "*.ckpt"
+      regular: true
+    hooks:
+      pre: make                # 同步前在本地执行
+      post: echo done          # 同步后在本地执行
+      exec: "{} mtime"         # 同步后在远端执行, {} 替换为远端路径, daemon 模式下每个文件上传后执行
+
+fkme scp @train
+fkme scp @train @infer      # 多个 profile 在同一个进程中并行运行
+fkme scp -conf ../x.yaml -list
+
+-- 主机组, 用于 fkme run @gpu, 见 run.go
+groups:
+  gpu: [gpu1, gpu2, app@10.1.1.7]
+*/
+const profileFile = ".fkme.yaml"
+
+type SyncHooks struct {
+	Pre  string `yaml:"pre"`
+	Post string `yaml:"post"`
+	Exec string `yaml:"exec"`
+}
+
+type ProfileFilter struct {
+	MaxSize       string `yaml:"max_size"`
+	MinSize       string `yaml:"min_size"`
+	NewerThan     string `yaml:"newer_than"`
+	OlderThan     string `yaml:"older_than"`
+	LatestPerGlob string `yaml:"latest_per_glob"`
+	Regular       bool   `yaml:"regular"`
+}
+
+type ProfileVersions struct {
+	Enable  bool   `yaml:"enable"`
+	Keep    int    `yaml:"keep"`
+	KeepAge string `yaml:"keep_age"`
+}
+
+type SyncProfile struct {
+	Src         string          `yaml:"src"`
+	Dst         string          `yaml:"dst"`
+	SSHConfig   string          `yaml:"ssh_config"`
+	Key         string          `yaml:"key"`
+	Password    string          `yaml:"password"`
+	Port        int             `yaml:"port"`
+	S5          string          `yaml:"s5"`
+	Concurrency int             `yaml:"concurrency"`
+	Mode        string          `yaml:"mode"`
+	StatusAddr  string          `yaml:"status_addr"`
+	Poll        time.Duration   `yaml:"poll"`
+	Versions    ProfileVersions `yaml:"versions"`
+	Ignores     []string        `yaml:"ignores"`
+	Filter      ProfileFilter   `yaml:"filter"`
+	Hooks       SyncHooks       `yaml:"hooks"`
+}
+
+type ProfileConf struct {
+	Profiles map[string]*SyncProfile `yaml:"profiles"`
+	Groups   map[string][]string     `yaml:"groups"`
+	root     string                  // .fkme.yaml 所在目录
+}
+
+// 从当前目录开始逐级向上查找 .fkme.yaml
+func findProfileFile() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		p := filepath.Join(dir, profileFile)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("%s not found", profileFile)
+		}
+		dir = parent
+	}
+}
+
+func LoadProfiles(conf_file string) (*ProfileConf, error) {
+	if conf_file == "" {
+		p, err := findProfileFile()
+		if err != nil {
+			return nil, err
+		}
+		conf_file = p
+	}
+	data, err := ioutil.ReadFile(conf_file)
+	if err != nil {
+		return nil, err
+	}
+	conf := &ProfileConf{}
+	if err := yaml.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("parse %s failed: %v", conf_file, err)
+	}
+	conf.root, _ = filepath.Abs(filepath.Dir(conf_file))
+	logger.Info("using profiles from %s", conf_file)
+	return conf, nil
+}
+
+// 是否为远端路径, 排除 windows 的盘符 d:/xx
+func isRemotePath(s string) bool {
+	return strings.Index(s, ":") > 1
+}
+
+// 在本地执行 hook 命令, 工作目录为项目根目录
+func runLocal(command, dir string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+/*
+mirror 模式: 删除远端存在而本地不存在的文件, 忽略的文件不删除
+*/
+func (c *Cli) mirrorClean(local_dir, remote_dir string) error {
+	ignores := c.loadIgnores(local_dir)
+	walker := c.Sftp.Walk(remote_dir)
+	for walker.Step() {
+		if walker.Err() != nil {
+			logger.Warn("walk %s: %v", walker.Path(), walker.Err())
+			continue
+		}
+		rel := strings.TrimPrefix(walker.Path()[len(remote_dir):], "/")
+		if rel == "" {
+			continue
+		}
+		if ignores.match_path(rel) || isVersionPath(rel) {
+			if walker.Stat().IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(local_dir, filepath.FromSlash(rel))); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		logger.Info("mirror: remove %s", walker.Path())
+		if c.versions != nil {
+			if err := c.versions.BackupAll(c.Sftp, walker.Path()); err != nil {
+				return err
+			}
+		}
+		if err := c.RemoveAll(walker.Path()); err != nil {
+			return err
+		}
+		if walker.Stat().IsDir() {
+			walker.SkipDir()
+		}
+	}
+	return nil
+}
+
+func (p *SyncProfile) run(name, root string) error {
+	local_path, remote_spec := p.Src, p.Dst
+	to_remote := true
+	if isRemotePath(p.Src) && !isRemotePath(p.Dst) {
+		local_path, remote_spec = p.Dst, p.Src
+		to_remote = false
+	} else if !isRemotePath(p.Dst) {
+		return fmt.Errorf("profile %s: one of src / dst must be remote", name)
+	}
+	mode := p.Mode
+	if mode == "" {
+		mode = "push"
+		if !to_remote {
+			mode = "pull"
+		}
+	}
+	switch mode {
+	case "push", "mirror", "daemon":
+		if !to_remote {
+			return fmt.Errorf("profile %s: mode %s needs a remote dst", name, mode)
+		}
+	case "pull":
+		if to_remote {
+			return fmt.Errorf("profile %s: mode pull needs a remote src", name)
+		}
+	default:
+		return fmt.Errorf("profile %s: unknown mode %s", name, mode)
+	}
+	if !filepath.IsAbs(local_path) {
+		local_path = filepath.Join(root, local_path)
+	}
+
+	pf := &p.Filter
+	filter := &Filter{max_size: &pf.MaxSize, min_size: &pf.MinSize, newer_than: &pf.NewerThan,
+		older_than: &pf.OlderThan, latest: &pf.LatestPerGlob, Regular: pf.Regular}
+	if err := filter.parse(); err != nil {
+		return fmt.Errorf("profile %s: %v", name, err)
+	}
+
+	if p.Hooks.Pre != "" {
+		logger.Info("[%s] pre: %s", name, p.Hooks.Pre)
+		if err := runLocal(p.Hooks.Pre, root); err != nil {
+			return fmt.Errorf("profile %s: pre hook failed: %v", name, err)
+		}
+	}
+
+	port := p.Port
+	if port == 0 {
+		port = 22
+	}
+	a := &cmd_args{key_file: &p.Key, passcode: &p.Password, port: &port,
+		conf_file: &p.SSHConfig, s5: &p.S5}
+	c := &Cli{ignores: p.Ignores, filter: filter}
+	remote_path, err := a.connectHost(c, remote_spec)
+	if err != nil {
+		return fmt.Errorf("profile %s: %v", name, err)
+	}
+	defer c.Close()
+	logger.Info("[%s] %s local[%s] remote[%s]", name, mode, local_path, remote_path)
+	if p.Versions.Enable && mode != "pull" {
+		age, err := ParseAge(p.Versions.KeepAge)
+		if err != nil {
+			return fmt.Errorf("profile %s: %v", name, err)
+		}
+		c.versions = NewVersioner(remote_path, p.Versions.Keep, age)
+	}
+
+	remoteExec := func(remote_file string) {
+		if p.Hooks.Exec == "" {
+			return
+		}
+		cmd := strings.ReplaceAll(p.Hooks.Exec, "{}", remote_file)
+		logger.Warn("[%s] exec [%s]", name, cmd)
+		fmt.Printf("[[[%s]]]\n", c.executeCmd(cmd))
+	}
+
+	switch mode {
+	case "pull":
+		if p.Concurrency > 1 {
+			c.ChanDownload(remote_path, local_path, p.Concurrency)
+		} else if !c.DownloadDir(remote_path, local_path) {
+			return fmt.Errorf("profile %s: download failed", name)
+		}
+	case "daemon":
+		if !c.UploadDir(local_path, remote_path) {
+			return fmt.Errorf("profile %s: upload failed", name)
+		}
+		remoteExec(remote_path)
+		c.watchUpload(local_path, remote_path, p.StatusAddr, p.Poll, remoteExec)
+		return nil
+	default:
+		if p.Concurrency > 1 {
+			c.ChanUpload(local_path, remote_path, p.Concurrency)
+		} else if !c.UploadDir(local_path, remote_path) {
+			return fmt.Errorf("profile %s: upload failed", name)
+		}
+		if mode == "mirror" {
+			if st, err := os.Stat(local_path); err == nil && st.IsDir() {
+				if err := c.mirrorClean(local_path, path.Clean(remote_path)); err != nil {
+					return fmt.Errorf("profile %s: mirror failed: %v", name, err)
+				}
+			}
+		}
+	}
+	remoteExec(remote_path)
+
+	if p.Hooks.Post != "" {
+		logger.Info("[%s] post: %s", name, p.Hooks.Post)
+		if err := runLocal(p.Hooks.Post, root); err != nil {
+			return fmt.Errorf("profile %s: post hook failed: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// 参数中是否有 @name 形式的 profile, 或者 -list
+func hasProfileArg(args []string) bool {
+	for _, s := range args {
+		if (strings.HasPrefix(s, "@") && len(s) > 1) || s == "-list" {
+			return true
+		}
+	}
+	return false
+}
+
+func RunProfiles(args []string) {
+	cmd := flag.NewFlagSet("scp", flag.ExitOnError)
+	conf_file := cmd.String("conf", "", "profile file, default is "+profileFile+" in current or parent directory")
+	list := cmd.Bool("list", false, "list profiles")
+	cmd.Parse(args)
+
+	conf, err := LoadProfiles(*conf_file)
+	if err != nil {
+		logger.Error("load profiles failed: %v", err)
+		os.Exit(2)
+	}
+	if *list {
+		names := []string{}
+		for name := range conf.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p := conf.Profiles[name]
+			fmt.Printf("@%-12s %-7s %s -> %s\n", name, p.Mode, p.Src, p.Dst)
+		}
+		return
+	}
+
+	profiles := map[string]*SyncProfile{}
+	for _, s := range cmd.Args() {
+		name := strings.TrimPrefix(s, "@")
+		p, ok := conf.Profiles[name]
+		if !ok {
+			logger.Error("profile %s not found", name)
+			os.Exit(2)
+		}
+		profiles[name] = p
+	}
+	if len(profiles) == 0 {
+		logger.Error("no profile given")
+		os.Exit(2)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for name, p := range profiles {
+		wg.Add(1)
+		go func(name string, p *SyncProfile) {
+			defer wg.Done()
+			if err := p.run(name, conf.root); err != nil {
+				logger.Error("%v", err)
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(name, p)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		logger.Error("%d profile(s) failed", len(errs))
+		os.Exit(3)
+	}
+}
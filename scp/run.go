@@ -0,0 +1,344 @@
+package scp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lulugyf/fkme/logger"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+在多台主机上并行执行命令
+
+主机: 逗号分隔的 ssh config 名称(需要 -f), user[/pass]@host, 或者 @组名
+组定义在 .fkme.yaml 中:
+  groups:
+    gpu: [gpu1, gpu2, app@10.1.1.7]
+    all: [od, ud7, "@gpu"]
+
+每行输出前加主机名, 标准输出为 "host | ", 标准错误为 "host ! "(写到 stderr)
+结束后打印每台主机的结果, 有失败的主机时退出码为 1
+
+fkme run -f ~ od,ud7 uptime
+fkme run -f ~ -c 4 -timeout 30s @gpu nvidia-smi --query-gpu=utilization.gpu --format=csv
+-- 先上传脚本再执行, 命令中的 {} 替换为远端的脚本路径, 没有命令时直接执行脚本
+fkme run -f ~ -upload ./deploy.sh @all
+fkme run -f ~ -upload ./deploy.sh @all "sudo {} --restart"
+*/
+type runResult struct {
+	host     string
+	status   string // ok, failed, timeout, error
+	code     int
+	err      error
+	duration time.Duration
+}
+
+type run_args struct {
+	conn        *cmd_args
+	concurrency int
+	timeout     time.Duration
+	upload      string
+	command     string
+}
+
+/*
+按行加前缀输出, 多个主机的输出共用一个锁, 不会交错在一行中
+buf 也由锁保护, 超时后 session 的复制 goroutine 可能还在 Write, 同时 runAll 在 Flush
+*/
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	lock   *sync.Mutex
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.writeLine(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// 调用时需要持有 w.lock
+func (w *prefixWriter) writeLine(line []byte) {
+	w.out.Write(append([]byte(w.prefix), line...))
+}
+
+func (w *prefixWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.buf) > 0 {
+		w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+/*
+展开主机列表, @name 为 .fkme.yaml 中的组, 组中可以再引用组
+*/
+func expandHosts(spec string, groups map[string][]string) ([]string, error) {
+	hosts := []string{}
+	seen := map[string]bool{}
+	var expand func(items []string, depth int) error
+	expand = func(items []string, depth int) error {
+		if depth > 10 {
+			return errors.New("host groups nested too deep")
+		}
+		for _, h := range items {
+			h = strings.TrimSpace(h)
+			if h == "" {
+				continue
+			}
+			if strings.HasPrefix(h, "@") {
+				g, ok := groups[h[1:]]
+				if !ok {
+					return fmt.Errorf("host group %s not found", h)
+				}
+				if err := expand(g, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			if !seen[h] {
+				seen[h] = true
+				hosts = append(hosts, h)
+			}
+		}
+		return nil
+	}
+	err := expand(strings.Split(spec, ","), 0)
+	return hosts, err
+}
+
+// 主机显示的名称, 不显示密码
+func hostLabel(h string) string {
+	if i := strings.Index(h, "@"); i > 0 {
+		if j := strings.Index(h[:i], "/"); j > 0 {
+			return h[:j] + h[i:]
+		}
+	}
+	return h
+}
+
+func RunHosts(args []string) {
+	a := &cmd_args{}
+	cmd := flag.NewFlagSet("run", flag.ExitOnError)
+	a.define(cmd)
+	c := cmd.Int("c", 10, "max hosts running at the same time")
+	timeout := cmd.Duration("timeout", 0, "per host timeout, include connect and upload, 0 for no limit")
+	upload := cmd.String("upload", "", "upload this local script before running, {} in command is replaced with its remote path")
+	conf_file := cmd.String("conf", "", "config file for host groups, default .fkme.yaml in current or parent dirs")
+	cmd.Parse(args)
+	if cmd.NArg() < 1 || (cmd.NArg() < 2 && *upload == "") {
+		fmt.Println("fkme run [-f ~] [-c 10] [-timeout 30s] [-upload script] <host1,host2,@group> [command ...]")
+		os.Exit(2)
+	}
+
+	groups := map[string][]string{}
+	if strings.Contains(cmd.Arg(0), "@") {
+		if conf, err := LoadProfiles(*conf_file); err == nil {
+			groups = conf.Groups
+		} else if *conf_file != "" {
+			logger.Error("%v", err)
+			os.Exit(2)
+		}
+	}
+	hosts, err := expandHosts(cmd.Arg(0), groups)
+	if err != nil {
+		logger.Error("%v", err)
+		os.Exit(2)
+	}
+	if len(hosts) == 0 {
+		logger.Error("no hosts")
+		os.Exit(2)
+	}
+	ra := &run_args{conn: a, concurrency: *c, timeout: *timeout, upload: *upload,
+		command: strings.Join(cmd.Args()[1:], " ")}
+	if ra.concurrency < 1 {
+		ra.concurrency = 1
+	}
+
+	results := ra.runAll(hosts)
+	printResults(results)
+	for _, r := range results {
+		if r.status != "ok" {
+			os.Exit(1)
+		}
+	}
+}
+
+func (ra *run_args) runAll(hosts []string) []*runResult {
+	results := make([]*runResult, len(hosts))
+	width := 0
+	for _, h := range hosts {
+		if n := len(hostLabel(h)); n > width {
+			width = n
+		}
+	}
+	lock := &sync.Mutex{}
+	sem := make(chan struct{}, ra.concurrency)
+	wg := sync.WaitGroup{}
+	for i, h := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, h string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			label := fmt.Sprintf("%-*s", width, hostLabel(h))
+			stdout := &prefixWriter{prefix: label + " | ", out: os.Stdout, lock: lock}
+			stderr := &prefixWriter{prefix: label + " ! ", out: os.Stderr, lock: lock}
+			start := time.Now()
+			r := ra.runHost(h, stdout, stderr)
+			stdout.Flush()
+			stderr.Flush()
+			r.duration = time.Since(start)
+			if r.err != nil {
+				stderr.Write([]byte(r.err.Error() + "\n"))
+				stderr.Flush()
+			}
+			results[i] = r
+		}(i, h)
+	}
+	wg.Wait()
+	return results
+}
+
+func (ra *run_args) runHost(host string, stdout, stderr io.Writer) *runResult {
+	r := &runResult{host: hostLabel(host), code: -1}
+	ctx := context.Background()
+	if ra.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ra.timeout)
+		defer cancel()
+	}
+	c := &Cli{}
+	done := make(chan error, 1)
+	go func() {
+		_, err := ra.conn.connectHost(c, host)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			r.status, r.err = "error", err
+			return r
+		}
+	case <-ctx.Done():
+		r.status, r.err = "timeout", errors.New("connect timeout")
+		go func() {
+			if <-done == nil {
+				c.Close()
+			}
+		}()
+		return r
+	}
+	defer c.Close()
+
+	command := ra.command
+	if ra.upload != "" {
+		remote := path.Join(".fkme-run", fmt.Sprintf("%d-%s", os.Getpid(), filepath.Base(ra.upload)))
+		if err := c.uploadScript(ra.upload, remote); err != nil {
+			r.status, r.err = "error", fmt.Errorf("upload failed: %v", err)
+			return r
+		}
+		defer c.Sftp.Remove(remote)
+		if command == "" {
+			command = "./" + remote
+		} else {
+			command = strings.Replace(command, "{}", remote, -1)
+		}
+	}
+
+	session, err := c.Ssh.NewSession()
+	if err != nil {
+		r.status, r.err = "error", err
+		return r
+	}
+	defer session.Close()
+	session.Stdout, session.Stderr = stdout, stderr
+	if err := session.Start(command); err != nil {
+		r.status, r.err = "error", err
+		return r
+	}
+	go func() { done <- session.Wait() }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		r.status, r.err = "timeout", fmt.Errorf("timeout after %v", ra.timeout)
+		return r
+	}
+	switch e := err.(type) {
+	case nil:
+		r.status, r.code = "ok", 0
+	case *ssh.ExitError:
+		r.status, r.code = "failed", e.ExitStatus()
+	default:
+		r.status, r.err = "error", err
+	}
+	return r
+}
+
+func (c *Cli) uploadScript(local, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c.Sftp.MkdirAll(path.Dir(remote))
+	w, err := c.Sftp.Create(remote)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return c.Sftp.Chmod(remote, 0755)
+}
+
+func printResults(results []*runResult) {
+	width := len("HOST")
+	for _, r := range results {
+		if len(r.host) > width {
+			width = len(r.host)
+		}
+	}
+	ok := 0
+	fmt.Println()
+	fmt.Printf("%-*s  %-8s %5s %10s\n", width, "HOST", "STATUS", "CODE", "TIME")
+	for _, r := range results {
+		code := "-"
+		if r.code >= 0 {
+			code = fmt.Sprintf("%d", r.code)
+		}
+		fmt.Printf("%-*s  %-8s %5s %10s\n", width, r.host, r.status, code, r.duration.Round(time.Millisecond))
+		if r.status == "ok" {
+			ok++
+		}
+	}
+	fmt.Printf("%d/%d ok\n", ok, len(results))
+}
@@ -0,0 +1,86 @@
+package scp
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestExpandHosts(t *testing.T) {
+	groups := map[string][]string{
+		"gpu":   {"gpu1", "gpu2", "app@10.1.1.7"},
+		"all":   {"od", "ud7", "@gpu"},
+		"twice": {"@gpu", "gpu1", "@all"},
+		"loop1": {"a", "@loop2"},
+		"loop2": {"b", "@loop1"},
+		"self":  {"@self"},
+		"empty": {},
+	}
+	cases := []struct {
+		spec string
+		want string
+		ok   bool
+	}{
+		{"od", "od", true},
+		{"od, ud7 ,,od", "od ud7", true},
+		{"@gpu", "gpu1 gpu2 app@10.1.1.7", true},
+		{"@all", "od ud7 gpu1 gpu2 app@10.1.1.7", true},
+		{"gpu2,@twice", "gpu2 gpu1 app@10.1.1.7 od ud7", true},
+		{"@empty", "", true},
+		{"@missing", "", false},
+		{"od,@all,@missing", "", false},
+		{"@loop1", "", false},
+		{"@self", "", false},
+	}
+	for _, c := range cases {
+		hosts, err := expandHosts(c.spec, groups)
+		if (err == nil) != c.ok {
+			t.Errorf("expandHosts(%q) error = %v, want ok=%v", c.spec, err, c.ok)
+			continue
+		}
+		if got := strings.Join(hosts, " "); c.ok && got != c.want {
+			t.Errorf("expandHosts(%q) = %q, want %q", c.spec, got, c.want)
+		}
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	lock := &sync.Mutex{}
+	a := &prefixWriter{prefix: "a | ", out: out, lock: lock}
+	b := &prefixWriter{prefix: "b ! ", out: out, lock: lock}
+	a.Write([]byte("one\ntw"))
+	b.Write([]byte("x"))
+	a.Write([]byte("o\n"))
+	b.Write([]byte("y\nz"))
+	a.Write([]byte("three"))
+	a.Flush()
+	b.Flush()
+	a.Flush()
+	want := "a | one\na | two\nb ! xy\na | three\nb ! z\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	// 超时后 session 还在写, 同时 Flush, 用 -race 检查
+	out.Reset()
+	w := &prefixWriter{prefix: "h | ", out: out, lock: lock}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w.Write([]byte("line\n"))
+				w.Flush()
+			}
+		}()
+	}
+	wg.Wait()
+	lock.Lock()
+	defer lock.Unlock()
+	if n := strings.Count(out.String(), "h | line\n"); n != 400 {
+		t.Errorf("got %d lines, want 400", n)
+	}
+}
@@ -0,0 +1,602 @@
+package scp
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lulugyf/fkme/logger"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+/*
+基于 Cli 的交互式 sftp 命令行, 连接参数与 scp 相同
+
+fkme sftp -f ~ ud7
+fkme sftp -f ~ -s5 127.0.0.1:8007 ud7
+fkme sftp -i ~/.ssh/id_rsa_tr -p 2022 _base_@localhost
+*/
+type shell struct {
+	c   *Cli
+	cwd string // 远端当前目录
+	out io.Writer
+}
+
+const shellHelp = `ls [-l] [path]              list remote directory
+cd path                     change remote directory
+pwd / lpwd                  print remote / local directory
+lcd path                    change local directory
+get [-r] remote [local]     download file or directory
+put [-r] local [remote]     upload file or directory
+rm [-r] path                remove remote file or directory
+mkdir [-p] path             create remote directory
+mv old new                  rename remote file
+chmod mode path             change remote file mode, mode is octal
+df [path]                   show remote filesystem usage (statvfs)
+!cmd                        execute command on remote host
+exit / quit                 quit
+`
+
+// 远端路径, 相对路径基于 cwd
+func (sh *shell) resolve(p string) string {
+	if p == "" {
+		return sh.cwd
+	}
+	if strings.HasPrefix(p, "/") {
+		return path.Clean(p)
+	}
+	return path.Join(sh.cwd, p)
+}
+
+func (sh *shell) printf(format string, v ...interface{}) {
+	fmt.Fprintf(sh.out, format, v...)
+}
+
+/*
+分割命令行参数, 支持单双引号
+*/
+func splitArgs(line string) []string {
+	args := []string{}
+	var cur strings.Builder
+	quote := rune(0)
+	has := false
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			has = true
+		case r == ' ' || r == '\t':
+			if has {
+				args = append(args, cur.String())
+				cur.Reset()
+				has = false
+			}
+		default:
+			cur.WriteRune(r)
+			has = true
+		}
+	}
+	if has {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+// 去掉参数中的 -r / -l / -p 之类的开关, 只检查第一个非开关参数之前的, 之后的 -r 是文件名
+func takeFlag(args []string, f string) ([]string, bool) {
+	ret := []string{}
+	found := false
+	for i, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			ret = append(ret, args[i:]...)
+			break
+		}
+		if a == f {
+			found = true
+		} else {
+			ret = append(ret, a)
+		}
+	}
+	return ret, found
+}
+
+func humanSize(n uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
+
+func (sh *shell) ls(args []string) error {
+	args, long := takeFlag(args, "-l")
+	p := ""
+	if len(args) > 0 {
+		p = args[0]
+	}
+	rp := sh.resolve(p)
+	st, err := sh.c.Sftp.Stat(rp)
+	if err != nil {
+		return err
+	}
+	files := []os.FileInfo{st}
+	if st.IsDir() {
+		files, err = sh.c.Sftp.ReadDir(rp)
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() {
+			name += "/"
+		}
+		if long {
+			sh.printf("%s %10d %s %s\n", f.Mode(), f.Size(),
+				f.ModTime().Format("2006-01-02 15:04"), name)
+		} else {
+			sh.printf("%s\n", name)
+		}
+	}
+	return nil
+}
+
+func (sh *shell) cd(args []string) error {
+	p := ""
+	if len(args) > 0 {
+		p = args[0]
+	}
+	rp := sh.resolve(p)
+	st, err := sh.c.Sftp.Stat(rp)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("%s is not a directory", rp)
+	}
+	sh.cwd = rp
+	return nil
+}
+
+func (sh *shell) getFile(remote_file, local_file string) error {
+	srcFile, err := sh.c.Sftp.Open(remote_file)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	if dir := filepath.Dir(local_file); dir != "" {
+		os.MkdirAll(dir, 0755)
+	}
+	dstFile, err := os.Create(local_file)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+	n, err := io.Copy(dstFile, srcFile)
+	if err != nil {
+		return err
+	}
+	sh.printf("%s -> %s  %d bytes\n", remote_file, local_file, n)
+	return nil
+}
+
+func (sh *shell) get(args []string) error {
+	args, recursive := takeFlag(args, "-r")
+	if len(args) < 1 {
+		return errors.New("usage: get [-r] remote [local]")
+	}
+	rp := sh.resolve(args[0])
+	local := path.Base(rp)
+	if len(args) > 1 {
+		local = args[1]
+	}
+	if st, err := os.Stat(local); err == nil && st.IsDir() {
+		local = filepath.Join(local, path.Base(rp))
+	}
+	st, err := sh.c.Sftp.Stat(rp)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return sh.getFile(rp, local)
+	}
+	if !recursive {
+		return fmt.Errorf("%s is a directory, use get -r", rp)
+	}
+	walker := sh.c.Sftp.Walk(rp)
+	for walker.Step() {
+		if walker.Err() != nil {
+			return walker.Err()
+		}
+		local_file := filepath.Join(local, filepath.FromSlash(walker.Path()[len(rp):]))
+		if walker.Stat().IsDir() {
+			os.MkdirAll(local_file, 0755)
+		} else if err := sh.getFile(walker.Path(), local_file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *shell) putFile(local_file, remote_file string) error {
+	srcFile, err := os.Open(local_file)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	sh.c.Sftp.MkdirAll(path.Dir(remote_file))
+	dstFile, err := sh.c.Sftp.Create(remote_file)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+	n, err := io.Copy(dstFile, srcFile)
+	if err != nil {
+		return err
+	}
+	sh.printf("%s -> %s  %d bytes\n", local_file, remote_file, n)
+	return nil
+}
+
+func (sh *shell) put(args []string) error {
+	args, recursive := takeFlag(args, "-r")
+	if len(args) < 1 {
+		return errors.New("usage: put [-r] local [remote]")
+	}
+	local := args[0]
+	rp := sh.resolve(filepath.Base(local))
+	if len(args) > 1 {
+		rp = sh.resolve(args[1])
+	}
+	if st, err := sh.c.Sftp.Stat(rp); err == nil && st.IsDir() {
+		rp = path.Join(rp, filepath.Base(local))
+	}
+	st, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return sh.putFile(local, rp)
+	}
+	if !recursive {
+		return fmt.Errorf("%s is a directory, use put -r", local)
+	}
+	return filepath.Walk(local, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			return err
+		}
+		remote_file := path.Join(rp, filepath.ToSlash(rel))
+		if info.IsDir() {
+			return sh.c.Sftp.MkdirAll(remote_file)
+		}
+		return sh.putFile(p, remote_file)
+	})
+}
+
+func (sh *shell) rm(args []string) error {
+	args, recursive := takeFlag(args, "-r")
+	if len(args) < 1 {
+		return errors.New("usage: rm [-r] path")
+	}
+	rp := sh.resolve(args[0])
+	st, err := sh.c.Sftp.Stat(rp)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return sh.c.Sftp.Remove(rp)
+	}
+	if !recursive {
+		return fmt.Errorf("%s is a directory, use rm -r", rp)
+	}
+	return sh.c.RemoveAll(rp)
+}
+
+func (sh *shell) mkdir(args []string) error {
+	args, parents := takeFlag(args, "-p")
+	if len(args) < 1 {
+		return errors.New("usage: mkdir [-p] path")
+	}
+	if parents {
+		return sh.c.Sftp.MkdirAll(sh.resolve(args[0]))
+	}
+	return sh.c.Sftp.Mkdir(sh.resolve(args[0]))
+}
+
+func (sh *shell) mv(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: mv old new")
+	}
+	oldname, newname := sh.resolve(args[0]), sh.resolve(args[1])
+	if st, err := sh.c.Sftp.Stat(newname); err == nil && st.IsDir() {
+		newname = path.Join(newname, path.Base(oldname))
+	}
+	if _, ok := sh.c.Sftp.HasExtension("posix-rename@openssh.com"); ok {
+		return sh.c.Sftp.PosixRename(oldname, newname)
+	}
+	return sh.c.Sftp.Rename(oldname, newname)
+}
+
+func (sh *shell) chmod(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: chmod mode path")
+	}
+	mode, err := strconv.ParseUint(args[0], 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid mode %s", args[0])
+	}
+	return sh.c.Sftp.Chmod(sh.resolve(args[1]), os.FileMode(mode))
+}
+
+func (sh *shell) df(args []string) error {
+	p := ""
+	if len(args) > 0 {
+		p = args[0]
+	}
+	st, err := sh.c.Sftp.StatVFS(sh.resolve(p))
+	if err != nil {
+		return err
+	}
+	total := st.TotalSpace()
+	free := st.FreeSpace()
+	avail := st.Frsize * st.Bavail
+	sh.printf("%10s %10s %10s %10s %5s\n", "Size", "Used", "Avail", "Inodes", "Use%")
+	used := total - free
+	pct := 0.0
+	if total > 0 {
+		pct = float64(used) * 100 / float64(total)
+	}
+	sh.printf("%10s %10s %10s %10d %4.0f%%\n",
+		humanSize(total), humanSize(used), humanSize(avail), st.Files, pct)
+	return nil
+}
+
+// 在当前目录执行远端命令, 输出 stdout 和 stderr, 退出码不为 0 时显示
+func (sh *shell) exec(cmd string) {
+	cmd = strings.TrimSpace(cmd)
+	if cmd == "" {
+		return
+	}
+	session, err := sh.c.Ssh.NewSession()
+	if err != nil {
+		sh.printf("!: %v\n", err)
+		return
+	}
+	defer session.Close()
+	session.Setenv("LANG", "en_US.UTF8")
+	out, err := session.CombinedOutput(fmt.Sprintf("cd %s && %s", shellQuote(sh.cwd), cmd))
+	sh.printf("%s", out)
+	if e, ok := err.(*ssh.ExitError); ok {
+		sh.printf("exit status %d\n", e.ExitStatus())
+	} else if err != nil {
+		sh.printf("!: %v\n", err)
+	}
+}
+
+// 执行一行命令, 返回 false 表示退出
+func (sh *shell) run(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return true
+	}
+	if strings.HasPrefix(line, "!") {
+		sh.exec(line[1:])
+		return true
+	}
+	args := splitArgs(line)
+	var err error
+	switch args[0] {
+	case "ls", "dir":
+		err = sh.ls(args[1:])
+	case "cd":
+		err = sh.cd(args[1:])
+	case "pwd":
+		sh.printf("%s\n", sh.cwd)
+	case "lpwd":
+		dir, _ := os.Getwd()
+		sh.printf("%s\n", dir)
+	case "lcd":
+		if len(args) < 2 {
+			err = errors.New("usage: lcd path")
+		} else {
+			err = os.Chdir(args[1])
+		}
+	case "get":
+		err = sh.get(args[1:])
+	case "put":
+		err = sh.put(args[1:])
+	case "rm":
+		err = sh.rm(args[1:])
+	case "mkdir":
+		err = sh.mkdir(args[1:])
+	case "mv", "rename":
+		err = sh.mv(args[1:])
+	case "chmod":
+		err = sh.chmod(args[1:])
+	case "df":
+		err = sh.df(args[1:])
+	case "help", "?":
+		sh.printf("%s", shellHelp)
+	case "exit", "quit", "bye":
+		return false
+	default:
+		err = fmt.Errorf("unknown command %s, enter 'help' for usage", args[0])
+	}
+	if err != nil {
+		sh.printf("%s: %v\n", args[0], err)
+	}
+	return true
+}
+
+// 需要补全本地路径的命令, 其余命令都补全远端路径
+var localPathCmds = map[string]bool{"lcd": true, "put": true}
+
+/*
+Tab 补全, 补全光标前的最后一个词
+*/
+func (sh *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	prefix := line[:pos]
+	i := strings.LastIndexAny(prefix, " \t")
+	word := prefix[i+1:]
+	fields := strings.Fields(prefix)
+	if len(fields) == 0 || (len(fields) == 1 && i < 0) {
+		return "", 0, false // 命令名不补全
+	}
+	// put 的第二个参数是远端路径
+	args, _ := takeFlag(fields[1:], "-r")
+	local := localPathCmds[fields[0]]
+	if fields[0] == "put" && (len(args) > 1 || (len(args) == 1 && word == "")) {
+		local = false
+	}
+
+	dir, base := path.Split(word)
+	var names []string
+	if local {
+		ldir := dir
+		if ldir == "" {
+			ldir = "."
+		}
+		entries, err := os.ReadDir(ldir)
+		if err != nil {
+			return "", 0, false
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), base) {
+				n := e.Name()
+				if e.IsDir() {
+					n += "/"
+				}
+				names = append(names, n)
+			}
+		}
+	} else {
+		files, err := sh.c.Sftp.ReadDir(sh.resolve(dir))
+		if err != nil {
+			return "", 0, false
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), base) {
+				n := f.Name()
+				if f.IsDir() {
+					n += "/"
+				}
+				names = append(names, n)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(names)
+	common := names[0]
+	for _, n := range names[1:] {
+		for !strings.HasPrefix(n, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(names) > 1 && common == base {
+		// 无法继续补全, 列出候选
+		sh.printf("%s\n", strings.Join(names, "  "))
+		return "", 0, false
+	}
+	newPrefix := prefix[:i+1] + dir + common
+	return newPrefix + line[pos:], len(newPrefix), true
+}
+
+func (sh *shell) loop() {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		// 非终端输入, 按行执行
+		sh.out = os.Stdout
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if !sh.run(scanner.Text()) {
+				break
+			}
+		}
+		return
+	}
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		logger.Error("make raw terminal failed %v", err)
+		return
+	}
+	defer term.Restore(fd, oldState)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "sftp> ")
+	t.AutoCompleteCallback = sh.complete
+	sh.out = t
+	for {
+		line, err := t.ReadLine()
+		if err != nil {
+			break
+		}
+		if !sh.run(line) {
+			break
+		}
+	}
+}
+
+func Shell(args []string) {
+	a := &cmd_args{}
+	cmd := flag.NewFlagSet("sftp", flag.ExitOnError)
+	a.define(cmd)
+	cmd.Usage = func() {
+		fmt.Println("fkme sftp [-f ~] [-s5 addr] [-i keyfile] [-p port] <host | {user}[/{pass}]@{host}[:{dir}]>")
+		cmd.PrintDefaults()
+	}
+	cmd.Parse(args)
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return
+	}
+
+	c := &Cli{}
+	rpath, err := a.connectHost(c, cmd.Arg(0))
+	if err != nil {
+		logger.Error("connect to %s failed: %v", cmd.Arg(0), err)
+		os.Exit(2)
+	}
+	defer c.Close()
+
+	sh := &shell{c: c, out: os.Stdout}
+	sh.cwd, err = c.Sftp.Getwd()
+	if err != nil {
+		sh.cwd = "/"
+	}
+	if rpath != "" {
+		if err := sh.cd([]string{rpath}); err != nil {
+			logger.Warn("cd %s failed: %v", rpath, err)
+		}
+	}
+	sh.loop()
+}
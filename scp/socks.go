@@ -0,0 +1,121 @@
+package scp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/armon/go-socks5"
+	"github.com/lulugyf/fkme/util"
+	"github.com/lulugyf/fkme/vault"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+通过 ssh 连接的 socks5 服务(ssh -D), 连接由远端发起, 域名也在远端解析
+只支持 CONNECT
+
+tunnel 配置中的 socks:
+  {"tunnel":"127.0.0.1:1080 <=> socks", "server":"app@10.1.1.5:22",
+   "socks":{"user":"me", "pass":"vault:s5pass", "allow":["10.0.0.0/8", "*.corp.com"], "deny":["10.0.0.1", "*:22"]}}
+
+allow / deny 的每一项为 CIDR, IP, 主机名或通配符(*.corp.com), 可以带 :端口, 端口也可以为 *
+deny 优先, allow 为空时允许所有目标
+*/
+type SocksConf struct {
+	User  string   `json:"user"`
+	Pass  string   `json:"pass"` // 可以是 vault:<name>
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// 不在本地解析, 保留域名交给远端
+type remoteResolver struct{}
+
+func (remoteResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+type socksRules struct {
+	allow []string
+	deny  []string
+}
+
+func matchTarget(pattern, host string, port int) bool {
+	p_host, p_port := pattern, ""
+	if h, p, err := net.SplitHostPort(pattern); err == nil {
+		p_host, p_port = h, p
+	}
+	if p_port != "" && p_port != "*" && p_port != strconv.Itoa(port) {
+		return false
+	}
+	if p_host == "*" || p_host == "" {
+		return true
+	}
+	if _, cidr, err := net.ParseCIDR(p_host); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && cidr.Contains(ip)
+	}
+	ok, _ := path.Match(strings.ToLower(p_host), strings.ToLower(host))
+	return ok
+}
+
+func (r *socksRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.ConnectCommand {
+		return ctx, false
+	}
+	host := req.DestAddr.FQDN
+	if host == "" {
+		host = req.DestAddr.IP.String()
+	}
+	port := req.DestAddr.Port
+	for _, p := range r.deny {
+		if matchTarget(p, host, port) {
+			return ctx, false
+		}
+	}
+	if len(r.allow) == 0 {
+		return ctx, true
+	}
+	for _, p := range r.allow {
+		if matchTarget(p, host, port) {
+			return ctx, true
+		}
+	}
+	return ctx, false
+}
+
+/*
+socks5 服务, 通过 client 连接目标, conf 可以为 nil
+*/
+func newSSHSocks(client *ssh.Client, conf *SocksConf) (*socks5.Server, error) {
+	return newSocks(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return client.Dial(network, addr)
+	}, conf)
+}
+
+// 与 newSSHSocks 相同, 由 dial 发起连接, 按需连接的 tunnel 在 dial 时才建立 ssh 连接
+func newSocks(dial func(ctx context.Context, network, addr string) (net.Conn, error), conf *SocksConf) (*socks5.Server, error) {
+	if conf == nil {
+		conf = &SocksConf{}
+	}
+	s5conf := &socks5.Config{
+		Logger:   log.New(ioutil.Discard, "", 0),
+		Resolver: remoteResolver{},
+		Rules:    util.AuditRules(&socksRules{allow: conf.Allow, deny: conf.Deny}),
+		Dial:     dial,
+	}
+	if conf.User != "" {
+		pass, err := vault.Resolve(conf.Pass)
+		if err != nil {
+			return nil, fmt.Errorf("socks pass: %v", err)
+		}
+		s5conf.Credentials = socks5.StaticCredentials{conf.User: pass}
+	}
+	return socks5.New(s5conf)
+}
@@ -0,0 +1,500 @@
+package scp
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lulugyf/fkme/logger"
+	"github.com/lulugyf/fkme/sshconfig"
+	"github.com/lulugyf/fkme/ws"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+/*
+交互式 ssh 客户端, 连接方式与 tunnel 相同: tcp, socks5(-s5), ProxyJump(-J), ws:// wss://
+
+主机: ssh config 中的名称(需要 -f, 支持 ProxyJump, LocalForward, RemoteForward, DynamicForward), [user[/pass]@]host[:port], [user[/pass]@]ws://addr/ws
+有 SSH_AUTH_SOCK 时使用 ssh-agent 中的密钥, 终端中可以输入密码
+
+fkme ssh -f ~ od
+fkme ssh app@10.1.1.5 uptime
+-- 通过 ws 网关(fkme ws -addr sshd), 中间经过跳板
+fkme ssh _base_/vault:gw@wss://example.com/yt/ws
+fkme ssh -J jump@10.1.1.1,app@10.2.0.3 app@10.3.0.8
+-- 端口转发, 只转发不执行命令时加 -N
+fkme ssh -f ~ -N -L 8888:localhost:8888 -R 2222:localhost:22 -D 1080 od
+*/
+type listFlags []string
+
+func (f *listFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+type ssh_args struct {
+	conn      *cmd_args
+	user      *string
+	jump      *string
+	fwd_agent *bool
+	tty       *bool
+	no_tty    *bool
+	no_cmd    *bool
+	locals    listFlags
+	remotes   listFlags
+	dynamics  listFlags
+
+	agent agent.ExtendedAgent // SSH_AUTH_SOCK 的连接, 没有时为 nil
+	sock  string
+}
+
+// 连接链中的一个 ssh 服务
+type sshHop struct {
+	addr string // host:port 或者 ws:// wss:// 地址
+	user string
+	pass string // 密码, 私钥文件或 vault: 引用
+	jump string // ssh config 中的 ProxyJump
+
+	conf *sshconfig.SSHHost // 来自 ssh config 时不为空
+}
+
+func isWSAddr(s string) bool {
+	return strings.HasPrefix(s, "ws://") || strings.HasPrefix(s, "wss://")
+}
+
+func SSH(args []string) {
+	sa := &ssh_args{conn: &cmd_args{}}
+	cmd := flag.NewFlagSet("ssh", flag.ExitOnError)
+	sa.conn.define(cmd)
+	sa.user = cmd.String("l", "", "login user, default $USER")
+	sa.jump = cmd.String("J", "", "jump hosts, comma separated, ProxyJump in ssh config is used if empty")
+	sa.fwd_agent = cmd.Bool("A", false, "forward ssh-agent")
+	sa.tty = cmd.Bool("t", false, "force pty allocation for command")
+	sa.no_tty = cmd.Bool("T", false, "disable pty allocation")
+	sa.no_cmd = cmd.Bool("N", false, "no shell or command, only port forwarding")
+	cmd.Var(&sa.locals, "L", "local forward [bind_addr:]port:host:hostport, can be repeated")
+	cmd.Var(&sa.remotes, "R", "remote forward [bind_addr:]port:host:hostport, can be repeated")
+	cmd.Var(&sa.dynamics, "D", "local socks5 proxy through remote [bind_addr:]port, can be repeated")
+	cmd.Parse(args)
+	if cmd.NArg() < 1 {
+		fmt.Println("fkme ssh [-f ~] [-J jump1,jump2] [-A] [-L ..] [-R ..] [-D ..] [-N] <host> [command ...]")
+		os.Exit(2)
+	}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if c, err := net.Dial("unix", sock); err == nil {
+			sa.agent, sa.sock = agent.NewClient(c), sock
+		} else {
+			logger.Warn("ssh-agent %s: %v", sock, err)
+		}
+	}
+
+	th, err := sa.resolveHop(cmd.Arg(0), true)
+	if err != nil {
+		logger.Error("%v", err)
+		os.Exit(255)
+	}
+	sa.addConfigForwards(th)
+	client, closer, err := sa.connect(th)
+	if err != nil {
+		logger.Error("%v", err)
+		os.Exit(255)
+	}
+	for _, spec := range sa.locals {
+		if err := forwardLocal(client, spec); err != nil {
+			logger.Error("-L %s: %v", spec, err)
+			os.Exit(255)
+		}
+	}
+	for _, spec := range sa.remotes {
+		if err := forwardRemote(client, spec); err != nil {
+			logger.Error("-R %s: %v", spec, err)
+			os.Exit(255)
+		}
+	}
+	for _, spec := range sa.dynamics {
+		if err := forwardDynamic(client, spec); err != nil {
+			logger.Error("-D %s: %v", spec, err)
+			os.Exit(255)
+		}
+	}
+
+	code := 0
+	if *sa.no_cmd {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+		done := make(chan error, 1)
+		go func() { done <- client.Wait() }()
+		select {
+		case <-sigc:
+		case err := <-done:
+			logger.Warn("connection closed: %v", err)
+			code = 255
+		}
+	} else {
+		code = sa.runSession(client, strings.Join(cmd.Args()[1:], " "))
+	}
+	closer()
+	os.Exit(code)
+}
+
+/*
+解析主机: ws 地址, ssh config 中的名称, 或者 [user[/pass]@]host[:port]
+target 为目标主机时 -p 作为默认端口, 跳板默认 22
+*/
+func (sa *ssh_args) resolveHop(spec string, target bool) (*sshHop, error) {
+	h := &sshHop{}
+	userpart := ""
+	if i := strings.Index(spec, "ws://"); i >= 0 {
+		if i > 0 && spec[i-1] == 'w' {
+			i--
+		}
+		userpart, h.addr = strings.TrimSuffix(spec[:i], "@"), spec[i:]
+	} else if *sa.conn.conf_file != "" && !strings.Contains(spec, "@") {
+		sshost, err := findSSHHost(*sa.conn.conf_file, spec)
+		if err != nil {
+			return nil, err
+		}
+		h.addr = net.JoinHostPort(sshost.HostName, strconv.Itoa(sshost.Port))
+		h.user = sshost.User
+		if idfile := identityFile(sshost); fileExists(idfile) {
+			h.pass = idfile
+		}
+		h.jump = sshost.ProxyJump
+		h.conf = sshost
+	} else {
+		hostport := spec
+		if i := strings.LastIndex(spec, "@"); i >= 0 {
+			userpart, hostport = spec[:i], spec[i+1:]
+		}
+		port := 22
+		if target {
+			port = *sa.conn.port
+		}
+		if _, _, err := net.SplitHostPort(hostport); err != nil {
+			hostport = net.JoinHostPort(hostport, strconv.Itoa(port))
+		}
+		h.addr = hostport
+	}
+	if userpart != "" {
+		s := strings.SplitN(userpart, "/", 2)
+		h.user = s[0]
+		if len(s) == 2 {
+			h.pass = s[1]
+		}
+	}
+	if h.user == "" {
+		h.user = *sa.user
+	}
+	if h.user == "" {
+		h.user = os.Getenv("USER")
+	}
+	if h.pass == "" && target {
+		h.pass = *sa.conn.key_file
+		if h.pass == "" {
+			h.pass = *sa.conn.passcode
+		}
+	}
+	return h, nil
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func (sa *ssh_args) clientConfig(h *sshHop) (*ssh.ClientConfig, error) {
+	auths := []ssh.AuthMethod{}
+	if h.pass != "" {
+		a, err := authMethods(h.pass)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, a...)
+	}
+	if sa.agent != nil {
+		auths = append(auths, ssh.PublicKeysCallback(sa.agent.Signers))
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		auths = append(auths, ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+			fmt.Fprintf(os.Stderr, "%s@%s's password: ", h.user, h.addr)
+			b, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Fprintln(os.Stderr)
+			return string(b), err
+		}), 3))
+	}
+	return &ssh.ClientConfig{
+		User:            h.user,
+		Auth:            auths,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}, nil
+}
+
+/*
+按顺序连接跳板和目标主机, 第一个可以是 ws 地址或经过 socks5, 后面的通过前一个连接转发
+返回的 closer 关闭全部连接
+*/
+func (sa *ssh_args) connect(th *sshHop) (*ssh.Client, func(), error) {
+	jump := *sa.jump
+	if jump == "" && th.jump != "none" {
+		jump = th.jump
+	}
+	hops := []*sshHop{}
+	if jump != "" {
+		for _, s := range strings.Split(jump, ",") {
+			h, err := sa.resolveHop(strings.TrimSpace(s), false)
+			if err != nil {
+				return nil, nil, err
+			}
+			hops = append(hops, h)
+		}
+	}
+	hops = append(hops, th)
+
+	clients := []*ssh.Client{}
+	closer := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+	for i, h := range hops {
+		config, err := sa.clientConfig(h)
+		if err != nil {
+			closer()
+			return nil, nil, err
+		}
+		var cl *ssh.Client
+		switch {
+		case i > 0 && isWSAddr(h.addr):
+			err = errors.New("ws:// address can only be the first hop")
+		case i > 0:
+			var conn net.Conn
+			if conn, err = clients[i-1].Dial("tcp", h.addr); err == nil {
+				var c ssh.Conn
+				var chans <-chan ssh.NewChannel
+				var reqs <-chan *ssh.Request
+				if c, chans, reqs, err = ssh.NewClientConn(conn, h.addr, config); err == nil {
+					cl = ssh.NewClient(c, chans, reqs)
+				} else {
+					conn.Close()
+				}
+			}
+		case *sa.conn.s5 != "" && !isWSAddr(h.addr):
+			cl, err = proxiedSSHClient(*sa.conn.s5, h.addr, config)
+		default:
+			cl, err = ws.DialSSH(h.addr, config)
+		}
+		if err != nil {
+			closer()
+			return nil, nil, fmt.Errorf("connect %s@%s failed: %v", h.user, h.addr, err)
+		}
+		clients = append(clients, cl)
+	}
+	return clients[len(clients)-1], closer, nil
+}
+
+/*
+执行 shell 或命令, 返回远端的退出码
+没有命令时(或 -t)在终端中分配 pty, 本地终端切换到 raw 模式, 窗口大小变化时通知远端
+*/
+func (sa *ssh_args) runSession(client *ssh.Client, command string) int {
+	session, err := client.NewSession()
+	if err != nil {
+		logger.Error("new session failed: %v", err)
+		return 255
+	}
+	defer session.Close()
+
+	if *sa.fwd_agent {
+		if sa.agent == nil {
+			logger.Warn("-A: no ssh-agent, SSH_AUTH_SOCK not set")
+		} else if err := agent.ForwardToRemote(client, sa.sock); err != nil {
+			logger.Warn("agent forwarding failed: %v", err)
+		} else if err := agent.RequestAgentForwarding(session); err != nil {
+			logger.Warn("agent forwarding refused: %v", err)
+		}
+	}
+
+	fd := int(os.Stdin.Fd())
+	if (command == "" || *sa.tty) && !*sa.no_tty && term.IsTerminal(fd) {
+		w, h, err := term.GetSize(fd)
+		if err != nil {
+			w, h = 80, 24
+		}
+		term_type := os.Getenv("TERM")
+		if term_type == "" {
+			term_type = "xterm-256color"
+		}
+		modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+		if err := session.RequestPty(term_type, h, w, modes); err != nil {
+			logger.Error("request pty failed: %v", err)
+			return 255
+		}
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			logger.Error("raw terminal failed: %v", err)
+			return 255
+		}
+		defer term.Restore(fd, state)
+		stop := watchResize(fd, session)
+		defer stop()
+	}
+
+	session.Stdin, session.Stdout, session.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if command == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(command)
+	}
+	if err != nil {
+		logger.Error("start failed: %v", err)
+		return 255
+	}
+	switch e := session.Wait().(type) {
+	case nil:
+		return 0
+	case *ssh.ExitError:
+		return e.ExitStatus()
+	case *ssh.ExitMissingError:
+		return 255
+	default:
+		logger.Error("%v", e)
+		return 255
+	}
+}
+
+// ssh config 中的 LocalForward, RemoteForward, DynamicForward
+func (sa *ssh_args) addConfigForwards(h *sshHop) {
+	if h.conf == nil {
+		return
+	}
+	spec := func(f sshconfig.Forward) string {
+		s := fmt.Sprintf("%d:%s:%d", f.InPort, f.OutHost, f.OutPort)
+		if f.InHost != "" {
+			s = f.InHost + ":" + s
+		}
+		return s
+	}
+	for _, f := range h.conf.LocalForwards {
+		sa.locals = append(sa.locals, spec(f))
+	}
+	for _, f := range h.conf.RemoteForwards {
+		sa.remotes = append(sa.remotes, spec(f))
+	}
+	for _, f := range h.conf.DynamicForwards {
+		s := strconv.Itoa(f.Port)
+		if f.Host != "" {
+			s = net.JoinHostPort(f.Host, s)
+		}
+		sa.dynamics = append(sa.dynamics, s)
+	}
+}
+
+// [bind_addr:]port:host:hostport, 没有 bind_addr 时为 localhost
+func parseForward(spec string) (string, string, error) {
+	s := strings.Split(spec, ":")
+	switch len(s) {
+	case 3:
+		return net.JoinHostPort("localhost", s[0]), net.JoinHostPort(s[1], s[2]), nil
+	case 4:
+		return net.JoinHostPort(s[0], s[1]), net.JoinHostPort(s[2], s[3]), nil
+	}
+	return "", "", fmt.Errorf("invalid forward %s, should be [bind_addr:]port:host:hostport", spec)
+}
+
+func pipeConn(a, b io.ReadWriteCloser) {
+	once := sync.Once{}
+	close := func() {
+		a.Close()
+		b.Close()
+	}
+	go func() {
+		io.Copy(a, b)
+		once.Do(close)
+	}()
+	io.Copy(b, a)
+	once.Do(close)
+}
+
+// 在 ln 上接受连接, 由 dial 建立另一端
+func serveForward(ln net.Listener, dial func() (net.Conn, error)) {
+	for {
+		c1, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			c2, err := dial()
+			if err != nil {
+				log.Printf("forward %v: %v\r\n", ln.Addr(), err)
+				c1.Close()
+				return
+			}
+			pipeConn(c1, c2)
+		}()
+	}
+}
+
+func forwardLocal(client *ssh.Client, spec string) error {
+	bind, dst, err := parseForward(spec)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	logger.Info("forward %s -> %s", bind, dst)
+	go serveForward(ln, func() (net.Conn, error) { return client.Dial("tcp", dst) })
+	return nil
+}
+
+func forwardRemote(client *ssh.Client, spec string) error {
+	bind, dst, err := parseForward(spec)
+	if err != nil {
+		return err
+	}
+	ln, err := client.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	logger.Info("forward remote %s -> %s", bind, dst)
+	go serveForward(ln, func() (net.Conn, error) { return net.Dial("tcp", dst) })
+	return nil
+}
+
+// [bind_addr:]port, 本地 socks5 服务, 连接由远端发起, 见 socks.go
+func forwardDynamic(client *ssh.Client, spec string) error {
+	bind := spec
+	if !strings.Contains(spec, ":") {
+		bind = net.JoinHostPort("localhost", spec)
+	}
+	s5, err := newSSHSocks(client, nil)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	logger.Info("socks5 on %s", bind)
+	go s5.Serve(ln)
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build windows
+// +build windows
+
+package scp
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// windows 下没有 SIGWINCH, 定时检查终端大小
+func watchResize(fd int, session *ssh.Session) func() {
+	done := make(chan struct{})
+	go func() {
+		w0, h0, _ := term.GetSize(fd)
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if w, h, err := term.GetSize(fd); err == nil && (w != w0 || h != h0) {
+					w0, h0 = w, h
+					session.WindowChange(h, w)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
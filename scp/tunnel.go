@@ -11,15 +11,14 @@ import (
 	"log"
 	"net"
 	"os"
-	"os/signal"
-	"path"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
-	"syscall"
 	"time"
 
+	"github.com/armon/go-socks5"
+	"github.com/lulugyf/fkme/util"
+	"github.com/lulugyf/fkme/ws"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -59,7 +58,7 @@ type TunnelConfig struct {
 		// socket on the remote side (at dial_address:port).
 		//
 		// The syntax of a reverse tunnel is:
-		//	"dial_address:port <- bind_address:port"
+		//	"bind_address:port <- dial_address:port"
 		//
 		// A reverse tunnel opens a listening TCP socket on the
 		// remote side (at bind_address:port) and proxies all traffic to a
@@ -83,107 +82,143 @@ type KeepAliveConfig struct {
 	// Interval is the amount of time in seconds to wait before the
 	// tunnel client will send a keep-alive message to ensure some minimum
 	// traffic on the SSH connection.
-	Interval uint
+	Interval uint `json:"interval"`
 
 	// CountMax is the maximum number of consecutive failed responses to
 	// keep-alive messages the client is willing to tolerate before considering
 	// the SSH connection as dead.
-	CountMax uint
+	CountMax uint `json:"count_max"`
 }
 
+var defaultKeepAlive = KeepAliveConfig{Interval: 30, CountMax: 2}
+
+const (
+	defaultRetryMin = 2 * time.Second
+	defaultRetryMax = 5 * time.Minute
+)
+
+// 一个端口映射, 同一个 srv 的端口映射共用一个 ssh 连接, 见 tunnel_server.go
 type tunnel struct {
-	auth          []ssh.AuthMethod
-	hostKeys      ssh.HostKeyCallback
-	mode          byte // '>' for forward, '<' for reverse
-	user          string
-	hostAddr      string
-	bindAddr      string
-	dialAddr      string
-	retryInterval time.Duration
-	keepAlive     KeepAliveConfig
-	//log logger
+	srv      *sshServer
+	mode     byte // '>' for forward, '<' for reverse, 'D' for dynamic socks5
+	bindAddr string
+	dialAddr string
+	socks    *SocksConf  // 'D' 的认证和规则, 见 socks.go
+	unixMode os.FileMode // 本地监听 unix socket 的权限
+	guard    *util.Guard // 本地监听的访问控制, 见 util/guard.go
+	audit    *util.AuditLog
+	sig      string // 端口映射的配置, 热加载时用于比较, 见 tunnel_reload.go
 }
 
 func (t tunnel) String() string {
+	return fmt.Sprintf("%v | %s", t.srv, t.spec())
+}
+
+// 配置中的写法, 例如 "localhost:7122 -> localhost:2022", 反向为 "远端监听 <- 本地地址"
+func (t tunnel) spec() string {
 	var left, right string
 	mode := "<?>"
 	switch t.mode {
 	case '>':
 		left, mode, right = t.bindAddr, "->", t.dialAddr
 	case '<':
-		left, mode, right = t.dialAddr, "<-", t.bindAddr
+		left, mode, right = t.bindAddr, "<-", t.dialAddr
+	case 'D':
+		left, mode, right = t.bindAddr, "<=>", "socks"
 	}
-	return fmt.Sprintf("%s@%s | %s %s %s", t.user, t.hostAddr, left, mode, right)
+	return fmt.Sprintf("%s %s %s", left, mode, right)
 }
 
-func (t tunnel) bindTunnel(ctx context.Context, wg *sync.WaitGroup) {
+/*
+在 ssh 连接 cl 上建立端口映射, 直到 ctx 结束或者监听失败
+连接断开时由调用者结束 ctx, 见 serverConn.run
+*/
+func (t tunnel) serve(ctx context.Context, wg *sync.WaitGroup, cl *ssh.Client) {
 	defer wg.Done()
+	if ws.IsUDPAddr(t.bindAddr) {
+		t.serveUDP(ctx, cl)
+		return
+	}
+	var once sync.Once // Only print errors once per session
 
-	for {
-		var once sync.Once // Only print errors once per session
-		func() {
-			// Connect to the server host via SSH.
-			cl, err := ssh.Dial("tcp", t.hostAddr, &ssh.ClientConfig{
-				User:            t.user,
-				Auth:            t.auth,
-				HostKeyCallback: t.hostKeys,
-				Timeout:         5 * time.Second,
-			})
-			if err != nil {
-				once.Do(func() { fmt.Printf("(%v) SSH dial error: %v\n", t, err) })
-				return
-			}
-			wg.Add(1)
-			go t.keepAliveMonitor(&once, wg, cl)
-			defer cl.Close()
-
-			// Attempt to bind to the inbound socket.
-			var ln net.Listener
-			switch t.mode {
-			case '>':
-				ln, err = net.Listen("tcp", t.bindAddr)
-			case '<':
-				ln, err = cl.Listen("tcp", t.bindAddr)
-			}
-			if err != nil {
-				once.Do(func() { fmt.Printf("(%v) bind error: %v\n", t, err) })
-				return
-			}
+	// Attempt to bind to the inbound socket.
+	var ln net.Listener
+	var err error
+	switch t.mode {
+	case '>', 'D':
+		if ln, err = ws.ListenLocal(t.bindAddr, t.unixMode); err == nil {
+			ln = t.guard.Listen(ln, t.String())
+		}
+	case '<':
+		ln, err = ws.ListenRemote(cl, t.bindAddr)
+	}
+	if err != nil {
+		once.Do(func() { fmt.Printf("(%v) bind error: %v\n", t, err) })
+		return
+	}
+	ln = t.auditListen(ln)
 
-			// The socket is binded. Make sure we close it eventually.
-			bindCtx, cancel := context.WithCancel(ctx)
-			defer cancel()
-			go func() {
-				cl.Wait()
-				cancel()
-			}()
-			go func() {
-				<-bindCtx.Done()
-				once.Do(func() {}) // Suppress future errors
-				ln.Close()
-			}()
+	// The socket is binded. Make sure we close it eventually.
+	bindCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-bindCtx.Done()
+		once.Do(func() {}) // Suppress future errors
+		ln.Close()
+	}()
 
-			fmt.Printf("(%v) binded tunnel\n", t)
-			defer fmt.Printf("(%v) collapsed tunnel\n", t)
+	fmt.Printf("(%v) binded tunnel\n", t)
+	defer fmt.Printf("(%v) collapsed tunnel\n", t)
 
-			// Accept all incoming connections.
-			for {
-				cn1, err := ln.Accept()
-				if err != nil {
-					once.Do(func() { fmt.Printf("(%v) accept error: %v\n", t, err) })
-					return
-				}
-				wg.Add(1)
-				go t.dialTunnel(bindCtx, wg, cl, cn1)
-			}
-		}()
+	// 动态转发, socks5 服务通过当前的 ssh 连接发起连接
+	var s5 *socks5.Server
+	if t.mode == 'D' {
+		if s5, err = newSSHSocks(cl, t.socks); err != nil {
+			once.Do(func() { fmt.Printf("(%v) socks error: %v\n", t, err) })
+			return
+		}
+	}
 
-		select {
-		case <-ctx.Done():
+	// Accept all incoming connections.
+	for {
+		cn1, err := ln.Accept()
+		if err != nil {
+			once.Do(func() { fmt.Printf("(%v) accept error: %v\n", t, err) })
 			return
-		case <-time.After(t.retryInterval):
-			fmt.Printf("(%v) retrying...\n", t)
 		}
+		wg.Add(1)
+		if s5 != nil {
+			go func() {
+				defer wg.Done()
+				s5.ServeConn(cn1)
+			}()
+			continue
+		}
+		go t.dialTunnel(bindCtx, wg, cl, cn1)
+	}
+}
+
+// 记录每个连接, socks 的目标由 util.AuditRules 设置
+func (t tunnel) auditListen(ln net.Listener) net.Listener {
+	dst := t.dialAddr
+	if t.mode == 'D' {
+		dst = ""
+	}
+	return t.audit.Listen(ln, t.spec(), t.srv.String(), dst)
+}
+
+// udp 端口映射, 每个来源地址一个 ssh 通道, 见 ws/udp.go
+func (t tunnel) serveUDP(ctx context.Context, cl *ssh.Client) {
+	pc, err := ws.ListenUDP(t.bindAddr)
+	if err != nil {
+		fmt.Printf("(%v) bind error: %v\n", t, err)
+		return
+	}
+	pc = t.guard.ListenPacket(pc, t.String())
+	fmt.Printf("(%v) binded tunnel\n", t)
+	defer fmt.Printf("(%v) collapsed tunnel\n", t)
+	if err := ws.ServeUDP(ctx, pc, cl, t.dialAddr); err != nil {
+		fmt.Printf("(%v) accept error: %v\n", t, err)
 	}
 }
 
@@ -193,22 +228,33 @@ func (t tunnel) dialTunnel(ctx context.Context, wg *sync.WaitGroup, client *ssh.
 	// The inbound connection is established. Make sure we close it eventually.
 	connCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	ac := util.AuditOf(cn1)
 	go func() {
 		<-connCtx.Done()
+		if ctx.Err() != nil {
+			ac.SetReason("tunnel closed")
+		}
 		cn1.Close()
 	}()
 
+	// 连接中是加帧头的数据报, 由本地转发到 udp 目标
+	if t.mode == '<' && ws.IsUDPAddr(t.dialAddr) {
+		util.RelayUDP(cn1, strings.TrimPrefix(t.dialAddr, "udp:"), 0)
+		return
+	}
+
 	// Establish the outbound connection.
-	var cn2 net.Conn
+	var cn2 io.ReadWriteCloser
 	var err error
 	switch t.mode {
 	case '>':
-		cn2, err = client.Dial("tcp", t.dialAddr)
+		cn2, err = ws.DialRemoteStream(client, t.dialAddr)
 	case '<':
-		cn2, err = net.Dial("tcp", t.dialAddr)
+		cn2, err = ws.DialLocal(t.dialAddr)
 	}
 	if err != nil {
 		fmt.Printf("(%v) dial error: %v", t, err)
+		ac.SetReason("dial error: " + err.Error())
 		return
 	}
 
@@ -227,10 +273,14 @@ func (t tunnel) dialTunnel(ctx context.Context, wg *sync.WaitGroup, client *ssh.
 	go func() {
 		defer wg2.Done()
 		defer cancel()
-		if _, err := io.Copy(cn1, cn2); err != nil {
+		_, err := io.Copy(cn1, cn2)
+		if err != nil {
 			once.Do(func() { fmt.Printf("(%v) connection error: %v", t, err) })
 		}
 		once.Do(func() {}) // Suppress future errors
+		if err == nil {
+			ac.SetReason("dst closed")
+		}
 	}()
 	go func() {
 		defer wg2.Done()
@@ -243,71 +293,76 @@ func (t tunnel) dialTunnel(ctx context.Context, wg *sync.WaitGroup, client *ssh.
 	wg2.Wait()
 }
 
-// keepAliveMonitor periodically sends messages to invoke a response.
-// If the server does not respond after some period of time,
-// assume that the underlying net.Conn abruptly died.
-func (t tunnel) keepAliveMonitor(once *sync.Once, wg *sync.WaitGroup, client *ssh.Client) {
-	defer wg.Done()
-	if t.keepAlive.Interval == 0 || t.keepAlive.CountMax == 0 {
-		return
-	}
-
-	// Detect when the SSH connection is closed.
-	wait := make(chan error, 1)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		wait <- client.Wait()
-	}()
+type TunnelConf struct {
+	Pass_OR_Keyfile string `json:"keyfile"` // 密码, 私钥文件, 或者 vault:<name>
 
-	// Repeatedly check if the remote server is still alive.
-	var aliveCount int32
-	ticker := time.NewTicker(time.Duration(t.keepAlive.Interval) * time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case err := <-wait:
-			if err != nil && err != io.EOF {
-				once.Do(func() { fmt.Printf("(%v) SSH error: %v", t, err) })
-			}
-			return
-		case <-ticker.C:
-			if n := atomic.AddInt32(&aliveCount, 1); n > int32(t.keepAlive.CountMax) {
-				once.Do(func() { fmt.Printf("(%v) SSH keep-alive termination", t) })
-				client.Close()
-				return
-			}
-		}
+	// 以下为全部 server 的默认值, 每个 server 或 tunnel 中可以覆盖
+	// keepalive 默认 {"interval":30, "count_max":2}, interval 为 0 时不检测
+	KeepAlive *KeepAliveConfig `json:"keepalive,omitempty"`
+	// 重连的等待从 retry_sec(默认 2) 开始每次加倍, 最多 retry_max_sec(默认 300), 本机网络变化时立即重连
+	RetrySec    int `json:"retry_sec"`
+	RetryMaxSec int `json:"retry_max_sec"`
+	// 使用 failover 中的备用 server 时, 每隔 failback_sec 检查优先的 server, 可用时切换回去, 0 为不切换
+	FailbackSec int `json:"failback_sec"`
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
-			if err == nil {
-				atomic.StoreInt32(&aliveCount, 0)
-			}
-		}()
-	}
-}
+	// 每个连接关闭时写一行 JSON 到 audit.file, 见 util/audit.go
+	Audit *util.AuditConf `json:"audit,omitempty"`
 
-type TunnelConf struct {
-	Pass_OR_Keyfile string `json:"keyfile"`
+	// 命名的 ssh 服务, tunnel 的 server 可以引用这里的名称
+	Servers map[string]*TunnelServer `json:"servers"`
 
 	Tunnels []struct {
 		// The syntax of a forward tunnel is:
 		//	"bind_address:port -> dial_address:port"
 		// The syntax of a reverse tunnel is:
-		//	"dial_address:port <- bind_address:port"
+		//	"bind_address:port <- dial_address:port"
+		// 注意: 以前的文档把反向映射写成 "dial <- bind", 但实际一直是监听左边(服务器上), 连接右边(本地)
+		// 按旧文档两边地址不同的配置, 需要交换 <- 两边的地址, 两边相同的(如 "localhost:2022 <- localhost:2022")不受影响
+		// The syntax of a dynamic (socks5) tunnel is:
+		//	"bind_address:port <=> socks"
+		// Any address can be a unix domain socket "unix:/path", see ws/streamlocal.go
+		// or a udp address "udp:host:port" on the local side or as the destination, see ws/udp.go
 		Tunnel string `json:"tunnel"`
+		// 本地监听的 unix socket 的权限, 八进制, 默认 "0600"
+		UnixMode string `json:"unix_mode"`
 
-		// Server is a remote SSH host. It has the following syntax:
+		// Server is a name in servers, or a remote SSH host with the following syntax:
 		//	"user@host:port"
 		//
 		// If the user is missing, then it defaults to the current process user.
 		// If the port is missing, then it defaults to 22.
-		Server   string `json:"server"`
-		RetrySec int    `json:"retry_sec`
-	} `json: tunnels`
+		// Tunnels with the same server share one SSH connection.
+		Server string `json:"server"`
+		// 备用的 server, 按优先级排列, server 连接失败或断开时依次尝试, 见 tunnel_server.go
+		Failover    []string         `json:"failover"`
+		FailbackSec int              `json:"failback_sec"`
+		RetrySec    int              `json:"retry_sec"`
+		RetryMaxSec int              `json:"retry_max_sec"`
+		KeepAlive   *KeepAliveConfig `json:"keepalive,omitempty"`
+		// 第一个转发到来时才连接, 没有转发 idle_min 分钟(默认 10)后断开, 不能用于 <-, 见 tunnel_ondemand.go
+		OnDemand bool `json:"on_demand"`
+		IdleMin  int  `json:"idle_min"`
+
+		// 动态转发的认证和规则
+		Socks *SocksConf `json:"socks,omitempty"`
+		// 本地监听(->, socks)的来源地址, 并发连接数和共享密钥, 见 util/guard.go
+		Guard *util.GuardConf `json:"guard,omitempty"`
+	} `json:"tunnels"`
+}
+
+type TunnelServer struct {
+	Addr       string   `json:"addr"`        // user@host:port, 或者 user@ws://host/ws
+	Keyfile    string   `json:"keyfile"`     // 私钥文件, 私钥内容, 密码, 或者 vault:<name>, 默认为全局的 keyfile
+	Password   string   `json:"password"`    // 密码, 可以是 vault:<name>
+	Agent      bool     `json:"agent"`       // 使用 SSH_AUTH_SOCK 中的密钥
+	HostKey    string   `json:"host_key"`    // 空或 insecure: 不检查, known_hosts: 按 known_hosts 检查, SHA256:...: 指纹
+	KnownHosts []string `json:"known_hosts"` // 默认 ~/.ssh/known_hosts
+	Proxy      string   `json:"proxy"`       // socks5 代理 host:port
+	Jump       string   `json:"jump"`        // 跳板, servers 中的名称或 user@host:port
+
+	KeepAlive   *KeepAliveConfig `json:"keepalive,omitempty"`
+	RetrySec    int              `json:"retry_sec"`
+	RetryMaxSec int              `json:"retry_max_sec"`
 }
 
 /*
@@ -327,186 +382,252 @@ type TunnelConf struct {
 	]
 }
 
+:: socks5 proxy through the server, same as ssh -D, see socks.go
+{
+	"keyfile":"vault:prodkey",
+	"tunnels":[
+		{"tunnel":"127.0.0.1:1080 <=> socks", "server":"app@121.43.230.103:22", "retry_sec":30,
+		 "socks":{"user":"me", "pass":"vault:s5pass", "allow":["10.0.0.0/8", "*.corp.com"]}}
+	]
+}
+
+:: keepalive and reconnect backoff, global and per tunnel
+{
+	"keyfile":"vault:prodkey",
+	"keepalive":{"interval":15, "count_max":3},
+	"retry_sec":1, "retry_max_sec":120,
+	"tunnels":[
+		{"tunnel":"localhost:7122 -> localhost:2022", "server":"app@121.43.230.103:22"},
+		{"tunnel":"localhost:2022 <- localhost:2022", "server":"app@121.43.230.103:22",
+		 "keepalive":{"interval":0}, "retry_sec":30, "retry_max_sec":600}
+	]
+}
+
+:: named servers, the tunnels of one server share one ssh connection
+{
+	"servers":{
+		"gw":   {"addr":"app@121.43.230.103:22", "keyfile":"vault:gwkey", "host_key":"known_hosts"},
+		"db":   {"addr":"dba@10.2.0.8:22", "password":"vault:dbpass", "jump":"gw"},
+		"lab":  {"addr":"me@10.9.0.2", "agent":true, "proxy":"127.0.0.1:1080",
+		         "host_key":"SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"},
+		"edge": {"addr":"_base_@wss://example.com/yt/ws", "keyfile":"~/.ssh/id_ed25519"}
+	},
+	"tunnels":[
+		{"tunnel":"localhost:7122 -> localhost:2022", "server":"gw"},
+		{"tunnel":"localhost:2022 <- localhost:2022", "server":"gw"},
+		{"tunnel":"localhost:15432 -> localhost:5432", "server":"db"},
+		{"tunnel":"127.0.0.1:1080 <=> socks", "server":"edge"}
+	]
+}
+
+:: unix domain sockets, remote docker and postgres, local jupyter kernel published on the server
+{
+	"keyfile":"~/.ssh/id_ed25519",
+	"tunnels":[
+		{"tunnel":"unix:/tmp/gw-docker.sock -> unix:/var/run/docker.sock", "server":"app@121.43.230.103", "unix_mode":"0660"},
+		{"tunnel":"127.0.0.1:15432 -> unix:/var/run/postgresql/.s.PGSQL.5432", "server":"app@121.43.230.103"},
+		{"tunnel":"unix:/tmp/kernel.sock <- unix:/run/user/1000/jupyter/kernel.sock", "server":"app@121.43.230.103"}
+	]
+}
+
+:: udp, dns through fkme sshd, statsd through openssh with fkme pm -b "7125;udp:127.0.0.1:8125" on the server
+{
+	"keyfile":"~/.ssh/id_ed25519",
+	"tunnels":[
+		{"tunnel":"udp:127.0.0.1:5353 -> udp:10.0.0.2:53", "server":"app@121.43.230.103:2022"},
+		{"tunnel":"udp:127.0.0.1:8125 -> 127.0.0.1:7125", "server":"app@121.43.230.103"}
+	]
+}
+
+:: failover, the office reverse tunnel moves to the next relay when one is down,
+:: and back to the first one 5 minutes after it recovers, see fkme tunnel -status-addr
+{
+	"keyfile":"vault:officekey",
+	"servers":{
+		"relay1": {"addr":"app@121.43.230.103:22", "host_key":"known_hosts"},
+		"relay2": {"addr":"app@47.98.10.21:22", "host_key":"known_hosts"},
+		"relay3": {"addr":"_base_@wss://example.com/yt/ws"}
+	},
+	"tunnels":[
+		{"tunnel":"localhost:2022 <- localhost:2022", "server":"relay1", "failover":["relay2", "relay3"], "failback_sec":300}
+	]
+}
+
+:: forwards shared with the lan, the first only for the office subnet with at most 20 connections,
+:: the second for other fkme only: fkme pm -b "7022;192.168.10.5:7000" -dial-secret vault:fwdsecret
+{
+	"keyfile":"~/.ssh/id_ed25519",
+	"tunnels":[
+		{"tunnel":"0.0.0.0:7122 -> localhost:22", "server":"app@121.43.230.103",
+		 "guard":{"allow":["192.168.10.0/24"], "deny":["192.168.10.1"], "max_conn":20}},
+		{"tunnel":"0.0.0.0:7000 -> localhost:22", "server":"app@121.43.230.103", "guard":{"secret":"vault:fwdsecret"}}
+	]
+}
+
+:: audit, a JSON line for every closed connection, rotated at 50MB, see util/audit.go
+{
+	"keyfile":"~/.ssh/id_ed25519",
+	"audit":{"file":"~/.fkme/tunnel-audit.jsonl", "max_mb":50, "keep":10},
+	"tunnels":[
+		{"tunnel":"0.0.0.0:7122 -> localhost:22", "server":"app@121.43.230.103"},
+		{"tunnel":"127.0.0.1:1080 <=> socks", "server":"app@121.43.230.103"}
+	]
+}
+
+:: on demand, connect to the bastion on the first connection, disconnect after 5 idle minutes
+{
+	"keyfile":"~/.ssh/id_ed25519",
+	"servers":{"bastion": {"addr":"ops@bastion.corp.com", "host_key":"known_hosts"}},
+	"tunnels":[
+		{"tunnel":"127.0.0.1:15432 -> 10.0.0.5:5432", "server":"bastion", "on_demand":true, "idle_min":5},
+		{"tunnel":"127.0.0.1:1080 <=> socks", "server":"bastion", "on_demand":true, "idle_min":5}
+	]
+}
+
 */
-func loadConf(conf_file string) (tunns []tunnel, closer func() error) {
+// 审计文件在热加载之间保持打开, 同一个文件只打开一次
+var (
+	auditMu   sync.Mutex
+	auditLogs = map[string]*util.AuditLog{}
+)
+
+func openAudit(conf *util.AuditConf) (*util.AuditLog, error) {
+	if conf == nil || conf.File == "" {
+		return nil, nil
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if a, ok := auditLogs[conf.File]; ok { // 同一个文件只打开一次, 重新加载时更新轮转参数
+		a.SetLimits(conf.MaxMB, conf.Keep)
+		return a, nil
+	}
+	a, err := util.OpenAudit(conf)
+	if err != nil {
+		return nil, err
+	}
+	auditLogs[conf.File] = a
+	return a, nil
+}
+
+func loadConf(conf_file string) (tunns []tunnel, err error) {
 	configJson, err := ioutil.ReadFile(conf_file)
 	if err != nil {
-		log.Printf("ReadFile Error:%v\n", err)
-		return nil, closer
+		return nil, err
 	}
 	var conf TunnelConf
 	err = json.Unmarshal(configJson, &conf)
 	if err != nil {
-		log.Printf("json decode failed: %v\n", err)
-		return nil, closer
+		return nil, fmt.Errorf("json decode failed: %v", err)
 	}
-	var auth []ssh.AuthMethod
-	_, err = os.Stat(conf.Pass_OR_Keyfile)
-	if err == nil {
-		pemBytes, err := ioutil.ReadFile(conf.Pass_OR_Keyfile)
-		signer, err := ssh.ParsePrivateKey(pemBytes)
-		if err == nil {
-			auth = append(auth, ssh.PublicKeys(signer))
-		}
-	} else {
-		auth = append(auth, ssh.Password(conf.Pass_OR_Keyfile))
+
+	audit, err := openAudit(conf.Audit)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %v", err)
 	}
+	a, _ := json.Marshal(conf.Audit)
 
+	servers := map[string]*sshServer{} // 相同配置的 server 使用同一个对象
 	for _, t := range conf.Tunnels {
-
-		var tunn tunnel
-		tunn.auth = auth
-		tunn.hostKeys = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
+		newServer := func(name string) (*sshServer, error) {
+			ts := conf.Servers[name]
+			if ts == nil {
+				ts = &TunnelServer{Addr: name}
+			}
+			ts1 := *ts
+			if t.KeepAlive != nil {
+				ts1.KeepAlive = t.KeepAlive
+			}
+			if t.RetrySec > 0 {
+				ts1.RetrySec = t.RetrySec
+			}
+			if t.RetryMaxSec > 0 {
+				ts1.RetryMaxSec = t.RetryMaxSec
+			}
+			return conf.newServer(name, &ts1, 0)
 		}
-
-		// user@172.18.231.76:7122
-		re := regexp.MustCompile("^([^@]+)@([^:]+):([0-9]+)")
-		reout := re.FindStringSubmatch(t.Server)
-		if len(reout) > 0 {
-			tunn.user = reout[1]
-			tunn.hostAddr = net.JoinHostPort(reout[2], reout[3])
-		} else {
-			log.Printf("--- %v, %d [%s]\n", reout, len(reout), t.Server)
+		srv, err := newServer(t.Server)
+		if err != nil {
+			log.Printf("server %s: %v\n", t.Server, err)
 			continue
 		}
+		for _, name := range t.Failover {
+			fs, err := newServer(name)
+			if err != nil {
+				log.Printf("failover server %s: %v\n", name, err)
+				continue
+			}
+			srv.failover = append(srv.failover, fs)
+			srv.sig += "|failover:" + fs.sig
+		}
+		if len(srv.failover) > 0 {
+			for _, f := range []int{conf.FailbackSec, t.FailbackSec} {
+				if f > 0 {
+					srv.failback = time.Duration(f) * time.Second
+				}
+			}
+			srv.sig += fmt.Sprintf("|failback:%v", srv.failback)
+		}
+		if t.OnDemand {
+			if strings.Contains(t.Tunnel, " <- ") {
+				log.Printf("on_demand is not supported for reverse tunnel: %s\n", t.Tunnel)
+				continue
+			}
+			srv.onDemand, srv.idle = true, defaultIdle
+			if t.IdleMin > 0 {
+				srv.idle = time.Duration(t.IdleMin) * time.Minute
+			}
+			srv.sig += fmt.Sprintf("|on_demand:%v", srv.idle)
+		}
+		if s, ok := servers[srv.sig]; ok {
+			srv = s
+		} else {
+			servers[srv.sig] = srv
+		}
+
+		var tunn tunnel
+		tunn.srv = srv
 		tt := strings.Split(t.Tunnel, " ")
 		if len(tt) != 3 {
 			log.Printf("invalid Tunnel config: %s\n", t.Tunnel)
 			continue
 		}
-		tunn.retryInterval = time.Duration(t.RetrySec) * time.Second
 		if tt[1] == "->" { // forward tunnel
 			tunn.mode = '>'
 			tunn.bindAddr = tt[0]
 			tunn.dialAddr = tt[2]
-			//tunn1.keepAlive = *KeepAliveConfig
-			tunns = append(tunns, tunn)
 		} else if tt[1] == "<-" { // reverse tunnel
 			tunn.mode = '<'
 			tunn.bindAddr = tt[0]
 			tunn.dialAddr = tt[2]
-			tunns = append(tunns, tunn)
+		} else if tt[1] == "<=>" && tt[2] == "socks" { // dynamic tunnel
+			tunn.mode = 'D'
+			tunn.bindAddr = tt[0]
+			tunn.socks = t.Socks
+		} else {
+			log.Printf("invalid Tunnel config: %s\n", t.Tunnel)
+			continue
 		}
-	}
-	return tunns, closer
-}
-
-func loadConfig(is_remote bool) (tunns []tunnel, closer func() error) {
-
-	// 1.) Build Auth Agent and Config
-	var auth []ssh.AuthMethod
-	var pass_or_keyfile = "D:\\devtool\\bin\\id_rsa"
-
-	_, err := os.Stat(pass_or_keyfile) // if os.IsNotExists(err)
-	if err == nil {
-		pemBytes, err := ioutil.ReadFile(pass_or_keyfile)
-		signer, err := ssh.ParsePrivateKey(pemBytes)
-		if err == nil {
-			auth = append(auth, ssh.PublicKeys(signer))
+		if ws.IsUDPAddr(tunn.bindAddr) && tunn.mode != '>' {
+			log.Printf("udp is only supported on the local side: %s\n", t.Tunnel)
+			continue
 		}
-	} else {
-		auth = append(auth, ssh.Password(pass_or_keyfile))
-
-	}
-
-	// case "->":
-	// 	tunn.bindAddr, tunn.mode, tunn.dialAddr = tt[0], '>', tt[2]
-	// case "<-":
-	// 	tunn.dialAddr, tunn.mode, tunn.bindAddr = tt[0], '<', tt[2]
-
-	// ssh $USER@$HOST -i /path/to/key.priv -L $BIND_ADDRESS:$BIND_PORT:$DIAL_ADDRESS:$DIAL_PORT
-	// ssh $USER@$HOST -i /path/to/key.priv -R $BIND_ADDRESS:$BIND_PORT:$DIAL_ADDRESS:$DIAL_PORT
-
-	// Example 1
-	// Binds Redis from Tailscale Pihole to Localhost of Mini
-	if !is_remote {
-		var tunn1 tunnel
-		tunn1.auth = auth
-		tunn1.hostKeys = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
+		if t.UnixMode != "" {
+			mode, err := strconv.ParseUint(t.UnixMode, 8, 32)
+			if err != nil {
+				log.Printf("invalid unix_mode %s: %s\n", t.UnixMode, t.Tunnel)
+				continue
+			}
+			tunn.unixMode = os.FileMode(mode)
 		}
-		tunn1.mode = '>' // '>' for forward, '<' for reverse
-		tunn1.user = "app"
-		tunn1.hostAddr = net.JoinHostPort("121.43.230.103", "22")
-		tunn1.bindAddr = "localhost:7122"
-		tunn1.dialAddr = "localhost:2022"
-		tunn1.retryInterval = 30 * time.Second
-		//tunn1.keepAlive = *KeepAliveConfig
-		tunns = append(tunns, tunn1)
-	}
-
-	// Example 2
-	// Binds Temporary Python Server from Mini to Localhost of Tailscale Pihole
-	if is_remote {
-		var tunn2 tunnel
-		tunn2.auth = auth
-		tunn2.hostKeys = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
+		if tunn.guard, err = util.NewGuard(t.Guard); err != nil {
+			log.Printf("invalid guard %v: %s\n", err, t.Tunnel)
+			continue
 		}
-		tunn2.mode = '<' // '>' for forward, '<' for reverse
-		tunn2.user = "app"
-		tunn2.hostAddr = net.JoinHostPort("121.43.230.103", "22")
-		tunn2.bindAddr = "localhost:2022"
-		tunn2.dialAddr = "localhost:2022"
-		tunn2.retryInterval = 300 * time.Second
-		//tunn1.keepAlive = *KeepAliveConfig
-		tunns = append(tunns, tunn2)
-	}
-
-	return tunns, closer
-}
-
-func main__() {
-	var tunns []tunnel
-	var closer func() error
-	if len(os.Args) > 1 && os.Args[1] == "client" {
-		tunns, closer = loadConfig(false)
-	} else {
-		tunns, closer = loadConfig(true)
-	}
-	defer closer()
-
-	// Setup signal handler to initiate shutdown.
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		sigc := make(chan os.Signal, 1)
-		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
-		fmt.Printf("received %v - initiating shutdown\n", <-sigc)
-		cancel()
-	}()
-
-	// Start a bridge for each tunnel.
-	var wg sync.WaitGroup
-	fmt.Printf("%s starting\n", path.Base(os.Args[0]))
-	defer fmt.Printf("%s shutdown\n", path.Base(os.Args[0]))
-	for _, t := range tunns {
-		wg.Add(1)
-		go t.bindTunnel(ctx, &wg)
-	}
-	wg.Wait()
-}
-
-func SSHTunnel(args []string) {
-	tunns, closer := loadConf(args[0])
-	defer closer()
-
-	// Setup signal handler to initiate shutdown.
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		sigc := make(chan os.Signal, 1)
-		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
-		fmt.Printf("received %v - initiating shutdown\n", <-sigc)
-		cancel()
-	}()
-
-	// Start a bridge for each tunnel.
-	var wg sync.WaitGroup
-	fmt.Printf("%s starting\n", path.Base(os.Args[0]))
-	defer fmt.Printf("%s shutdown\n", path.Base(os.Args[0]))
-	for _, t := range tunns {
-		wg.Add(1)
-		go t.bindTunnel(ctx, &wg)
+		tunn.audit = audit
+		b, _ := json.Marshal(t.Socks)
+		g, _ := json.Marshal(t.Guard)
+		tunn.sig = fmt.Sprintf("%s|%s|%v|%s|%s", t.Tunnel, b, tunn.unixMode, g, a)
+		tunns = append(tunns, tunn)
 	}
-	wg.Wait()
+	return tunns, nil
 }
@@ -0,0 +1,310 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lulugyf/fkme/util"
+	"github.com/lulugyf/fkme/ws"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+按需连接: 本地监听立即建立, 第一个转发到来时才连接 ssh, 连接期间新的转发等待连接完成(最多 onDemandDialTimeout)
+没有转发超过 idle_min 分钟(默认 10)后断开 ssh 连接, 之后的转发再重新连接
+只用于本地监听的端口映射(->, socks 和 udp), 同一个 server 的端口映射共用 on_demand 设置
+
+	{"tunnel":"127.0.0.1:15432 -> 10.0.0.5:5432", "server":"bastion", "on_demand":true, "idle_min":5}
+	{"tunnel":"127.0.0.1:1080 <=> socks", "server":"bastion", "on_demand":true}
+*/
+const onDemandDialTimeout = 30 * time.Second
+
+const defaultIdle = 10 * time.Minute
+
+// 按需连接的 serverConn 不主动连接, 只检查空闲并在停止时断开连接
+func (sc *serverConn) runOnDemand(ctx context.Context) {
+	defer sc.wg.Done()
+	t := time.NewTicker(idleCheck(sc.srv.idle))
+	defer t.Stop()
+	for {
+		// 停止时 connCtx 随 ctx 结束, 由 dialOnDemand 断开连接
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		sc.mu.Lock()
+		if sc.client != nil && sc.users == 0 && time.Since(sc.idleSince) > sc.srv.idle {
+			fmt.Printf("(%v) idle for %v, disconnect\n", sc.srv, sc.srv.idle)
+			sc.disconnect()
+		}
+		sc.mu.Unlock()
+	}
+}
+
+func idleCheck(idle time.Duration) time.Duration {
+	d := idle / 4
+	if d > time.Minute {
+		d = time.Minute
+	}
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// 取得 ssh 连接, 没有连接时发起连接并等待, 成功时 users 加一, 用完后调用 release
+func (sc *serverConn) acquire(ctx context.Context) (*ssh.Client, context.Context, error) {
+	timer := time.NewTimer(onDemandDialTimeout)
+	defer timer.Stop()
+	for i := 0; ; i++ {
+		sc.mu.Lock()
+		if sc.client != nil {
+			sc.users++
+			cl, connCtx := sc.client, sc.connCtx
+			sc.mu.Unlock()
+			return cl, connCtx, nil
+		}
+		if i > 0 {
+			err := errors.New("not connected")
+			if sc.lastErr != "" {
+				err = errors.New(sc.lastErr)
+			}
+			sc.mu.Unlock()
+			return nil, nil, err
+		}
+		if sc.dialing == nil {
+			sc.dialing = make(chan struct{})
+			sc.wg.Add(1)
+			go sc.dialOnDemand(sc.dialing)
+		}
+		dialing := sc.dialing
+		sc.mu.Unlock()
+
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-timer.C:
+			return nil, nil, fmt.Errorf("connect timeout after %v", onDemandDialTimeout)
+		}
+	}
+}
+
+// 连接 ssh, 连接结束(成功或者失败)时关闭 done, 成功时等待连接断开后清理
+func (sc *serverConn) dialOnDemand(done chan struct{}) {
+	defer sc.wg.Done()
+	cl, closer, active := sc.dialAny()
+	sc.mu.Lock()
+	sc.dialing = nil
+	if cl == nil || sc.ctx.Err() != nil {
+		sc.mu.Unlock()
+		close(done)
+		if cl != nil {
+			closer()
+		}
+		return
+	}
+	connCtx, cancel := context.WithCancel(sc.ctx)
+	if sc.active != nil && sc.active != active {
+		sc.switches++
+	}
+	sc.active, sc.since, sc.idleSince = active, time.Now(), time.Now()
+	sc.client, sc.connCtx, sc.disconnect = cl, connCtx, cancel
+	sc.mu.Unlock()
+	close(done)
+
+	fmt.Printf("(%v) connected on demand\n", active)
+	go active.keepAliveMonitor(connCtx, cl)
+	go func() {
+		<-connCtx.Done()
+		cl.Close()
+	}()
+	cl.Wait()
+	cancel()
+	sc.mu.Lock()
+	sc.client, sc.connCtx, sc.disconnect = nil, nil, nil
+	sc.mu.Unlock()
+	closer()
+	fmt.Printf("(%v) disconnected\n", active)
+}
+
+func (sc *serverConn) release() {
+	sc.mu.Lock()
+	sc.users--
+	if sc.users == 0 {
+		sc.idleSince = time.Now()
+	}
+	sc.mu.Unlock()
+}
+
+// 建立按需连接的本地监听, 监听失败时单独重试, 调用时持有 sc.mu
+func (sc *serverConn) bindOnDemand(p *portRun) {
+	ctx, cancel := context.WithCancel(sc.ctx)
+	p.cancel = cancel
+	t := p.t
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		bo := &util.Backoff{Min: sc.srv.retryMin, Max: sc.srv.retryMax}
+		for {
+			p.wg.Add(1)
+			sc.serveOnDemand(ctx, p.wg, t)
+			if ctx.Err() != nil {
+				return
+			}
+			d := bo.Next()
+			fmt.Printf("(%v) retrying in %v...\n", t, d.Round(100*time.Millisecond))
+			if !util.Sleep(ctx, d) {
+				return
+			}
+		}
+	}()
+}
+
+// 与 tunnel.serve 相同, 但每个转发开始时才取得 ssh 连接
+func (sc *serverConn) serveOnDemand(ctx context.Context, wg *sync.WaitGroup, t tunnel) {
+	defer wg.Done()
+	if ws.IsUDPAddr(t.bindAddr) {
+		pc, err := ws.ListenUDP(t.bindAddr)
+		if err != nil {
+			fmt.Printf("(%v) bind error: %v\n", t, err)
+			return
+		}
+		pc = t.guard.ListenPacket(pc, t.String())
+		fmt.Printf("(%v) binded tunnel (on demand)\n", t)
+		defer fmt.Printf("(%v) collapsed tunnel\n", t)
+		err = util.ServeUDP(ctx, pc, func() (io.ReadWriteCloser, error) {
+			cl, _, err := sc.acquire(ctx)
+			if err != nil {
+				return nil, err
+			}
+			stream, err := ws.DialRemoteStream(cl, t.dialAddr)
+			if err != nil {
+				sc.release()
+				return nil, err
+			}
+			return &releaseStream{ReadWriteCloser: stream, release: sc.release}, nil
+		}, 0)
+		if err != nil {
+			fmt.Printf("(%v) accept error: %v\n", t, err)
+		}
+		return
+	}
+
+	ln, err := ws.ListenLocal(t.bindAddr, t.unixMode)
+	if err != nil {
+		fmt.Printf("(%v) bind error: %v\n", t, err)
+		return
+	}
+	ln = t.auditListen(t.guard.Listen(ln, t.String()))
+	bindCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-bindCtx.Done()
+		ln.Close()
+	}()
+
+	fmt.Printf("(%v) binded tunnel (on demand)\n", t)
+	defer fmt.Printf("(%v) collapsed tunnel\n", t)
+
+	// socks5 握手在本地完成, 连接目标时才取得 ssh 连接
+	var s5 interface{ ServeConn(net.Conn) error }
+	if t.mode == 'D' {
+		s5, err = newSocks(func(dctx context.Context, network, addr string) (net.Conn, error) {
+			cl, _, err := sc.acquire(dctx)
+			if err != nil {
+				return nil, err
+			}
+			cn, err := cl.Dial(network, addr)
+			if err != nil {
+				sc.release()
+				return nil, err
+			}
+			return &releaseConn{Conn: cn, release: sc.release}, nil
+		}, t.socks)
+		if err != nil {
+			fmt.Printf("(%v) socks error: %v\n", t, err)
+			return
+		}
+	}
+
+	for {
+		cn1, err := ln.Accept()
+		if err != nil {
+			if bindCtx.Err() == nil {
+				fmt.Printf("(%v) accept error: %v\n", t, err)
+			}
+			return
+		}
+		wg.Add(1)
+		if s5 != nil {
+			go func() {
+				defer wg.Done()
+				s5.ServeConn(cn1)
+			}()
+			continue
+		}
+		go func() {
+			cl, connCtx, err := sc.acquire(bindCtx)
+			if err != nil {
+				fmt.Printf("(%v) on demand connect error: %v\n", t, err)
+				util.AuditOf(cn1).SetReason("connect error: " + err.Error())
+				cn1.Close()
+				wg.Done()
+				return
+			}
+			defer sc.release()
+			// 连接断开或者监听关闭时结束转发
+			fwdCtx, cancel := context.WithCancel(connCtx)
+			defer cancel()
+			go func() {
+				select {
+				case <-bindCtx.Done():
+					cancel()
+				case <-fwdCtx.Done():
+				}
+			}()
+			t := t
+			t.srv = sc.activeServer()
+			t.dialTunnel(fwdCtx, wg, cl, cn1)
+		}()
+	}
+}
+
+func (sc *serverConn) activeServer() *sshServer {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.active != nil {
+		return sc.active
+	}
+	return sc.srv
+}
+
+// Close 时释放按需连接的计数
+type releaseConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *releaseConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+type releaseStream struct {
+	io.ReadWriteCloser
+	once    sync.Once
+	release func()
+}
+
+func (s *releaseStream) Close() error {
+	s.once.Do(s.release)
+	return s.ReadWriteCloser.Close()
+}
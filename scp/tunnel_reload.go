@@ -0,0 +1,248 @@
+package scp
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lulugyf/fkme/logger"
+	"github.com/lulugyf/fkme/watch"
+)
+
+/*
+tunnel 配置热加载: 配置文件变化(-watch)或收到 SIGHUP 时重新读取, 与运行中的 server 比较
+  新增的 server 启动, 删除的停止, 连接配置(地址, 认证, 跳板, keyfile 等)修改的先停止再启动
+  连接配置没有变化的 server 保持 ssh 连接, 只增加和删除其中的端口映射
+  没有变化的端口映射不受影响
+  新配置读取失败时保留原来的 tunnel
+
+fkme tunnel tunnel_pc.json
+fkme tunnel -watch=false tunnel_pc.json   # 只在 SIGHUP 时重新读取
+kill -HUP <pid>
+
+-status-addr 提供 HTTP 状态查询, 包括每个连接当前使用的 server(见 failover), 是否连接, 最后的错误
+fkme tunnel -status-addr 127.0.0.1:8091 tunnel_pc.json
+curl http://127.0.0.1:8091/status
+*/
+type tunnelSet struct {
+	conf_file string
+	mu        sync.Mutex             // 保护 running 和 order, 状态查询在其它 goroutine 中
+	running   map[string]*serverConn // key 为 sshServer.sig
+	order     []string
+}
+
+// 按 server 分组, 保持配置中的顺序
+func groupByServer(tunns []tunnel) (map[string][]tunnel, []*sshServer) {
+	groups := map[string][]tunnel{}
+	servers := []*sshServer{}
+	for _, t := range tunns {
+		if _, ok := groups[t.srv.sig]; !ok {
+			servers = append(servers, t.srv)
+		}
+		groups[t.srv.sig] = append(groups[t.srv.sig], t)
+	}
+	return groups, servers
+}
+
+func (s *tunnelSet) start(srv *sshServer, tunns []tunnel) {
+	sc := startServer(srv, tunns)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running[srv.sig] = sc
+	s.order = append(s.order, srv.sig)
+}
+
+// 停止并等待监听端口关闭, 以便修改后的 tunnel 可以使用同一个端口
+func (s *tunnelSet) stop(sig string) {
+	sc, ok := s.running[sig]
+	if !ok {
+		return
+	}
+	sc.stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, sig)
+	for i, k := range s.order {
+		if k == sig {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *tunnelSet) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	conns := []*serverConn{}
+	for _, k := range s.order {
+		conns = append(conns, s.running[k])
+	}
+	s.mu.Unlock()
+	st := []serverStatus{}
+	for _, sc := range conns {
+		st = append(st, sc.status())
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// 在 addr 上启动状态服务, 不阻塞
+func (s *tunnelSet) serveStatus(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	go func() {
+		logger.Info("status server listen on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("status server on %s failed: %v", addr, err)
+		}
+	}()
+}
+
+func (s *tunnelSet) stopAll() {
+	for len(s.order) > 0 {
+		s.stop(s.order[len(s.order)-1])
+	}
+}
+
+func (s *tunnelSet) reload() error {
+	tunns, err := loadConf(s.conf_file)
+	if err != nil {
+		return err
+	}
+	groups, servers := groupByServer(tunns)
+	stopped, started, ports := 0, 0, 0
+	for _, sig := range append([]string{}, s.order...) {
+		if _, ok := groups[sig]; !ok {
+			logger.Info("(%v) stop", s.running[sig].srv)
+			s.stop(sig)
+			stopped++
+		}
+	}
+	for _, srv := range servers {
+		sc, ok := s.running[srv.sig]
+		if !ok {
+			logger.Info("(%v) start", srv)
+			s.start(srv, groups[srv.sig])
+			started++
+			continue
+		}
+		// 连接不变, 同步端口映射
+		want := map[string]bool{}
+		for _, t := range groups[srv.sig] {
+			want[t.sig] = true
+		}
+		sc.mu.Lock()
+		old := []tunnel{}
+		for _, k := range sc.order {
+			old = append(old, sc.ports[k].t)
+		}
+		sc.mu.Unlock()
+		for _, t := range old {
+			if !want[t.sig] {
+				logger.Info("(%v) remove", t)
+				sc.removePort(t.sig)
+				ports++
+			}
+		}
+		for _, t := range groups[srv.sig] {
+			t.srv = sc.srv
+			if sc.addPort(t) {
+				logger.Info("(%v) add", t)
+				ports++
+			}
+		}
+	}
+	logger.Info("tunnels reloaded from %s: %d servers stopped, %d started, %d ports changed, %d running",
+		s.conf_file, stopped, started, ports, len(s.running))
+	return nil
+}
+
+// 监视配置文件所在的目录, 只关心配置文件本身, 编辑器改名保存也能收到
+func watchConfFile(ctx context.Context, conf_file string, changed chan<- struct{}) {
+	abs, err := filepath.Abs(conf_file)
+	if err != nil {
+		logger.Warn("watch %s: %v", conf_file, err)
+		return
+	}
+	dir := filepath.Dir(abs)
+	opts := &watch.Options{
+		Debounce: 500 * time.Millisecond,
+		Ignore: []watch.Matcher{func(p string, isDir bool) bool {
+			return isDir || p != abs
+		}},
+	}
+	err = watch.Files(ctx, dir, opts, func(fpath string) error {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		logger.Warn("watch %s: %v, use SIGHUP to reload", conf_file, err)
+	}
+}
+
+func SSHTunnel(args []string) {
+	cmd := flag.NewFlagSet("tunnel", flag.ExitOnError)
+	watch_conf := cmd.Bool("watch", true, "reload when the config file changes, SIGHUP always reloads")
+	status_addr := cmd.String("status-addr", "", "serve tunnel status over HTTP on this address, e.g. 127.0.0.1:8091")
+	cmd.Parse(args)
+	if cmd.NArg() != 1 {
+		fmt.Println("fkme tunnel [-watch=false] [-status-addr host:port] <tunnel.json>")
+		os.Exit(2)
+	}
+	s := &tunnelSet{conf_file: cmd.Arg(0), running: map[string]*serverConn{}}
+	tunns, err := loadConf(s.conf_file)
+	if err != nil {
+		logger.Error("%s: %v", s.conf_file, err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("%s starting\n", path.Base(os.Args[0]))
+	defer fmt.Printf("%s shutdown\n", path.Base(os.Args[0]))
+	groups, servers := groupByServer(tunns)
+	for _, srv := range servers {
+		s.start(srv, groups[srv.sig])
+	}
+
+	if *status_addr != "" {
+		s.serveStatus(*status_addr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	if *watch_conf {
+		go watchConfFile(ctx, s.conf_file, changed)
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case sig := <-sigc:
+			if sig != syscall.SIGHUP {
+				fmt.Printf("received %v - initiating shutdown\n", sig)
+				s.stopAll()
+				return
+			}
+		case <-changed:
+		}
+		if err := s.reload(); err != nil {
+			logger.Error("reload %s failed, keep running tunnels: %v", s.conf_file, err)
+		}
+	}
+}
@@ -0,0 +1,589 @@
+package scp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lulugyf/fkme/logger"
+	"github.com/lulugyf/fkme/sshconfig"
+	"github.com/lulugyf/fkme/util"
+	"github.com/lulugyf/fkme/vault"
+	"github.com/lulugyf/fkme/ws"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+/*
+tunnel 配置中的 ssh 服务, 同一个服务的全部端口映射共用一个 ssh 连接
+连接断开时全部端口映射一起关闭, 重连后重新建立
+*/
+type sshServer struct {
+	name      string // servers 中的名称, 或者 user@host:port
+	user      string
+	hostAddr  string // host:port, 或者 ws:// wss:// 地址
+	auth      []ssh.AuthMethod
+	hostKeys  ssh.HostKeyCallback
+	proxy     string     // socks5 代理
+	jump      *sshServer // 跳板
+	retryMin  time.Duration
+	retryMax  time.Duration
+	keepAlive KeepAliveConfig
+	sig       string // 连接的配置, 热加载时用于比较
+
+	failover []*sshServer  // 备用的 server, 按优先级排列
+	failback time.Duration // 使用备用 server 时检查优先 server 的间隔, 0 为不切换回去
+
+	onDemand bool          // 第一个转发时才连接, 见 tunnel_ondemand.go
+	idle     time.Duration // 按需连接没有转发多久后断开
+}
+
+// 全部候选的 server, 第一个为配置中的 server
+func (s *sshServer) candidates() []*sshServer {
+	return append([]*sshServer{s}, s.failover...)
+}
+
+func (s *sshServer) String() string {
+	return s.user + "@" + s.hostAddr
+}
+
+// user@host:port, user@ws://..., 没有 user 时为当前用户, 没有端口时为 22
+func parseServerAddr(addr string) (string, string) {
+	u, host := "", addr
+	if i := strings.Index(addr, "ws://"); i >= 0 {
+		if i > 0 && addr[i-1] == 'w' {
+			i--
+		}
+		u, host = strings.TrimSuffix(addr[:i], "@"), addr[i:]
+	} else {
+		if i := strings.LastIndex(addr, "@"); i >= 0 {
+			u, host = addr[:i], addr[i+1:]
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "22")
+		}
+	}
+	if u == "" {
+		if cu, err := user.Current(); err == nil {
+			u = cu.Username
+		}
+	}
+	return u, host
+}
+
+func agentAuth() ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, errors.New("SSH_AUTH_SOCK not set")
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return agent.NewClient(conn).Signers()
+	})
+}
+
+func hostKeyCallback(policy string, files []string) (ssh.HostKeyCallback, error) {
+	switch {
+	case policy == "" || policy == "insecure":
+		return ssh.InsecureIgnoreHostKey(), nil
+	case policy == "known_hosts":
+		if len(files) == 0 {
+			files = []string{"~/.ssh/known_hosts"}
+		}
+		paths := make([]string, len(files))
+		for i, f := range files {
+			paths[i] = sshconfig.ExpandHome(f)
+		}
+		return knownhosts.New(paths...)
+	case strings.HasPrefix(policy, "SHA256:"):
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if fp := ssh.FingerprintSHA256(key); fp != policy {
+				return fmt.Errorf("host key mismatch for %s: %s", hostname, fp)
+			}
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown host_key %s, should be insecure, known_hosts or SHA256:...", policy)
+}
+
+/*
+根据配置创建 sshServer, name 为 servers 中的名称或者地址
+跳板也可以是 servers 中的名称, depth 用于防止循环引用
+*/
+func (conf *TunnelConf) newServer(name string, ts *TunnelServer, depth int) (*sshServer, error) {
+	if depth > 8 {
+		return nil, errors.New("jump hosts nested too deep")
+	}
+	if ts.Addr == "" {
+		return nil, errors.New("no server address")
+	}
+	srv := &sshServer{name: name, proxy: ts.Proxy}
+	srv.user, srv.hostAddr = parseServerAddr(ts.Addr)
+
+	keyfile := ts.Keyfile
+	if keyfile == "" && ts.Password == "" && !ts.Agent {
+		keyfile = conf.Pass_OR_Keyfile
+	}
+	if strings.HasPrefix(keyfile, "~/") {
+		keyfile = sshconfig.ExpandHome(keyfile)
+	}
+	if keyfile != "" {
+		auth, err := authMethods(keyfile)
+		if err != nil {
+			return nil, fmt.Errorf("keyfile: %v", err)
+		}
+		srv.auth = append(srv.auth, auth...)
+	}
+	if ts.Password != "" {
+		pass, err := vault.Resolve(ts.Password)
+		if err != nil {
+			return nil, fmt.Errorf("password: %v", err)
+		}
+		srv.auth = append(srv.auth, ssh.Password(pass))
+	}
+	if ts.Agent {
+		srv.auth = append(srv.auth, agentAuth())
+	}
+	var err error
+	if srv.hostKeys, err = hostKeyCallback(ts.HostKey, ts.KnownHosts); err != nil {
+		return nil, err
+	}
+
+	srv.keepAlive = defaultKeepAlive
+	if ts.KeepAlive != nil {
+		srv.keepAlive = *ts.KeepAlive
+	} else if conf.KeepAlive != nil {
+		srv.keepAlive = *conf.KeepAlive
+	}
+	srv.retryMin, srv.retryMax = defaultRetryMin, defaultRetryMax
+	for _, r := range []int{conf.RetrySec, ts.RetrySec} {
+		if r > 0 {
+			srv.retryMin = time.Duration(r) * time.Second
+		}
+	}
+	for _, r := range []int{conf.RetryMaxSec, ts.RetryMaxSec} {
+		if r > 0 {
+			srv.retryMax = time.Duration(r) * time.Second
+		}
+	}
+	if srv.retryMax < srv.retryMin {
+		srv.retryMax = srv.retryMin
+	}
+
+	jump_sig := ""
+	if ts.Jump != "" {
+		jts, jname := conf.Servers[ts.Jump], ts.Jump
+		if jts == nil {
+			jts = &TunnelServer{Addr: ts.Jump}
+		}
+		if srv.jump, err = conf.newServer(jname, jts, depth+1); err != nil {
+			return nil, fmt.Errorf("jump %s: %v", ts.Jump, err)
+		}
+		jump_sig = srv.jump.sig
+	}
+	b, _ := json.Marshal(ts)
+	srv.sig = fmt.Sprintf("%s|%s|%v|%v|%v|%s|[%s]", name, conf.Pass_OR_Keyfile, srv.keepAlive,
+		srv.retryMin, srv.retryMax, b, jump_sig)
+	return srv, nil
+}
+
+/*
+连接 ssh 服务: 经过跳板, socks5 代理, 或者直接连接(也支持 ws:// 地址)
+返回的 closer 同时关闭跳板的连接
+*/
+func (s *sshServer) dial() (*ssh.Client, func(), error) {
+	config := &ssh.ClientConfig{
+		User:            s.user,
+		Auth:            s.auth,
+		HostKeyCallback: s.hostKeys,
+		Timeout:         5 * time.Second,
+	}
+	if s.jump != nil {
+		jc, jcloser, err := s.jump.dial()
+		if err != nil {
+			return nil, nil, fmt.Errorf("jump %v: %v", s.jump, err)
+		}
+		conn, err := jc.Dial("tcp", s.hostAddr)
+		if err != nil {
+			jcloser()
+			return nil, nil, err
+		}
+		c, chans, reqs, err := ssh.NewClientConn(conn, s.hostAddr, config)
+		if err != nil {
+			conn.Close()
+			jcloser()
+			return nil, nil, err
+		}
+		cl := ssh.NewClient(c, chans, reqs)
+		return cl, func() {
+			cl.Close()
+			jcloser()
+		}, nil
+	}
+	var cl *ssh.Client
+	var err error
+	if s.proxy != "" {
+		cl, err = proxiedSSHClient(s.proxy, s.hostAddr, config)
+	} else {
+		cl, err = ws.DialSSH(s.hostAddr, config)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return cl, func() { cl.Close() }, nil
+}
+
+// keepAliveMonitor periodically sends messages to invoke a response.
+// If the server does not respond after some period of time,
+// assume that the underlying net.Conn abruptly died.
+func (s *sshServer) keepAliveMonitor(ctx context.Context, client *ssh.Client) {
+	if s.keepAlive.Interval == 0 || s.keepAlive.CountMax == 0 {
+		return
+	}
+
+	// Detect when the SSH connection is closed.
+	wait := make(chan error, 1)
+	go func() {
+		wait <- client.Wait()
+	}()
+
+	// Repeatedly check if the remote server is still alive.
+	var aliveCount int32
+	ticker := time.NewTicker(time.Duration(s.keepAlive.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-wait:
+			if err != nil && err != io.EOF {
+				fmt.Printf("(%v) SSH error: %v\n", s, err)
+			}
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n := atomic.AddInt32(&aliveCount, 1); n > int32(s.keepAlive.CountMax) {
+				fmt.Printf("(%v) SSH keep-alive termination\n", s)
+				client.Close()
+				return
+			}
+		}
+
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			if err == nil {
+				atomic.StoreInt32(&aliveCount, 0)
+			}
+		}()
+	}
+}
+
+// 运行中的端口映射
+type portRun struct {
+	t      tunnel
+	cancel context.CancelFunc // 当前连接上的映射, 没有连接时为 nil
+	wg     *sync.WaitGroup
+}
+
+/*
+运行中的 ssh 服务连接, 端口映射可以在连接保持的情况下增加和删除
+有备用 server 时按优先级依次连接, 当前连接断开后重新从第一个开始
+配置了 failback 时, 连接在备用 server 上会定期检查优先的 server, 可以连接时断开当前连接切换回去
+*/
+type serverConn struct {
+	srv     *sshServer
+	mu      sync.Mutex
+	client  *ssh.Client // 当前的连接, 重连时为 nil
+	connCtx context.Context
+	ports   map[string]*portRun
+	order   []string
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	active    *sshServer // 当前或者最后连接的 server
+	since     time.Time
+	switches  int // 切换 server 的次数
+	lastErr   string
+	lastErrAt time.Time
+	failback  bool // 当前连接是为了切换回优先的 server 而断开的
+
+	// 按需连接, 见 tunnel_ondemand.go
+	ctx        context.Context
+	users      int                // 使用连接的转发数
+	idleSince  time.Time          // users 变为 0 的时间
+	dialing    chan struct{}      // 正在连接, 连接结束时关闭
+	disconnect context.CancelFunc // 结束 connCtx 并断开连接
+}
+
+func startServer(srv *sshServer, tunns []tunnel) *serverConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := &serverConn{srv: srv, ports: map[string]*portRun{}, cancel: cancel, ctx: ctx}
+	for _, t := range tunns {
+		sc.addPort(t)
+	}
+	sc.wg.Add(1)
+	if srv.onDemand {
+		go sc.runOnDemand(ctx)
+	} else {
+		go sc.run(ctx)
+	}
+	return sc
+}
+
+func (sc *serverConn) run(ctx context.Context) {
+	defer sc.wg.Done()
+	bo := &util.Backoff{Min: sc.srv.retryMin, Max: sc.srv.retryMax}
+	for {
+		cl, closer, active := sc.dialAny()
+		if cl != nil {
+			connected := time.Now()
+			// 连接断开或者停止时结束 connCtx, 全部端口映射随之关闭
+			connCtx, cancel := context.WithCancel(ctx)
+			go func() {
+				cl.Wait()
+				cancel()
+			}()
+			go active.keepAliveMonitor(connCtx, cl)
+			sc.mu.Lock()
+			if sc.active != nil && sc.active != active {
+				sc.switches++
+			}
+			if len(sc.srv.failover) > 0 && sc.active != active {
+				if active == sc.srv {
+					logger.Info("(%v) active server %v", sc.srv, active)
+				} else {
+					logger.Warn("(%v) failed over to %v", sc.srv, active)
+				}
+			}
+			sc.active, sc.since = active, connected
+			sc.client, sc.connCtx = cl, connCtx
+			for _, k := range sc.order {
+				sc.bind(sc.ports[k])
+			}
+			sc.mu.Unlock()
+			if active != sc.srv && sc.srv.failback > 0 {
+				go sc.watchFailback(connCtx, active, cl)
+			}
+
+			<-connCtx.Done()
+			cancel()
+			sc.mu.Lock()
+			sc.client, sc.connCtx = nil, nil
+			for _, p := range sc.ports {
+				if p.cancel != nil {
+					p.cancel()
+					p.cancel = nil
+				}
+			}
+			failback := sc.failback
+			sc.failback = false
+			sc.mu.Unlock()
+			closer()
+			// 连接保持了一段时间才断开, 不是连续的失败, 从最短的等待开始
+			if time.Since(connected) > time.Minute {
+				bo.Reset()
+			}
+			if failback && ctx.Err() == nil {
+				bo.Reset()
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		d := bo.Next()
+		fmt.Printf("(%v) retrying in %v...\n", sc.srv, d.Round(100*time.Millisecond))
+		if !util.Sleep(ctx, d) {
+			return
+		}
+	}
+}
+
+// 按优先级依次连接, 返回第一个成功的连接和 server, 全部失败时返回 nil
+func (sc *serverConn) dialAny() (*ssh.Client, func(), *sshServer) {
+	for _, c := range sc.srv.candidates() {
+		cl, closer, err := c.dial()
+		if err == nil {
+			return cl, closer, c
+		}
+		fmt.Printf("(%v) SSH dial error: %v\n", c, err)
+		sc.mu.Lock()
+		sc.lastErr, sc.lastErrAt = fmt.Sprintf("%v: %v", c, err), time.Now()
+		sc.mu.Unlock()
+	}
+	return nil, nil, nil
+}
+
+// 每隔 failback 检查比 active 优先的 server, 可以连接时断开 cl, 由 run 从第一个 server 重新连接
+func (sc *serverConn) watchFailback(ctx context.Context, active *sshServer, cl *ssh.Client) {
+	t := time.NewTicker(sc.srv.failback)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for _, c := range sc.srv.candidates() {
+			if c == active {
+				break
+			}
+			_, closer, err := c.dial()
+			if err != nil {
+				continue
+			}
+			closer()
+			logger.Info("(%v) %v is back, failing back from %v", sc.srv, c, active)
+			sc.mu.Lock()
+			sc.failback = true
+			sc.mu.Unlock()
+			cl.Close()
+			return
+		}
+	}
+}
+
+// 在当前连接上建立端口映射, 监听失败时单独重试, 不影响连接和其它端口, 调用时持有 sc.mu
+func (sc *serverConn) bind(p *portRun) {
+	cl := sc.client
+	ctx, cancel := context.WithCancel(sc.connCtx)
+	p.cancel = cancel
+	t := p.t
+	t.srv = sc.active // 日志中显示实际连接的 server
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		bo := &util.Backoff{Min: sc.srv.retryMin, Max: sc.srv.retryMax}
+		for {
+			p.wg.Add(1)
+			t.serve(ctx, p.wg, cl)
+			if ctx.Err() != nil {
+				return
+			}
+			// 远端监听随连接断开而关闭, 由 run 重新连接
+			if _, _, err := cl.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				return
+			}
+			d := bo.Next()
+			fmt.Printf("(%v) retrying in %v...\n", t, d.Round(100*time.Millisecond))
+			if !util.Sleep(ctx, d) {
+				return
+			}
+		}
+	}()
+}
+
+// 增加端口映射, 已经存在时返回 false
+func (sc *serverConn) addPort(t tunnel) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.ports[t.sig]; ok {
+		return false
+	}
+	p := &portRun{t: t, wg: &sync.WaitGroup{}}
+	sc.ports[t.sig] = p
+	sc.order = append(sc.order, t.sig)
+	if sc.srv.onDemand {
+		sc.bindOnDemand(p)
+	} else if sc.client != nil {
+		sc.bind(p)
+	}
+	return true
+}
+
+// 停止端口映射并等待监听关闭, 以便修改后的映射可以使用同一个端口
+func (sc *serverConn) removePort(sig string) {
+	sc.mu.Lock()
+	p, ok := sc.ports[sig]
+	if !ok {
+		sc.mu.Unlock()
+		return
+	}
+	if p.cancel != nil {
+		p.cancel()
+	}
+	delete(sc.ports, sig)
+	for i, k := range sc.order {
+		if k == sig {
+			sc.order = append(sc.order[:i], sc.order[i+1:]...)
+			break
+		}
+	}
+	sc.mu.Unlock()
+	if !waitTimeout(p.wg, 10*time.Second) {
+		logger.Warn("(%v) stop timeout", p.t)
+	}
+}
+
+func (sc *serverConn) stop() {
+	sc.cancel()
+	ok := waitTimeout(&sc.wg, 10*time.Second)
+	sc.mu.Lock()
+	ports := sc.ports
+	sc.mu.Unlock()
+	for _, p := range ports {
+		ok = waitTimeout(p.wg, 10*time.Second) && ok
+	}
+	if !ok {
+		logger.Warn("(%v) stop timeout", sc.srv)
+	}
+}
+
+// fkme tunnel -status-addr 中一个连接的状态
+type serverStatus struct {
+	Server      string    `json:"server"`
+	Failover    []string  `json:"failover,omitempty"`
+	Active      string    `json:"active"` // 当前或者最后连接的 server
+	Connected   bool      `json:"connected"`
+	OnDemand    bool      `json:"on_demand"`
+	Users       int       `json:"users"` // 按需连接时使用连接的转发数
+	Since       time.Time `json:"since"`
+	Switches    int       `json:"switches"`
+	Tunnels     []string  `json:"tunnels"`
+	LastError   string    `json:"last_error"`
+	LastErrorAt time.Time `json:"last_error_at"`
+}
+
+func (sc *serverConn) status() serverStatus {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st := serverStatus{Server: sc.srv.String(), Connected: sc.client != nil, OnDemand: sc.srv.onDemand, Users: sc.users, Since: sc.since,
+		Switches: sc.switches, LastError: sc.lastErr, LastErrorAt: sc.lastErrAt, Tunnels: []string{}}
+	for _, f := range sc.srv.failover {
+		st.Failover = append(st.Failover, f.String())
+	}
+	if sc.active != nil {
+		st.Active = sc.active.String()
+	}
+	for _, k := range sc.order {
+		st.Tunnels = append(st.Tunnels, sc.ports[k].t.spec())
+	}
+	return st
+}
+
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
@@ -0,0 +1,19 @@
+package scp
+
+import "testing"
+
+func TestTunnelSpec(t *testing.T) {
+	cases := []struct {
+		t    tunnel
+		want string
+	}{
+		{tunnel{mode: '>', bindAddr: "localhost:7122", dialAddr: "localhost:2022"}, "localhost:7122 -> localhost:2022"},
+		{tunnel{mode: '<', bindAddr: "0.0.0.0:8080", dialAddr: "localhost:80"}, "0.0.0.0:8080 <- localhost:80"},
+		{tunnel{mode: 'D', bindAddr: "localhost:1080"}, "localhost:1080 <=> socks"},
+	}
+	for _, c := range cases {
+		if got := c.t.spec(); got != c.want {
+			t.Errorf("spec() = %q, want %q", got, c.want)
+		}
+	}
+}
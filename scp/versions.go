@@ -0,0 +1,344 @@
+package scp
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lulugyf/fkme/logger"
+	"github.com/pkg/sftp"
+)
+
+/*
+远端文件在覆盖或删除之前, 先移动到 <root>/.fkme-versions/<path>/<timestamp>
+
+-versions               开启
+-keep-versions 10       每个文件最多保留的版本数, 0 为不限
+-keep-age 30d           版本最长保留时间, 为空则不限
+
+-- 上传时保留旧版本
+fkme scp -f ~ -versions -keep-versions 5 -keep-age 7d fkme ud7:gosrc/fkme
+-- 列出 main.go 的所有版本
+fkme scp -f ~ -restore main.go ud7:gosrc/fkme
+-- 恢复 main.go 到指定版本, 时间可以只写前缀, latest 为最新的版本
+fkme scp -f ~ -restore main.go@20221020-1530 ud7:gosrc/fkme
+*/
+const (
+	VersionsDir   = ".fkme-versions" // 版本目录, 同步和删除时跳过
+	versionFormat = "20060102-150405"
+)
+
+type Versioner struct {
+	Root    string        // 同步的远端根目录
+	Keep    int           // 每个文件保留的版本数, 0 为不限
+	KeepAge time.Duration // 版本保留时间, 0 为不限
+}
+
+func NewVersioner(root string, keep int, keep_age time.Duration) *Versioner {
+	return &Versioner{Root: path.Clean(root), Keep: keep, KeepAge: keep_age}
+}
+
+// 文件相对于 Root 的路径, 以及版本目录
+func (v *Versioner) dir(remote_file string) (string, string) {
+	remote_file = path.Clean(remote_file)
+	root := v.Root
+	if !strings.HasPrefix(remote_file, root+"/") {
+		root = path.Dir(remote_file)
+	}
+	rel := strings.TrimPrefix(remote_file, root+"/")
+	return rel, path.Join(root, VersionsDir, rel)
+}
+
+// 是否是版本目录中的文件
+func isVersionPath(p string) bool {
+	for _, s := range strings.Split(p, "/") {
+		if s == VersionsDir {
+			return true
+		}
+	}
+	return false
+}
+
+func rename(client *sftp.Client, oldname, newname string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldname, newname)
+	}
+	return client.Rename(oldname, newname)
+}
+
+/*
+将 remote_file 移动到版本目录, 文件不存在时什么都不做
+*/
+func (v *Versioner) Backup(client *sftp.Client, remote_file string) error {
+	if isVersionPath(remote_file) {
+		return nil
+	}
+	st, err := client.Stat(remote_file)
+	if err != nil || !st.Mode().IsRegular() {
+		return nil
+	}
+	rel, vdir := v.dir(remote_file)
+	if err := client.MkdirAll(vdir); err != nil {
+		return fmt.Errorf("create %s failed: %v", vdir, err)
+	}
+	name := time.Now().Format(versionFormat)
+	// 同一秒内多次覆盖, 序号取已有的最大值加 1, 保证按名称排序与时间顺序一致
+	seq := -1
+	if files, err := client.ReadDir(vdir); err == nil {
+		for _, f := range files {
+			if f.Name() == name {
+				seq = max_int(seq, 0)
+			} else if strings.HasPrefix(f.Name(), name+".") {
+				n, _ := strconv.Atoi(f.Name()[len(name)+1:])
+				seq = max_int(seq, n)
+			}
+		}
+	}
+	if seq >= 0 {
+		name = fmt.Sprintf("%s.%d", name, seq+1)
+	}
+	target := path.Join(vdir, name)
+	if err := rename(client, remote_file, target); err != nil {
+		return fmt.Errorf("backup %s failed: %v", remote_file, err)
+	}
+	logger.Info("version: %s -> %s", rel, target)
+	v.prune(client, vdir)
+	return nil
+}
+
+/*
+备份 remote_file 后重新创建, 新文件保留原来的权限(改名到版本目录后原文件不存在, Create 会用默认权限)
+v 为 nil 时只是 Create
+*/
+func (v *Versioner) Create(client *sftp.Client, remote_file string) (*sftp.File, error) {
+	if v == nil {
+		return client.Create(remote_file)
+	}
+	st, err := client.Stat(remote_file)
+	if err := v.Backup(client, remote_file); err != nil {
+		return nil, err
+	}
+	f, err2 := client.Create(remote_file)
+	if err2 != nil {
+		return nil, err2
+	}
+	if err == nil && st.Mode().IsRegular() {
+		if err := f.Chmod(st.Mode().Perm()); err != nil {
+			logger.Warn("chmod %s failed: %v", remote_file, err)
+		}
+	}
+	return f, nil
+}
+
+// 备份目录下的所有文件, 用于删除目录之前
+func (v *Versioner) BackupAll(client *sftp.Client, remote_path string) error {
+	st, err := client.Stat(remote_path)
+	if err != nil {
+		return nil
+	}
+	if !st.IsDir() {
+		return v.Backup(client, remote_path)
+	}
+	walker := client.Walk(remote_path)
+	for walker.Step() {
+		if walker.Err() != nil {
+			continue
+		}
+		if walker.Stat().IsDir() {
+			if path.Base(walker.Path()) == VersionsDir {
+				walker.SkipDir()
+			}
+			continue
+		}
+		if err := v.Backup(client, walker.Path()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func max_int(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// 按时间和序号排序, 20221020-153000.10 在 20221020-153000.9 之后
+func sortVersions(names []string) {
+	key := func(name string) (string, int) {
+		s := strings.SplitN(name, ".", 2)
+		if len(s) == 1 {
+			return s[0], 0
+		}
+		n, _ := strconv.Atoi(s[1])
+		return s[0], n
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ti, ni := key(names[i])
+		tj, nj := key(names[j])
+		if ti != tj {
+			return ti < tj
+		}
+		return ni < nj
+	})
+}
+
+// 版本列表, 按时间从旧到新
+func (v *Versioner) Versions(client *sftp.Client, remote_file string) ([]string, error) {
+	_, vdir := v.dir(remote_file)
+	files, err := client.ReadDir(vdir)
+	if err != nil {
+		return nil, fmt.Errorf("no versions of %s", remote_file)
+	}
+	names := []string{}
+	for _, f := range files {
+		if !f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	sortVersions(names)
+	return names, nil
+}
+
+// 按数量和时间清理旧版本
+func (v *Versioner) prune(client *sftp.Client, vdir string) {
+	if v.Keep <= 0 && v.KeepAge <= 0 {
+		return
+	}
+	files, err := client.ReadDir(vdir)
+	if err != nil {
+		return
+	}
+	names := []string{}
+	for _, f := range files {
+		if !f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	sortVersions(names)
+	for i, name := range names {
+		remove := v.Keep > 0 && i < len(names)-v.Keep
+		if !remove && v.KeepAge > 0 && i < len(names)-1 { // 最新的版本总是保留
+			t, err := time.ParseInLocation(versionFormat, strings.SplitN(name, ".", 2)[0], time.Local)
+			remove = err == nil && time.Since(t) > v.KeepAge
+		}
+		if remove {
+			logger.Info("version: remove %s", path.Join(vdir, name))
+			client.Remove(path.Join(vdir, name))
+		}
+	}
+}
+
+/*
+将 remote_file 恢复为时间 ts 的版本, ts 可以是前缀, 为 latest 时恢复最新的版本
+当前的文件也会先备份
+*/
+func (v *Versioner) Restore(client *sftp.Client, remote_file, ts string) (string, error) {
+	names, err := v.Versions(client, remote_file)
+	if err != nil {
+		return "", err
+	}
+	found := ""
+	for _, name := range names {
+		if ts == "latest" || strings.HasPrefix(name, ts) {
+			found = name // 匹配多个时取最新的
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("version %s of %s not found", ts, remote_file)
+	}
+	_, vdir := v.dir(remote_file)
+	src, err := client.Open(path.Join(vdir, found))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := v.Create(client, remote_file)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return "", err
+	}
+	return found, nil
+}
+
+type version_args struct {
+	enable   *bool
+	keep     *int
+	keep_age *string
+}
+
+func (a *version_args) define(cmd *flag.FlagSet) {
+	a.enable = cmd.Bool("versions", false, "keep old versions of remote files in "+VersionsDir+" before overwrite or delete")
+	a.keep = cmd.Int("keep-versions", 10, "versions to keep per file, 0 for unlimited")
+	a.keep_age = cmd.String("keep-age", "", "max age of versions, e.g. 30d")
+}
+
+// 未开启时返回 nil
+func (a *version_args) versioner(root string) (*Versioner, error) {
+	if !*a.enable {
+		return nil, nil
+	}
+	age, err := ParseAge(*a.keep_age)
+	if err != nil {
+		return nil, err
+	}
+	return NewVersioner(root, *a.keep, age), nil
+}
+
+// fkme scp -restore path[@time] host:root
+func RunRestore(args []string) {
+	a := &cmd_args{}
+	cmd := flag.NewFlagSet("scp", flag.ExitOnError)
+	a.define(cmd)
+	restore := cmd.String("restore", "", "path[@time], restore a remote file, list versions if no time given")
+	cmd.Parse(args)
+	if cmd.NArg() != 1 || *restore == "" {
+		fmt.Println("fkme scp [-f ~] [-i keyfile] [-p port] -restore path[@time] <host:dir | {user}[/{pass}]@{host}:{dir}>")
+		os.Exit(2)
+	}
+	c := &Cli{}
+	root, err := a.connectHost(c, cmd.Arg(0))
+	if err != nil {
+		logger.Error("connect to %s failed: %v", cmd.Arg(0), err)
+		os.Exit(2)
+	}
+	defer c.Close()
+	if root == "" {
+		root = "."
+	}
+	fpath, ts := *restore, ""
+	if i := strings.LastIndex(fpath, "@"); i >= 0 {
+		fpath, ts = fpath[:i], fpath[i+1:]
+	}
+	if !strings.HasPrefix(fpath, "/") {
+		fpath = path.Join(root, fpath)
+	}
+	v := NewVersioner(root, 0, 0)
+	if ts == "" {
+		names, err := v.Versions(c.Sftp, fpath)
+		if err != nil {
+			logger.Error("%v", err)
+			os.Exit(3)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
+	}
+	found, err := v.Restore(c.Sftp, fpath, ts)
+	if err != nil {
+		logger.Error("restore failed: %v", err)
+		os.Exit(3)
+	}
+	logger.Info("%s restored to version %s", fpath, found)
+}
@@ -40,6 +40,7 @@ const (
 	itemUser
 	itemPort
 	itemProxyCommand
+	itemProxyJump
 	itemHostKeyAlgorithms
 	itemIdentityFile
 	itemLocalForward
@@ -55,6 +56,7 @@ var variables = map[string]itemType{
 	"user":              itemUser,
 	"port":              itemPort,
 	"proxycommand":      itemProxyCommand,
+	"proxyjump":         itemProxyJump,
 	"hostkeyalgorithms": itemHostKeyAlgorithms,
 	"identityfile":      itemIdentityFile,
 	"localforward":      itemLocalForward,
@@ -0,0 +1,214 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/lulugyf/fkme/logger"
+	"github.com/lulugyf/fkme/util"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+端口转发
+  direct-tcpip:  ssh -L, 以及 ws 客户端的 "7022;>;22"
+  tcpip-forward: ssh -R, 以及 ws 客户端的 "8000;<;21080", 在服务端监听端口, 连接通过 forwarded-tcpip 通道发回客户端
+                 默认只监听 127.0.0.1, GatewayPorts 时按客户端请求的地址, 空或 * 为所有地址
+  direct-udp@fkme: fkme tunnel "udp:127.0.0.1:5353 -> udp:10.0.0.2:53", 以及 ws 客户端的 "udp:5353;>;udp:53"
+                   通道中是加上长度帧头的数据报, 见 util/udp.go
+*/
+
+// 扩展的通道类型, 不是 openssh 支持的
+const UDPChannelType = "direct-udp@fkme"
+
+// RFC 4254 7.2
+type directPayload struct {
+	DestAddr string
+	DestPort uint32
+	OrigAddr string
+	OrigPort uint32
+}
+
+// RFC 4254 7.1
+type forwardPayload struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type forwardedPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+func pipe(a, b io.ReadWriteCloser) {
+	once := sync.Once{}
+	close := func() {
+		a.Close()
+		b.Close()
+	}
+	go func() {
+		io.Copy(a, b)
+		once.Do(close)
+	}()
+	io.Copy(b, a)
+	once.Do(close)
+}
+
+func directTCPIP(newChannel ssh.NewChannel) {
+	d := &directPayload{}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), d); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+	addr := net.JoinHostPort(d.DestAddr, strconv.Itoa(int(d.DestPort)))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		logger.Warn("direct-tcpip to %s failed: %v", addr, err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	logger.Info("direct-tcpip %s:%d -> %s", d.OrigAddr, d.OrigPort, addr)
+	pipe(channel, conn)
+}
+
+func directUDP(newChannel ssh.NewChannel) {
+	d := &directPayload{}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), d); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+	addr := net.JoinHostPort(d.DestAddr, strconv.Itoa(int(d.DestPort)))
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	logger.Info("direct-udp %s:%d -> %s", d.OrigAddr, d.OrigPort, addr)
+	if err := util.RelayUDP(channel, addr, util.DefaultUDPIdle); err != nil {
+		logger.Warn("direct-udp to %s failed: %v", addr, err)
+	}
+}
+
+// 一个 ssh 连接上的远程转发监听, 连接断开时全部关闭
+type forwards struct {
+	conn      *ssh.ServerConn
+	gateway   bool // 见 Config.GatewayPorts
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+func newForwards(conn *ssh.ServerConn, gateway bool) *forwards {
+	return &forwards{conn: conn, gateway: gateway, listeners: map[string]net.Listener{}}
+}
+
+// 实际监听的地址, 同 openssh: GatewayPorts no 时总是 127.0.0.1, clientspecified 时空或 * 为所有地址
+func (fw *forwards) bindAddr(addr string) string {
+	switch {
+	case !fw.gateway || addr == "localhost":
+		return "127.0.0.1"
+	case addr == "*":
+		return ""
+	}
+	return addr
+}
+
+func (fw *forwards) handleRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			f := &forwardPayload{}
+			if err := ssh.Unmarshal(req.Payload, f); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			port, err := fw.listen(f)
+			if err != nil {
+				logger.Warn("tcpip-forward %s:%d failed: %v", f.BindAddr, f.BindPort, err)
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, ssh.Marshal(&struct{ Port uint32 }{port}))
+		case "cancel-tcpip-forward":
+			f := &forwardPayload{}
+			if err := ssh.Unmarshal(req.Payload, f); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(fw.cancel(f), nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (fw *forwards) listen(f *forwardPayload) (uint32, error) {
+	bind := fw.bindAddr(f.BindAddr)
+	l, err := net.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(int(f.BindPort))))
+	if err != nil {
+		return 0, err
+	}
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	fw.mu.Lock()
+	fw.listeners[fmt.Sprintf("%s:%d", f.BindAddr, port)] = l
+	fw.mu.Unlock()
+	logger.Info("tcpip-forward listen on %s for %s", l.Addr(), fw.conn.RemoteAddr())
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fw.forward(c, f.BindAddr, port)
+		}
+	}()
+	return port, nil
+}
+
+func (fw *forwards) forward(c net.Conn, bind string, port uint32) {
+	orig := c.RemoteAddr().(*net.TCPAddr)
+	payload := ssh.Marshal(&forwardedPayload{Addr: bind, Port: port,
+		OriginAddr: orig.IP.String(), OriginPort: uint32(orig.Port)})
+	channel, requests, err := fw.conn.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		logger.Warn("open forwarded-tcpip failed: %v", err)
+		c.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	pipe(channel, c)
+}
+
+func (fw *forwards) cancel(f *forwardPayload) bool {
+	key := fmt.Sprintf("%s:%d", f.BindAddr, f.BindPort)
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	l, ok := fw.listeners[key]
+	if ok {
+		l.Close()
+		delete(fw.listeners, key)
+	}
+	return ok
+}
+
+func (fw *forwards) closeAll() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	for k, l := range fw.listeners {
+		l.Close()
+		delete(fw.listeners, k)
+	}
+}
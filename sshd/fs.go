@@ -0,0 +1,312 @@
+package sshd
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lulugyf/fkme/util"
+	"github.com/pkg/sftp"
+)
+
+/*
+sftp 请求处理, 所有路径都限制在 root 目录下(类似 chroot)
+客户端看到的 / 就是 root
+*/
+type rootFS struct {
+	root     string // 绝对路径, 已解析符号链接
+	readOnly bool
+}
+
+func newRootFS(root string, readOnly bool) (*rootFS, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	abs, err = filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+	return &rootFS{root: abs, readOnly: readOnly}, nil
+}
+
+func (fs *rootFS) handlers() sftp.Handlers {
+	return sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+}
+
+func (fs *rootFS) inside(p string) bool {
+	prefix := fs.root
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) { // root 为 / 时不能再加分隔符
+		prefix += string(filepath.Separator)
+	}
+	return p == fs.root || strings.HasPrefix(p, prefix)
+}
+
+/*
+客户端路径转换为本地路径
+已存在的路径(或其上级目录)通过符号链接指向 root 之外时, 返回 os.ErrPermission
+*/
+func (fs *rootFS) real(p string) (string, error) {
+	local := filepath.Join(fs.root, filepath.FromSlash(path.Clean("/"+p)))
+	check := local
+	for {
+		resolved, err := filepath.EvalSymlinks(check)
+		if err == nil {
+			if !fs.inside(resolved) {
+				return "", os.ErrPermission
+			}
+			return local, nil
+		}
+		if !os.IsNotExist(err) || check == fs.root {
+			return local, nil
+		}
+		check = filepath.Dir(check) // 不存在的文件, 检查上级目录
+	}
+}
+
+// 与 real 相同, 但不跟随最后一级的符号链接, 用于 Lstat / Remove / Rename 等
+func (fs *rootFS) realNoFollow(p string) (string, error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return fs.root, nil
+	}
+	dir, err := fs.real(path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path.Base(p)), nil
+}
+
+// 只读模式下, 修改操作返回 os.ErrPermission
+func (fs *rootFS) writable() error {
+	if fs.readOnly {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (fs *rootFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	p, err := fs.real(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func openFlags(r *sftp.Request) int {
+	pf := r.Pflags()
+	flag := os.O_WRONLY
+	if pf.Read {
+		flag = os.O_RDWR
+	}
+	if pf.Creat {
+		flag |= os.O_CREATE
+	}
+	if pf.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pf.Excl {
+		flag |= os.O_EXCL
+	}
+	return flag
+}
+
+func (fs *rootFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.OpenFile(r)
+}
+
+func (fs *rootFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	if err := fs.writable(); err != nil {
+		return nil, err
+	}
+	p, err := fs.real(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, openFlags(r), 0644)
+}
+
+func (fs *rootFS) Filecmd(r *sftp.Request) error {
+	if err := fs.writable(); err != nil {
+		return err
+	}
+	p, err := fs.realNoFollow(r.Filepath)
+	if err != nil {
+		return err
+	}
+	switch r.Method {
+	case "Setstat":
+		if p, err = fs.real(r.Filepath); err != nil {
+			return err
+		}
+		attrs := r.Attributes()
+		flags := r.AttrFlags()
+		if flags.Permissions {
+			if err := os.Chmod(p, attrs.FileMode()); err != nil {
+				return err
+			}
+		}
+		if flags.Size {
+			if err := os.Truncate(p, int64(attrs.Size)); err != nil {
+				return err
+			}
+		}
+		if flags.Acmodtime {
+			return os.Chtimes(p, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0))
+		}
+		return nil
+	case "Rename":
+		target, err := fs.realNoFollow(r.Target)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(target); err == nil {
+			return os.ErrExist
+		}
+		return os.Rename(p, target)
+	case "PosixRename":
+		return fs.PosixRename(r)
+	case "Rmdir", "Remove":
+		return os.Remove(p)
+	case "Mkdir":
+		return os.Mkdir(p, 0755)
+	case "Link":
+		target, err := fs.realNoFollow(r.Target)
+		if err != nil {
+			return err
+		}
+		return os.Link(p, target)
+	case "Symlink":
+		// r.Filepath 为链接指向的目标, r.Target 为链接文件
+		if p, err = fs.real(r.Filepath); err != nil {
+			return err
+		}
+		link, err := fs.realNoFollow(r.Target)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(p, link)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *rootFS) PosixRename(r *sftp.Request) error {
+	if err := fs.writable(); err != nil {
+		return err
+	}
+	p, err := fs.realNoFollow(r.Filepath)
+	if err != nil {
+		return err
+	}
+	target, err := fs.realNoFollow(r.Target)
+	if err != nil {
+		return err
+	}
+	return os.Rename(p, target)
+}
+
+func (fs *rootFS) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	p, err := fs.real(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	disk := util.DiskUsage(p)
+	if disk == nil {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	return &sftp.StatVFS{Bsize: 1, Frsize: 1, Blocks: disk.All, Bfree: disk.Free,
+		Bavail: disk.Free, Namemax: 255}, nil
+}
+
+type listerat []os.FileInfo
+
+func (f listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(f)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, f[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Readlink 返回的文件名为链接目标
+type linkInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (l linkInfo) Name() string { return l.name }
+
+func (fs *rootFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	if r.Method == "Readlink" {
+		return fs.readlink(r)
+	}
+	p, err := fs.real(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "List":
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		files, err := f.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return listerat(files), nil
+	case "Stat":
+		st, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerat{st}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// 链接目标在 root 之内时转换为客户端路径
+func (fs *rootFS) readlink(r *sftp.Request) (sftp.ListerAt, error) {
+	p, err := fs.realNoFollow(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	target, err := os.Readlink(p)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.IsAbs(target) {
+		if !fs.inside(target) {
+			return nil, os.ErrPermission
+		}
+		rel, err := filepath.Rel(fs.root, target)
+		if err != nil {
+			return nil, os.ErrPermission
+		}
+		target = path.Join("/", filepath.ToSlash(rel))
+	}
+	st, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	return listerat{linkInfo{st, filepath.ToSlash(target)}}, nil
+}
+
+func (fs *rootFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	p, err := fs.realNoFollow(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	st, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	return listerat{st}, nil
+}
@@ -0,0 +1,61 @@
+package sshd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestRootFSInside(t *testing.T) {
+	cases := []struct {
+		root, p string
+		want    bool
+	}{
+		{"/", "/", true},
+		{"/", "/etc/hostname", true},
+		{"/data/proj", "/data/proj", true},
+		{"/data/proj", "/data/proj/a", true},
+		{"/data/proj", "/data/proj2", false},
+		{"/data/proj", "/data", false},
+		{"/data/proj", "/etc/passwd", false},
+	}
+	for _, c := range cases {
+		fs := &rootFS{root: filepath.FromSlash(c.root)}
+		if got := fs.inside(filepath.FromSlash(c.p)); got != c.want {
+			t.Errorf("root %s: inside(%q) = %v, want %v", c.root, c.p, got, c.want)
+		}
+	}
+}
+
+func TestRootFSSlash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir) // macOS 的 /tmp 是链接
+	file := filepath.Join(dir, "a.txt")
+	ioutil.WriteFile(file, []byte("a"), 0644)
+	link := filepath.Join(dir, "link")
+	os.Symlink(file, link)
+
+	fs, err := newRootFS("/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := fs.real(filepath.ToSlash(file))
+	if err != nil || p != file {
+		t.Errorf("real(%q) = %q, %v", file, p, err)
+	}
+	ls, err := fs.readlink(sftp.NewRequest("Readlink", filepath.ToSlash(link)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := make([]os.FileInfo, 1)
+	if n, _ := ls.ListAt(infos, 0); n != 1 || infos[0].Name() != filepath.ToSlash(file) {
+		t.Errorf("readlink(%q) = %v, want %q", link, infos[0], file)
+	}
+}
@@ -0,0 +1,183 @@
+package sshd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/lulugyf/fkme/logger"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+session 通道: sftp 子系统, 以及 Config.Shell 开启时的 pty / shell / exec
+*/
+type session struct {
+	s       *Server
+	user    string
+	channel ssh.Channel
+	env     []string
+	pty     *ptyReq
+	resize  func(w, h uint32) // pty 启动后设置
+	mu      sync.Mutex
+}
+
+type ptyReq struct {
+	Term   string
+	Width  uint32
+	Height uint32
+	PixW   uint32
+	PixH   uint32
+	Modes  string
+}
+
+type windowChange struct {
+	Width  uint32
+	Height uint32
+	PixW   uint32
+	PixH   uint32
+}
+
+type execReq struct {
+	Command string
+}
+
+type envReq struct {
+	Name  string
+	Value string
+}
+
+func (s *Server) handleSession(user string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	sess := &session{s: s, user: user, channel: channel}
+	started := false
+	for req := range requests {
+		ok := false
+		switch req.Type {
+		case "subsystem":
+			if !started && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp" {
+				ok, started = true, true
+				req.Reply(true, nil)
+				go sess.serveSftp()
+				continue
+			}
+		case "pty-req":
+			p := &ptyReq{}
+			if s.conf.Shell && ssh.Unmarshal(req.Payload, p) == nil {
+				sess.pty, ok = p, true
+			}
+		case "window-change":
+			w := &windowChange{}
+			if ssh.Unmarshal(req.Payload, w) == nil {
+				sess.mu.Lock()
+				if sess.resize != nil {
+					sess.resize(w.Width, w.Height)
+				} else if sess.pty != nil {
+					sess.pty.Width, sess.pty.Height = w.Width, w.Height
+				}
+				sess.mu.Unlock()
+				ok = true
+			}
+		case "env":
+			e := &envReq{}
+			if ssh.Unmarshal(req.Payload, e) == nil {
+				sess.env = append(sess.env, fmt.Sprintf("%s=%s", e.Name, e.Value))
+				ok = true
+			}
+		case "shell", "exec":
+			if !s.conf.Shell || started {
+				break
+			}
+			command := ""
+			if req.Type == "exec" {
+				e := &execReq{}
+				if ssh.Unmarshal(req.Payload, e) != nil {
+					break
+				}
+				command = e.Command
+			}
+			ok, started = true, true
+			req.Reply(true, nil)
+			go sess.run(command)
+			continue
+		}
+		if !ok {
+			logger.Warn("%s: request %s rejected", user, req.Type)
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+func (sess *session) serveSftp() {
+	defer sess.channel.Close()
+	server := sftp.NewRequestServer(sess.channel, sess.s.fs.handlers())
+	if err := server.Serve(); err != nil && err != io.EOF {
+		logger.Warn("sftp server: %v", err)
+	}
+	server.Close()
+}
+
+// 命令结束后发送退出码并关闭通道
+func (sess *session) exit(code int) {
+	status := make([]byte, 4)
+	binary.BigEndian.PutUint32(status, uint32(code))
+	sess.channel.SendRequest("exit-status", false, status)
+	sess.channel.Close()
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		return e.ExitCode()
+	}
+	return 255
+}
+
+// command 为空时启动交互式 shell
+func (sess *session) run(command string) {
+	cmd := shellCommand(command)
+	cmd.Dir = sess.s.fs.root
+	cmd.Env = append(os.Environ(), sess.env...)
+	logger.Info("%s: run [%s] pty: %v", sess.user, command, sess.pty != nil)
+
+	if sess.pty != nil {
+		cmd.Env = append(cmd.Env, "TERM="+sess.pty.Term)
+		sess.mu.Lock()
+		resize, wait, err := startPty(cmd, sess.channel, sess.pty.Width, sess.pty.Height)
+		if err == nil {
+			sess.resize = resize
+		}
+		sess.mu.Unlock()
+		if err == nil {
+			sess.exit(exitCode(wait()))
+			return
+		}
+		logger.Warn("start pty failed, fallback to pipes: %v", err)
+	}
+
+	cmd.Stdout = sess.channel
+	cmd.Stderr = sess.channel.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Fprintf(sess.channel.Stderr(), "%v\n", err)
+		sess.exit(255)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(sess.channel.Stderr(), "%v\n", err)
+		sess.exit(127)
+		return
+	}
+	go func() {
+		io.Copy(stdin, sess.channel)
+		stdin.Close()
+	}()
+	sess.exit(exitCode(cmd.Wait()))
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+// +build !windows
+
+package sshd
+
+import (
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+	"golang.org/x/crypto/ssh"
+)
+
+func shellCommand(command string) *exec.Cmd {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	if command == "" {
+		return exec.Command(shell, "-l")
+	}
+	return exec.Command(shell, "-c", command)
+}
+
+/*
+在 pty 中启动命令, 返回调整窗口大小和等待结束的函数
+*/
+func startPty(cmd *exec.Cmd, ch ssh.Channel, w, h uint32) (func(w, h uint32), func() error, error) {
+	f, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: uint16(w), Rows: uint16(h)})
+	if err != nil {
+		return nil, nil, err
+	}
+	resize := func(w, h uint32) {
+		pty.Setsize(f, &pty.Winsize{Cols: uint16(w), Rows: uint16(h)})
+	}
+	go io.Copy(f, ch)
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ch, f)
+		close(done)
+	}()
+	wait := func() error {
+		err := cmd.Wait()
+		<-done // 输出全部发送后再退出
+		f.Close()
+		return err
+	}
+	return resize, wait, nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package sshd
+
+import (
+	"errors"
+	"os/exec"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func shellCommand(command string) *exec.Cmd {
+	if command == "" {
+		return exec.Command("cmd.exe")
+	}
+	return exec.Command("cmd.exe", "/C", command)
+}
+
+// windows 下不支持 pty, 使用管道
+func startPty(cmd *exec.Cmd, ch ssh.Channel, w, h uint32) (func(w, h uint32), func() error, error) {
+	return nil, nil, errors.New("pty not supported on windows")
+}
@@ -0,0 +1,290 @@
+package sshd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lulugyf/fkme/logger"
+	"github.com/lulugyf/fkme/sshconfig"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+内置的 ssh 服务, 用于没有 openssh 的容器
+fkme sftpd 只提供 sftp 子系统, fkme scp / fkme sftp 可以直接连接
+fkme sshd 另外提供 shell / exec / pty 和端口转发(-L -R)
+
+fkme sftpd -p 2022 -root /data -auth ~/.ssh/authorized_keys
+fkme sftpd -p 2022 -root /data -user _base_ -pw secret -ro
+fkme sshd -p 2022 -auth ~/.ssh/authorized_keys
+fkme sshd -p 2022 -user _base_ -pw secret -shell=false   # 只做端口转发和 sftp
+fkme sshd -p 2022 -gateway-ports                         # ssh -R 0.0.0.0:8080:... 可以监听所有地址
+
+也可以不监听 tcp 端口, 直接在 websocket 上提供服务(见 ws.Run):
+  fkme ws -p 8899 -prefix /yt -addr sshd -auth ~/.ssh/authorized_keys
+  fkme ws -addr wss://host/yt/ws -port "7022;>;22" -port "8000;<;21080"
+
+在 cron 的配置中启动(代替单独的 sshserv):
+  {"name":"sftpd", "cwd":"/data", "args":["/app/fkme", "sftpd", "-p", "2022", "-root", "/data", "-auth", "/data/.ssh/authorized_keys"]}
+*/
+type Config struct {
+	Addr           string
+	HostKey        string // 主机私钥文件, 不存在时生成 ed25519 密钥并保存
+	AuthorizedKeys string // 公钥认证
+	User           string // 不为空时只允许此用户登录
+	Password       string // 不为空时允许密码认证
+	Root           string // sftp 的根目录, 也是 shell 的工作目录
+	ReadOnly       bool
+	Shell          bool // 允许 shell / exec / pty
+	Forward        bool // 允许 direct-tcpip 和 tcpip-forward 端口转发
+	GatewayPorts   bool // tcpip-forward 按客户端请求的地址监听, 否则总是监听 127.0.0.1, 同 openssh 的 GatewayPorts
+}
+
+type Server struct {
+	conf    *Config
+	sshConf *ssh.ServerConfig
+	fs      *rootFS
+}
+
+/*
+读取主机私钥, 文件不存在时生成新的 ed25519 密钥并保存, 以便重启后客户端的 known_hosts 不变
+*/
+func loadHostKey(fpath string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(fpath)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	os.MkdirAll(filepath.Dir(fpath), 0700)
+	if err := ioutil.WriteFile(fpath, data, 0600); err != nil {
+		return nil, err
+	}
+	logger.Info("host key generated: %s", fpath)
+	return ssh.ParsePrivateKey(data)
+}
+
+func loadAuthorizedKeys(fpath string) ([]ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	keys := []ssh.PublicKey{}
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys, nil
+}
+
+func NewServer(conf *Config) (*Server, error) {
+	fs, err := newRootFS(conf.Root, conf.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{conf: conf, fs: fs, sshConf: &ssh.ServerConfig{}}
+
+	checkUser := func(user string) bool {
+		return conf.User == "" || conf.User == user
+	}
+	if conf.AuthorizedKeys != "" {
+		keys, err := loadAuthorizedKeys(conf.AuthorizedKeys)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("%d authorized keys loaded from %s", len(keys), conf.AuthorizedKeys)
+		s.sshConf.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if checkUser(c.User()) {
+				for _, k := range keys {
+					if bytes.Equal(k.Marshal(), key.Marshal()) {
+						return &ssh.Permissions{}, nil
+					}
+				}
+			}
+			return nil, fmt.Errorf("unknown public key for %s", c.User())
+		}
+	}
+	if conf.Password != "" {
+		s.sshConf.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if checkUser(c.User()) && subtle.ConstantTimeCompare(pass, []byte(conf.Password)) == 1 {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", c.User())
+		}
+	}
+	if s.sshConf.PublicKeyCallback == nil && s.sshConf.PasswordCallback == nil {
+		return nil, errors.New("no authentication configured, need authorized_keys or password")
+	}
+
+	signer, err := loadHostKey(conf.HostKey)
+	if err != nil {
+		return nil, fmt.Errorf("load host key %s failed: %v", conf.HostKey, err)
+	}
+	s.sshConf.AddHostKey(signer)
+	return s, nil
+}
+
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.conf.Addr)
+	if err != nil {
+		return err
+	}
+	logger.Info("ssh server listen on %s, root: %s, shell: %v, forward: %v",
+		s.conf.Addr, s.fs.root, s.conf.Shell, s.conf.Forward)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// 处理一个连接, 连接可以来自 tcp 或者 websocket
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConf)
+	if err != nil {
+		logger.Warn("handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer sconn.Close()
+	user := sconn.User()
+	logger.Info("%s@%s logged in", user, sconn.RemoteAddr())
+	fw := newForwards(sconn, s.conf.GatewayPorts)
+	defer fw.closeAll()
+	if s.conf.Forward {
+		go fw.handleRequests(reqs)
+	} else {
+		go ssh.DiscardRequests(reqs)
+	}
+
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				logger.Error("accept channel failed: %v", err)
+				continue
+			}
+			go s.handleSession(user, channel, requests)
+		case "direct-tcpip":
+			if !s.conf.Forward {
+				newChannel.Reject(ssh.Prohibited, "port forwarding disabled")
+				continue
+			}
+			go directTCPIP(newChannel)
+		case UDPChannelType:
+			if !s.conf.Forward {
+				newChannel.Reject(ssh.Prohibited, "port forwarding disabled")
+				continue
+			}
+			go directUDP(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+	logger.Info("%s@%s disconnected", user, sconn.RemoteAddr())
+}
+
+func expandHome(p string) string {
+	if strings.HasPrefix(p, "~") {
+		return sshconfig.ExpandHome(p)
+	}
+	return p
+}
+
+func Run(args []string) {
+	run("sftpd", args)
+}
+
+func RunSSHD(args []string) {
+	run("sshd", args)
+}
+
+// sftpd 默认只提供 sftp, sshd 默认开启 shell 和端口转发, 根目录为 /
+func run(name string, args []string) {
+	full := name == "sshd"
+	default_root := "."
+	if full {
+		default_root = "/"
+	}
+	cmd := flag.NewFlagSet(name, flag.ExitOnError)
+	port := cmd.Int("p", 2022, "Port to bind")
+	host := cmd.String("b", "", "Host ip to bind, default all")
+	root := cmd.String("root", default_root, "sftp root directory, and shell working directory")
+	hostKey := cmd.String("hostkey", "~/.fkme/sftpd_host_ed25519_key", "host private key, generated if not exists")
+	auth := cmd.String("auth", "", "authorized_keys file")
+	user := cmd.String("user", "", "only allow this user, default any")
+	pass := cmd.String("pw", "", "password, env FKME_SFTPD_PASS is used if empty")
+	readOnly := cmd.Bool("ro", false, "sftp read only")
+	shell := cmd.Bool("shell", full, "allow shell, exec and pty")
+	forward := cmd.Bool("forward", full, "allow tcp port forwarding")
+	gateway := cmd.Bool("gateway-ports", false, "remote forwards (-R) bind the address the client asks for, default 127.0.0.1 only")
+	cmd.Parse(args)
+
+	conf := &Config{
+		Addr:           fmt.Sprintf("%s:%d", *host, *port),
+		HostKey:        expandHome(*hostKey),
+		AuthorizedKeys: expandHome(*auth),
+		User:           *user,
+		Password:       *pass,
+		Root:           expandHome(*root),
+		ReadOnly:       *readOnly,
+		Shell:          *shell,
+		Forward:        *forward,
+		GatewayPorts:   *gateway,
+	}
+	s, err := NewServer(DefaultAuth(conf))
+	if err != nil {
+		logger.Error("%s: %v", name, err)
+		os.Exit(2)
+	}
+	if err := s.ListenAndServe(); err != nil {
+		logger.Error("%s: %v", name, err)
+		os.Exit(3)
+	}
+}
+
+/*
+没有指定认证方式时, 使用环境变量 FKME_SFTPD_PASS 或者当前用户的 ~/.ssh/authorized_keys
+*/
+func DefaultAuth(conf *Config) *Config {
+	if conf.Password == "" {
+		conf.Password = os.Getenv("FKME_SFTPD_PASS")
+	}
+	if conf.AuthorizedKeys == "" && conf.Password == "" {
+		if p := expandHome("~/.ssh/authorized_keys"); p != "" {
+			if _, err := os.Stat(p); err == nil {
+				conf.AuthorizedKeys = p
+			}
+		}
+	}
+	return conf
+}
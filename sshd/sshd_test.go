@@ -0,0 +1,95 @@
+package sshd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lulugyf/fkme/logger"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshd 和 ws -addr sshd 的默认根目录是 /, sftp 应当可以读写任意路径
+func TestSFTPDefaultRoot(t *testing.T) {
+	logger.InitLogger("")
+	dir, err := ioutil.TempDir("", "sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	s, err := NewServer(&Config{HostKey: filepath.Join(dir, "host_key"), Password: "pw", Root: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			s.ServeConn(c)
+		}
+	}()
+	c2, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, chans, reqs, err := ssh.NewClientConn(c2, ln.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password("pw")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ssh.NewClient(conn, chans, reqs)
+	defer client.Close()
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	fpath := filepath.ToSlash(filepath.Join(dir, "a.txt"))
+	f, err := sc.Create(fpath)
+	if err != nil {
+		t.Fatalf("create %s: %v", fpath, err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+	if b, err := ioutil.ReadFile(filepath.FromSlash(fpath)); err != nil || string(b) != "hello" {
+		t.Errorf("read %s = %q, %v", fpath, b, err)
+	}
+	if _, err := sc.Stat(fpath); err != nil {
+		t.Errorf("stat %s: %v", fpath, err)
+	}
+}
+
+func TestForwardBindAddr(t *testing.T) {
+	cases := []struct {
+		gateway bool
+		addr    string
+		want    string
+	}{
+		{false, "", "127.0.0.1"},
+		{false, "0.0.0.0", "127.0.0.1"},
+		{false, "10.1.1.5", "127.0.0.1"},
+		{true, "localhost", "127.0.0.1"},
+		{true, "", ""},
+		{true, "*", ""},
+		{true, "0.0.0.0", "0.0.0.0"},
+		{true, "10.1.1.5", "10.1.1.5"},
+	}
+	for _, c := range cases {
+		fw := newForwards(nil, c.gateway)
+		if got := fw.bindAddr(c.addr); got != c.want {
+			t.Errorf("gateway=%v bindAddr(%q) = %q, want %q", c.gateway, c.addr, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package util
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/lulugyf/fkme/logger"
+)
+
+/*
+归档格式: tar, tar.gz(tgz), tar.zst(tzst), zip
+
+  ArchiveFormat     根据文件名判断格式
+  NewArchiveWriter  写入归档, 条目用 tar.Header 描述, zip 也一样
+  ReadArchive       逐个读取归档中的条目
+  Extract           解压到本地目录, 拒绝指向目录外的路径
+
+-- 解压, 格式由文件名判断, 标准输入时用 -format 指定(默认 tar)
+fkme untar -C ./exp exp.tar.zst
+ssh od 'tar cf - exp' | fkme untar -C ./exp -
+*/
+const (
+	FormatTar = "tar"
+	FormatTgz = "tar.gz"
+	FormatZst = "tar.zst"
+	FormatZip = "zip"
+)
+
+// 根据文件名判断格式, 未知时返回空串
+func ArchiveFormat(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return FormatTgz
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return FormatZst
+	case strings.HasSuffix(name, ".tar"):
+		return FormatTar
+	case strings.HasSuffix(name, ".zip"):
+		return FormatZip
+	}
+	return ""
+}
+
+// -format 参数, 也接受 tgz, gz, zst 等简写
+func ParseFormat(s string) (string, error) {
+	switch strings.TrimPrefix(strings.ToLower(s), ".") {
+	case "tar":
+		return FormatTar, nil
+	case "tar.gz", "tgz", "gz", "gzip":
+		return FormatTgz, nil
+	case "tar.zst", "tzst", "zst", "zstd":
+		return FormatZst, nil
+	case "zip":
+		return FormatZip, nil
+	}
+	return "", fmt.Errorf("unknown archive format: %s", s)
+}
+
+type ArchiveWriter interface {
+	// 目录的 Name 以 / 结尾, 符号链接的目标在 Linkname 中
+	WriteHeader(hdr *tar.Header) error
+	Write(p []byte) (int, error)
+	// 结束归档, 不关闭底层的 io.Writer
+	Close() error
+}
+
+type tarWriter struct {
+	*tar.Writer
+	compressor io.WriteCloser
+}
+
+func (w *tarWriter) Close() error {
+	err := w.Writer.Close()
+	if w.compressor != nil {
+		if err1 := w.compressor.Close(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+type zipWriter struct {
+	zw  *zip.Writer
+	cur io.Writer
+}
+
+func (w *zipWriter) WriteHeader(hdr *tar.Header) error {
+	fh := &zip.FileHeader{Name: hdr.Name, Method: zip.Deflate, Modified: hdr.ModTime}
+	fh.SetMode(hdr.FileInfo().Mode())
+	if hdr.Typeflag == tar.TypeDir {
+		fh.Method = zip.Store
+		if !strings.HasSuffix(fh.Name, "/") {
+			fh.Name += "/"
+		}
+	}
+	f, err := w.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	w.cur = f
+	if hdr.Typeflag == tar.TypeSymlink {
+		_, err = io.WriteString(f, hdr.Linkname)
+	}
+	return err
+}
+
+func (w *zipWriter) Write(p []byte) (int, error) {
+	if w.cur == nil {
+		return 0, errors.New("zip: write before header")
+	}
+	return w.cur.Write(p)
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
+
+func NewArchiveWriter(w io.Writer, format string) (ArchiveWriter, error) {
+	switch format {
+	case FormatTar:
+		return &tarWriter{Writer: tar.NewWriter(w)}, nil
+	case FormatTgz:
+		gz := gzip.NewWriter(w)
+		return &tarWriter{Writer: tar.NewWriter(gz), compressor: gz}, nil
+	case FormatZst:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &tarWriter{Writer: tar.NewWriter(zw), compressor: zw}, nil
+	case FormatZip:
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format: %s", format)
+}
+
+/*
+读取 tar 流中的条目写入 aw, 用于转换远端 tar 命令的输出
+*/
+func CopyTar(aw ArchiveWriter, r io.Reader) (files int, bytes int64, err error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, bytes, nil
+		}
+		if err != nil {
+			return files, bytes, err
+		}
+		if hdr.Name == "./" || hdr.Name == "." {
+			continue
+		}
+		hdr.Name = strings.TrimPrefix(hdr.Name, "./")
+		if err := aw.WriteHeader(hdr); err != nil {
+			return files, bytes, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			n, err := io.Copy(aw, tr)
+			if err != nil {
+				return files, bytes, err
+			}
+			files++
+			bytes += n
+		}
+	}
+}
+
+type ArchiveFunc func(hdr *tar.Header, r io.Reader) error
+
+/*
+逐个读取归档中的条目, zip 条目也转换为 tar.Header
+zip 需要随机读取, r 不是文件时先写入临时文件
+*/
+func ReadArchive(r io.Reader, format string, fn ArchiveFunc) error {
+	switch format {
+	case FormatTar:
+		return readTar(r, fn)
+	case FormatTgz:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return readTar(gz, fn)
+	case FormatZst:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return readTar(zr, fn)
+	case FormatZip:
+		return readZip(r, fn)
+	}
+	return fmt.Errorf("unknown archive format: %s", format)
+}
+
+func readTar(r io.Reader, fn ArchiveFunc) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func readZip(r io.Reader, fn ArchiveFunc) error {
+	f, ok := r.(*os.File)
+	if ok {
+		if st, err := f.Stat(); err != nil || !st.Mode().IsRegular() {
+			ok = false
+		}
+	}
+	if !ok {
+		tmp, err := ioutil.TempFile("", "fkme-zip-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, r); err != nil {
+			return err
+		}
+		f = tmp
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(f, st.Size())
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		hdr := &tar.Header{Name: zf.Name, Mode: int64(mode.Perm()), Size: int64(zf.UncompressedSize64),
+			ModTime: zf.Modified, Typeflag: tar.TypeReg}
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		switch {
+		case mode.IsDir():
+			hdr.Typeflag, hdr.Size = tar.TypeDir, 0
+		case mode&os.ModeSymlink != 0:
+			link, err := ioutil.ReadAll(io.LimitReader(rc, 4096))
+			if err != nil {
+				rc.Close()
+				return err
+			}
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, string(link), 0
+		}
+		err = fn(hdr, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+归档中的路径在 target 下的位置, 不允许 .. 或绝对路径跳出 target
+target 下已经存在的上级目录也不能是符号链接, 否则先解压 a -> /etc 再解压 a/passwd 会写到 /etc/passwd
+*/
+func SafeJoin(target, name string) (string, error) {
+	p, err := JoinUnder(target, name)
+	if err != nil {
+		return "", fmt.Errorf("illegal path in archive: %s", name)
+	}
+	rel, _ := filepath.Rel(target, filepath.Dir(p))
+	if rel == "." {
+		return p, nil
+	}
+	dir := target
+	for _, s := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, s)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break // 之后的目录由 MkdirAll 创建
+		} else if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("illegal path in archive: %s, %s is a symlink", name, dir)
+		}
+	}
+	return p, nil
+}
+
+/*
+解压到本地目录 target, 目录不存在时创建
+*/
+func Extract(r io.Reader, format, target string) error {
+	st, err := os.Stat(target)
+	if err != nil && os.IsNotExist(err) {
+		err = os.MkdirAll(target, 0755)
+		if err != nil {
+			logger.Error("Can not create dir of %s, %v", target, err)
+			return errors.New("can not create target dir")
+		}
+	} else if err == nil {
+		if !st.IsDir() {
+			logger.Error("target [%s] is not a directory", target)
+			return errors.New("target dir is not a directory")
+		}
+	} else {
+		logger.Error("Stat target %s failed %v", target, err)
+		return errors.New("unknown error of stat target directory")
+	}
+	return ReadArchive(r, format, func(header *tar.Header, r io.Reader) error {
+		return extractEntry(target, header, r)
+	})
+}
+
+func extractEntry(target string, header *tar.Header, r io.Reader) error {
+	fpath, err := SafeJoin(target, header.Name)
+	if err != nil {
+		return err
+	}
+	info := header.FileInfo()
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(fpath, 0755); err != nil {
+			logger.Error("Extract: Mkdir() failed: %s", err.Error())
+		}
+		return nil
+	case tar.TypeSymlink:
+		if _, err := os.Lstat(fpath); err == nil {
+			os.Remove(fpath)
+		}
+		os.MkdirAll(filepath.Dir(fpath), 0755)
+		return os.Symlink(header.Linkname, fpath)
+	case tar.TypeReg, tar.TypeRegA:
+	default:
+		return nil // 设备文件, 硬链接等不处理
+	}
+	if fi, err := os.Lstat(fpath); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		os.Remove(fpath) // 不跟随已有的符号链接写入
+	}
+	os.MkdirAll(filepath.Dir(fpath), 0755)
+	file, err := os.OpenFile(fpath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err == nil && !header.ModTime.IsZero() {
+		os.Chtimes(fpath, header.ModTime, header.ModTime)
+	}
+	return err
+}
+
+func ExtractTar(r io.Reader, target string) error {
+	return Extract(r, FormatTar, target)
+}
+
+func Untar(args []string) {
+	cmd := flag.NewFlagSet("untar", flag.ExitOnError)
+	target := cmd.String("C", ".", "extract into this directory")
+	format := cmd.String("format", "", "tar, tar.gz, tar.zst or zip, default by file name, tar for stdin")
+	cmd.Parse(args)
+	if cmd.NArg() != 1 {
+		fmt.Println("fkme untar [-C dir] [-format tar.zst] <file | ->")
+		os.Exit(2)
+	}
+	name := cmd.Arg(0)
+	f := *format
+	if f == "" {
+		f = ArchiveFormat(name)
+		if f == "" {
+			f = FormatTar
+		}
+	} else {
+		var err error
+		if f, err = ParseFormat(f); err != nil {
+			logger.Error("%v", err)
+			os.Exit(2)
+		}
+	}
+	in := os.Stdin
+	if name != "-" {
+		var err error
+		if in, err = os.Open(name); err != nil {
+			logger.Error("%v", err)
+			os.Exit(2)
+		}
+		defer in.Close()
+	}
+	if err := Extract(in, f, *target); err != nil {
+		logger.Error("extract failed: %v", err)
+		os.Exit(3)
+	}
+}
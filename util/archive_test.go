@@ -0,0 +1,95 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	target, err := ioutil.TempDir("", "safejoin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(target)
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	os.MkdirAll(filepath.Join(target, "dir", "sub"), 0755)
+	os.Symlink(outside, filepath.Join(target, "out"))
+	os.Symlink("sub", filepath.Join(target, "dir", "in"))
+
+	cases := []struct {
+		name string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{"dir/sub/a.txt", true},
+		{"new/dir/a.txt", true},
+		{"out", true},    // 链接本身可以替换
+		{"dir/in", true}, // 同上
+		{"../a.txt", false},
+		{"dir/../../a.txt", false},
+		{"out/passwd", false},
+		{"out/x/passwd", false},
+		{"dir/in/a.txt", false}, // 指向 target 内的链接也不跟随
+	}
+	for _, c := range cases {
+		p, err := SafeJoin(target, c.name)
+		if (err == nil) != c.ok {
+			t.Errorf("SafeJoin(%q) = %q, %v, want ok=%v", c.name, p, err, c.ok)
+		}
+	}
+}
+
+func TestExtractSymlinkEscape(t *testing.T) {
+	target, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(target)
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	// a -> outside, 然后 a/passwd; b -> outside/b, 然后普通文件 b
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside})
+	tw.WriteHeader(&tar.Header{Name: "a/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+	tw.Write([]byte("x"))
+	tw.WriteHeader(&tar.Header{Name: "b", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outside, "b")})
+	tw.WriteHeader(&tar.Header{Name: "b", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+	tw.Write([]byte("y"))
+	tw.Close()
+
+	if err := ExtractTar(bytes.NewReader(buf.Bytes()), target); err == nil {
+		t.Errorf("extract a/passwd through a symlink: want error")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "passwd")); err == nil {
+		t.Errorf("wrote %s/passwd", outside)
+	}
+
+	buf.Reset()
+	tw = tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "b", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outside, "b")})
+	tw.WriteHeader(&tar.Header{Name: "b", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+	tw.Write([]byte("y"))
+	tw.Close()
+	if err := ExtractTar(bytes.NewReader(buf.Bytes()), target); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "b")); err == nil {
+		t.Errorf("wrote %s/b through a symlink", outside)
+	}
+	if fi, err := os.Lstat(filepath.Join(target, "b")); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("%s/b should be a regular file: %v", target, err)
+	}
+}
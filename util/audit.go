@@ -0,0 +1,325 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/lulugyf/fkme/sshconfig"
+)
+
+/*
+连接审计: 每个连接关闭时写一行 JSON, 记录来源, 目标, 起止时间, 收发字节数, 关闭原因和端口映射名称
+文件超过 max_mb(默认 100) 时改名为 file.1, file.2 ..., 最多保留 keep(默认 5) 个
+bytes_in 为从来源收到的字节数, bytes_out 为发给来源的字节数, udp 映射没有连接, 不记录
+
+	fkme tunnel: {"audit":{"file":"~/.fkme/audit.jsonl", "max_mb":50, "keep":10}, "tunnels":[...]}
+	fkme pm -b "7000;10.0.0.5:22" -audit /var/log/fkme/pm.jsonl
+	fkme ws -addr wss://host/yt/ws -port "7022;>;2022" -audit audit.jsonl
+	fkme s5 -p 1080 -audit s5.jsonl -audit-max-mb 20
+
+	{"start":"2026-10-19T10:50:22+08:00","end":"2026-10-19T10:50:23+08:00","tunnel":"127.0.0.1:7122 -> localhost:2022",
+	 "server":"app@121.43.230.103:22","src":"127.0.0.1:50122","dst":"localhost:2022","bytes_in":812,"bytes_out":40213,"reason":"dst closed"}
+*/
+type AuditConf struct {
+	File  string `json:"file"`
+	MaxMB int    `json:"max_mb"`
+	Keep  int    `json:"keep"`
+}
+
+const (
+	defaultAuditMaxMB = 100
+	defaultAuditKeep  = 5
+)
+
+type AuditRecord struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Tunnel   string    `json:"tunnel"`
+	Server   string    `json:"server,omitempty"`
+	Src      string    `json:"src"`
+	Dst      string    `json:"dst"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Reason   string    `json:"reason"`
+}
+
+// 审计文件, nil 为不记录
+type AuditLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+}
+
+// conf 为 nil 或者没有 file 时返回 nil
+func OpenAudit(conf *AuditConf) (*AuditLog, error) {
+	if conf == nil || conf.File == "" {
+		return nil, nil
+	}
+	a := &AuditLog{path: sshconfig.ExpandHome(conf.File)}
+	a.SetLimits(conf.MaxMB, conf.Keep)
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// 修改轮转的大小和保留个数, 0 为默认值, 用于重新加载配置
+func (a *AuditLog) SetLimits(maxMB, keep int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.maxSize, a.keep = int64(maxMB)<<20, keep
+	if a.maxSize <= 0 {
+		a.maxSize = defaultAuditMaxMB << 20
+	}
+	if a.keep <= 0 {
+		a.keep = defaultAuditKeep
+	}
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, fi.Size()
+	return nil
+}
+
+// file.(keep-1) -> file.keep ... file -> file.1, 然后打开新的 file
+func (a *AuditLog) rotate() error {
+	a.f.Close()
+	a.f = nil
+	for i := a.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return a.open()
+}
+
+func (a *AuditLog) Write(r *AuditRecord) {
+	if a == nil {
+		return
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f != nil && a.size > 0 && a.size+int64(len(b)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("audit rotate %s: %v\n", a.path, err)
+		}
+	}
+	if a.f == nil { // 轮转失败后再次尝试打开
+		if err := a.open(); err != nil {
+			log.Printf("audit %s: %v\n", a.path, err)
+			return
+		}
+	}
+	n, err := a.f.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("audit %s: %v\n", a.path, err)
+	}
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+/*
+记录 ln 接受的每个连接, a 为 nil 时返回 ln
+tunnel 和 server 为端口映射和 ssh 服务的名称, dst 为转发的目标, socks 等每个连接不同时可以为空, 由 SetDst 设置
+*/
+func (a *AuditLog) Listen(ln net.Listener, tunnel, server, dst string) net.Listener {
+	if a == nil {
+		return ln
+	}
+	return &auditListener{Listener: ln, a: a, rec: AuditRecord{Tunnel: tunnel, Server: server, Dst: dst}}
+}
+
+type auditListener struct {
+	net.Listener
+	a   *AuditLog
+	rec AuditRecord
+}
+
+func (l *auditListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.a.Wrap(c, l.rec.Tunnel, l.rec.Server, l.rec.Dst), nil
+}
+
+// 记录一个连接, Close 时写入审计, a 为 nil 时返回 c
+func (a *AuditLog) Wrap(c net.Conn, tunnel, server, dst string) net.Conn {
+	if a == nil {
+		return c
+	}
+	ac := &AuditConn{Conn: c, a: a}
+	ac.rec = AuditRecord{Start: time.Now(), Tunnel: tunnel, Server: server, Dst: dst}
+	switch ra := c.RemoteAddr().(type) {
+	case nil: // 没有名字的 unix socket
+	case *net.TCPAddr:
+		ac.rec.Src = ra.String()
+		auditing.Store(ac.rec.Src, ac)
+	default:
+		ac.rec.Src = ra.String()
+	}
+	return ac
+}
+
+// 正在记录的 tcp 连接, 按来源地址查找, 见 AuditRules
+var auditing sync.Map
+
+// 审计中的连接, 读写时累计字节数
+type AuditConn struct {
+	net.Conn
+	a        *AuditLog
+	in, out  int64
+	mu       sync.Mutex
+	rec      AuditRecord
+	reason   string
+	closeOne sync.Once
+}
+
+// c 不是审计中的连接时返回 nil, nil 的方法不做任何事
+func AuditOf(c net.Conn) *AuditConn {
+	ac, _ := c.(*AuditConn)
+	return ac
+}
+
+func (c *AuditConn) SetDst(dst string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.rec.Dst = dst
+	c.mu.Unlock()
+}
+
+// 设置关闭原因, 只有第一次设置的有效
+func (c *AuditConn) SetReason(reason string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.reason == "" {
+		c.reason = reason
+	}
+	c.mu.Unlock()
+}
+
+func (c *AuditConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.in, int64(n))
+	if err == io.EOF {
+		c.SetReason("src closed")
+	} else if err != nil {
+		c.SetReason("src error: " + err.Error())
+	}
+	return n, err
+}
+
+func (c *AuditConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.out, int64(n))
+	if err != nil {
+		c.SetReason("src error: " + err.Error())
+	}
+	return n, err
+}
+
+func (c *AuditConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOne.Do(func() {
+		if c.rec.Src != "" {
+			auditing.Delete(c.rec.Src)
+		}
+		c.SetReason("closed")
+		c.mu.Lock()
+		r := c.rec
+		r.Reason = c.reason
+		c.mu.Unlock()
+		r.End = time.Now()
+		r.BytesIn, r.BytesOut = atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out)
+		c.a.Write(&r)
+	})
+	return err
+}
+
+// socks5 的规则, 把每个会话的目标记录到审计中的连接, 然后由 next 决定, next 为 nil 时全部允许
+func AuditRules(next socks5.RuleSet) socks5.RuleSet {
+	return auditRules{next: next}
+}
+
+type auditRules struct {
+	next socks5.RuleSet
+}
+
+func (r auditRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	var ac *AuditConn
+	if req.RemoteAddr != nil {
+		if v, ok := auditing.Load(req.RemoteAddr.Address()); ok {
+			ac = v.(*AuditConn)
+		}
+	}
+	if d := req.DestAddr; d != nil {
+		if d.FQDN != "" {
+			ac.SetDst(net.JoinHostPort(d.FQDN, strconv.Itoa(d.Port)))
+		} else {
+			ac.SetDst(d.Address())
+		}
+	}
+	if r.next == nil {
+		return ctx, true
+	}
+	ctx, ok := r.next.Allow(ctx, req)
+	if !ok {
+		ac.SetReason("denied by socks rules")
+	}
+	return ctx, ok
+}
+
+// 在 cmd 中注册 -audit -audit-max-mb -audit-keep, Parse 之后用 OpenAudit 打开
+func AuditFlags(cmd *flag.FlagSet) *AuditConf {
+	conf := &AuditConf{}
+	cmd.StringVar(&conf.File, "audit", "", "write a JSON line for every closed connection to this file")
+	cmd.IntVar(&conf.MaxMB, "audit-max-mb", defaultAuditMaxMB, "rotate the audit file at this size in MB")
+	cmd.IntVar(&conf.Keep, "audit-keep", defaultAuditKeep, "number of rotated audit files to keep")
+	return conf
+}
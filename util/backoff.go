@@ -0,0 +1,138 @@
+package util
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+重连的指数退避: 每次失败后等待时间乘以 Factor, 加上随机抖动, 不超过 Max
+连接稳定后调用 Reset 恢复到 Min
+本机网络地址变化(网络恢复, 切换 wifi 等)时 Sleep 提前返回, 立即重试
+
+	bo := &util.Backoff{Min: 2 * time.Second, Max: 5 * time.Minute}
+	for {
+		err := connect()
+		...
+		if !util.Sleep(ctx, bo.Next()) {
+			return
+		}
+	}
+*/
+type Backoff struct {
+	Min    time.Duration // 默认 1 秒
+	Max    time.Duration // 默认 5 分钟
+	Factor float64       // 默认 2
+	Jitter float64       // 随机增减的比例, 0 ~ 1, 默认 0.2
+
+	attempt int
+}
+
+// 下一次等待的时间
+func (b *Backoff) Next() time.Duration {
+	min, max, factor, jitter := b.Min, b.Max, b.Factor, b.Jitter
+	if min <= 0 {
+		min = time.Second
+	}
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+	if max < min {
+		max = min
+	}
+	if factor <= 1 {
+		factor = 2
+	}
+	if jitter <= 0 || jitter > 1 {
+		jitter = 0.2
+	}
+	d := float64(min)
+	for i := 0; i < b.attempt && d < float64(max); i++ {
+		d *= factor
+	}
+	b.attempt++
+	d += d * jitter * (rand.Float64()*2 - 1)
+	if d > float64(max) {
+		d = float64(max)
+	}
+	return time.Duration(d)
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+func (b *Backoff) Attempt() int {
+	return b.attempt
+}
+
+/*
+等待 d, ctx 结束时返回 false
+网络地址变化时提前返回 true
+*/
+func Sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+	case <-NetChanged():
+	}
+	return true
+}
+
+var netWatch struct {
+	once sync.Once
+	mu   sync.Mutex
+	ch   chan struct{}
+}
+
+/*
+本机网络地址(不含 loopback)变化时关闭返回的 chan
+第一次调用时开始每 2 秒检查一次
+*/
+func NetChanged() <-chan struct{} {
+	netWatch.once.Do(func() {
+		netWatch.ch = make(chan struct{})
+		go watchNet(2 * time.Second)
+	})
+	netWatch.mu.Lock()
+	defer netWatch.mu.Unlock()
+	return netWatch.ch
+}
+
+func localAddrs() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	ss := []string{}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && !ipn.IP.IsLoopback() && !ipn.IP.IsLinkLocalUnicast() {
+			ss = append(ss, ipn.String())
+		}
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, ",")
+}
+
+func watchNet(interval time.Duration) {
+	last := localAddrs()
+	for range time.Tick(interval) {
+		cur := localAddrs()
+		if cur == last {
+			continue
+		}
+		last = cur
+		netWatch.mu.Lock()
+		close(netWatch.ch)
+		netWatch.ch = make(chan struct{})
+		netWatch.mu.Unlock()
+	}
+}
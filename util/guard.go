@@ -0,0 +1,325 @@
+package util
+
+import (
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lulugyf/fkme/vault"
+)
+
+/*
+本地监听的访问控制: 来源地址的白名单和黑名单(CIDR 或 IP), 最大并发连接数, 共享密钥前导
+secret 不为空时, 连接后 10 秒内要先发送 secret 加换行, 不符时关闭, 适合监听在 0.0.0.0 上的端口
+unix socket 没有来源地址, 只检查连接数和 secret, 被拒绝的连接记录在日志中
+udp 没有连接, 只按来源地址检查 allow 和 deny, 见 ListenPacket
+http 代理等客户端不能先发送 secret 的监听使用 NoSecret
+
+	fkme tunnel: {"tunnel":"0.0.0.0:7122 -> localhost:22", "server":"gw", "guard":{"allow":["10.0.0.0/8"], "max_conn":20}}
+	fkme ws -addr wss://host/yt/ws -port "7022;>;2022" -allow 192.168.1.0/24,127.0.0.1 -deny 192.168.1.9
+	fkme pm -b "7000;127.0.0.1:22" -secret vault:pmkey      # 对端: fkme pm -b "7022;relay:7000" -dial-secret vault:pmkey
+	fkme s5 -p 1080 -allow 10.0.0.0/8 -max-conn 100
+	fkme wsmid -m cc -slot dd -ws ws://127.0.0.1:8899/yt/ws -p 31080 -to s5 -allow 127.0.0.1
+*/
+type GuardConf struct {
+	Allow   []string `json:"allow"`    // 非空时只接受这些来源
+	Deny    []string `json:"deny"`     // 先于 allow 检查
+	MaxConn int      `json:"max_conn"` // 最大并发连接数, 0 为不限制
+	Secret  string   `json:"secret"`   // 共享密钥, 可以是 vault:<name>
+}
+
+const secretTimeout = 10 * time.Second
+
+// 解析后的访问控制, nil 为不限制
+type Guard struct {
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	maxConn int
+	secret  []byte
+}
+
+// conf 为 nil 或者没有任何限制时返回 nil
+func NewGuard(conf *GuardConf) (*Guard, error) {
+	if conf == nil || (len(conf.Allow) == 0 && len(conf.Deny) == 0 && conf.MaxConn <= 0 && conf.Secret == "") {
+		return nil, nil
+	}
+	g := &Guard{maxConn: conf.MaxConn}
+	var err error
+	if g.allow, err = parseCIDRs(conf.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %v", err)
+	}
+	if g.deny, err = parseCIDRs(conf.Deny); err != nil {
+		return nil, fmt.Errorf("deny: %v", err)
+	}
+	if conf.Secret != "" {
+		s, err := vault.Resolve(conf.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("secret: %v", err)
+		}
+		if strings.Contains(s, "\n") {
+			return nil, errors.New("secret: must be a single line")
+		}
+		g.secret = []byte(s)
+	}
+	return g, nil
+}
+
+func parseCIDRs(ss []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range ss {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func matchIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 按来源地址检查, 不是 ip 地址(unix socket)时通过
+func (g *Guard) check(addr net.Addr) error {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return nil
+	}
+	if matchIP(g.deny, ip) {
+		return errors.New("denied")
+	}
+	if len(g.allow) > 0 && !matchIP(g.allow, ip) {
+		return errors.New("not allowed")
+	}
+	return nil
+}
+
+func (g *Guard) readSecret(c net.Conn) error {
+	c.SetReadDeadline(time.Now().Add(secretTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	buf := make([]byte, len(g.secret)+1)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return fmt.Errorf("no secret: %v", err)
+	}
+	if subtle.ConstantTimeCompare(buf[:len(g.secret)], g.secret) != 1 || buf[len(g.secret)] != '\n' {
+		return errors.New("bad secret")
+	}
+	return nil
+}
+
+// 连接 secret 保护的监听时, 先发送 secret
+func WriteSecret(w io.Writer, secret string) error {
+	_, err := io.WriteString(w, secret+"\n")
+	return err
+}
+
+/*
+按 g 过滤 ln 接受的连接, g 为 nil 时返回 ln, tag 用于日志
+需要 secret 时在单独的 goroutine 中读取, 不阻塞其它连接
+*/
+func (g *Guard) Listen(ln net.Listener, tag string) net.Listener {
+	if g == nil {
+		return ln
+	}
+	l := &guardListener{Listener: ln, g: g, tag: tag}
+	if g.secret != nil {
+		l.ready = make(chan net.Conn)
+		l.done = make(chan struct{})
+		go l.acceptLoop()
+	}
+	return l
+}
+
+type guardListener struct {
+	net.Listener
+	g      *Guard
+	tag    string
+	active int32
+
+	// 需要 secret 时, 由 acceptLoop 接受连接
+	ready chan net.Conn
+	done  chan struct{}
+	err   error
+}
+
+func (l *guardListener) Accept() (net.Conn, error) {
+	if l.ready == nil {
+		for {
+			c, err := l.Listener.Accept()
+			if err != nil {
+				return nil, err
+			}
+			if c = l.admit(c); c != nil {
+				return c, nil
+			}
+		}
+	}
+	select {
+	case c := <-l.ready:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *guardListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		if c = l.admit(c); c == nil {
+			continue
+		}
+		go func(c net.Conn) {
+			if err := l.g.readSecret(c); err != nil {
+				l.reject(c, err.Error())
+				c.Close()
+				return
+			}
+			select {
+			case l.ready <- c:
+			case <-l.done:
+				c.Close()
+			}
+		}(c)
+	}
+}
+
+// 检查来源和连接数, 通过时返回计数的连接, 否则关闭并返回 nil
+func (l *guardListener) admit(c net.Conn) net.Conn {
+	if err := l.g.check(c.RemoteAddr()); err != nil {
+		l.reject(c, err.Error())
+		c.Close()
+		return nil
+	}
+	if n := atomic.AddInt32(&l.active, 1); l.g.maxConn > 0 && int(n) > l.g.maxConn {
+		atomic.AddInt32(&l.active, -1)
+		l.reject(c, fmt.Sprintf("too many connections (%d)", l.g.maxConn))
+		c.Close()
+		return nil
+	}
+	return &guardConn{Conn: c, l: l}
+}
+
+func (l *guardListener) reject(c net.Conn, reason string) {
+	log.Printf("(%s) reject %v: %s\n", l.tag, c.RemoteAddr(), reason)
+}
+
+// Close 时减少监听的连接数
+type guardConn struct {
+	net.Conn
+	l    *guardListener
+	once sync.Once
+}
+
+func (c *guardConn) Close() error {
+	c.once.Do(func() { atomic.AddInt32(&c.l.active, -1) })
+	return c.Conn.Close()
+}
+
+// 不检查 secret 的 g, 用于客户端不能先发送 secret 的监听(如 ws -http 代理), 没有其它限制时返回 nil
+func (g *Guard) NoSecret() *Guard {
+	if g == nil || g.secret == nil {
+		return g
+	}
+	if len(g.allow) == 0 && len(g.deny) == 0 && g.maxConn <= 0 {
+		return nil
+	}
+	ng := *g
+	ng.secret = nil
+	return &ng
+}
+
+/*
+按来源地址过滤 pc 收到的数据报, 只检查 allow 和 deny, g 为 nil 或者没有地址限制时返回 pc
+被拒绝的来源只记录一次日志
+*/
+func (g *Guard) ListenPacket(pc net.PacketConn, tag string) net.PacketConn {
+	if g == nil || (len(g.allow) == 0 && len(g.deny) == 0) {
+		return pc
+	}
+	return &guardPacketConn{PacketConn: pc, g: g, tag: tag}
+}
+
+type guardPacketConn struct {
+	net.PacketConn
+	g        *Guard
+	tag      string
+	rejected sync.Map
+}
+
+func (c *guardPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		if err := c.g.check(addr); err != nil {
+			if _, logged := c.rejected.LoadOrStore(addr.String(), true); !logged {
+				log.Printf("(%s) reject %v: %s\n", c.tag, addr, err)
+			}
+			continue
+		}
+		return n, addr, nil
+	}
+}
+
+// 逗号分隔, 可以重复的参数
+type csvFlag []string
+
+func (f *csvFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *csvFlag) Set(value string) error {
+	*f = append(*f, strings.Split(value, ",")...)
+	return nil
+}
+
+// 在 cmd 中注册 -allow -deny -max-conn -secret, Parse 之后用 NewGuard 解析
+func GuardFlags(cmd *flag.FlagSet) *GuardConf {
+	conf := &GuardConf{}
+	cmd.Var((*csvFlag)(&conf.Allow), "allow", "only accept clients from these CIDRs or IPs, comma separated")
+	cmd.Var((*csvFlag)(&conf.Deny), "deny", "reject clients from these CIDRs or IPs, comma separated")
+	cmd.IntVar(&conf.MaxConn, "max-conn", 0, "max concurrent connections per listener, 0 for no limit")
+	cmd.StringVar(&conf.Secret, "secret", "", "clients must send this line first, vault:<name> is read from fkme vault")
+	return conf
+}
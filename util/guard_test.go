@@ -0,0 +1,64 @@
+package util
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGuardListenPacket(t *testing.T) {
+	g, err := NewGuard(&GuardConf{Deny: []string{"127.0.0.2"}, Secret: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc = g.ListenPacket(pc, "test")
+
+	for _, c := range []struct{ src, msg string }{{"127.0.0.2", "bad"}, {"127.0.0.1", "good"}} {
+		laddr := &net.UDPAddr{IP: net.ParseIP(c.src)}
+		conn, err := net.DialUDP("udp", laddr, pc.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			// macOS/BSD 的 lo0 默认只有 127.0.0.1
+			t.Skipf("cannot send from %s: %v", c.src, err)
+		}
+		conn.Write([]byte(c.msg))
+		conn.Close()
+	}
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "good" {
+		t.Errorf("ReadFrom = %q from %v, %v, want good", buf[:n], addr, err)
+	}
+}
+
+func TestGuardNoSecret(t *testing.T) {
+	cases := []struct {
+		conf GuardConf
+		nil_ bool
+	}{
+		{GuardConf{Secret: "s"}, true},
+		{GuardConf{Secret: "s", MaxConn: 3}, false},
+		{GuardConf{Allow: []string{"10.0.0.0/8"}}, false},
+	}
+	for _, c := range cases {
+		g, err := NewGuard(&c.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ng := g.NoSecret()
+		if (ng == nil) != c.nil_ {
+			t.Errorf("NoSecret(%+v) = %v, want nil=%v", c.conf, ng, c.nil_)
+		}
+		if ng != nil && ng.secret != nil {
+			t.Errorf("NoSecret(%+v) still has a secret", c.conf)
+		}
+		if g.secret == nil && c.conf.Secret != "" {
+			t.Errorf("NoSecret changed the original guard")
+		}
+	}
+}
@@ -8,13 +8,17 @@ set GO111MODULE=off
 //---
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"strings"
 	"time"
+
+	"github.com/lulugyf/fkme/vault"
 )
 
 type Port struct {
@@ -35,6 +39,10 @@ type Serv struct {
 	showdata *bool
 	mng_port *int
 	cfg_file string
+
+	guard       *Guard // 监听的访问控制, 见 guard.go
+	audit       *AuditLog
+	dial_secret string // 目标是 secret 保护的监听时, 连接后先发送
 }
 
 func NewServ() *Serv {
@@ -72,6 +80,12 @@ func Trans(conn1, conn2 net.Conn, tag string, repstr string) {
 		n, err := conn1.Read(buf)
 		if err != nil {
 			println("Error reading:", err.Error(), "::read from", conn1.RemoteAddr().String())
+			// conn2 为审计中的来源时, conn1 是目标, 字节数由 AuditConn 统计
+			if err == io.EOF {
+				AuditOf(conn2).SetReason("dst closed")
+			} else {
+				AuditOf(conn2).SetReason("dst error: " + err.Error())
+			}
 			break
 		}
 		if len(ss) > 0 {
@@ -114,6 +128,8 @@ func (v *Serv) Listen(port *Port, showdata bool) {
 		log.Println("error listening:", err.Error())
 		os.Exit(1)
 	}
+	listener = v.guard.Listen(listener, fmt.Sprintf("pm %d", port.Listen_port))
+	listener = v.audit.Listen(listener, fmt.Sprintf("pm %d", port.Listen_port), "", "")
 	tag_up, tag_down := "<<", ""
 	if !showdata {
 		tag_up, tag_down = "", ""
@@ -130,6 +146,8 @@ func (v *Serv) Listen(port *Port, showdata bool) {
 		go func(port *Port, conn net.Conn) {
 			var conn1 net.Conn
 			var err1 error
+			ac := AuditOf(conn)
+			ac.SetDst(port.Remote_addr) // Remote_addr 可以被 bindOp 修改
 			for i := 0; i < 10; i++ {
 				conn1, err1 = net.Dial("tcp", port.Remote_addr)
 				if err1 != nil {
@@ -141,9 +159,17 @@ func (v *Serv) Listen(port *Port, showdata bool) {
 			}
 			if err1 != nil {
 				fmt.Printf("  -Connect to target [%s] failed [%v], close\n", port.Remote_addr, err1.Error())
+				ac.SetReason("dial error: " + err1.Error())
 				conn.Close()
 				return
 			}
+			if v.dial_secret != "" {
+				if err := WriteSecret(conn1, v.dial_secret); err != nil {
+					conn.Close()
+					conn1.Close()
+					return
+				}
+			}
 			fmt.Printf("  =New Connection from %s on port %d to %s\n",
 				conn.RemoteAddr().String(), port.Listen_port, port.Remote_addr)
 			go Trans(conn, conn1, tag_up, "") //port.repstr)
@@ -178,6 +204,67 @@ func (serv *Serv) bindOp(port int, remote_addr, repstr string) int {
 	}
 }
 
+/*
+udp 映射, listen 和 dst 任一为 udp: 时
+  udp:port;udp:host:port  直接转发
+  udp:port;host:port      数据报加帧头经 tcp 发往 dst, 由对端的 "port;udp:host:port" 转发
+  port;udp:host:port      tcp 连接中的数据报发往 udp 目标
+*/
+func (serv *Serv) bindUDP(item string) {
+	ss := strings.SplitN(item, ";", 2)
+	if len(ss) != 2 {
+		log.Fatalf("invalid bind item: %s", item)
+	}
+	listen, dst := strings.TrimPrefix(ss[0], "udp:"), ss[1]
+	if !strings.Contains(listen, ":") {
+		listen = ":" + listen
+	}
+	if !strings.HasPrefix(ss[0], "udp:") {
+		listener, err := net.Listen("tcp", listen)
+		if err != nil {
+			log.Fatalf("error listening: %v", err)
+		}
+		log.Printf("Listen on %s -> %s\n", listen, dst)
+		listener = serv.guard.Listen(listener, "pm "+listen)
+		listener = serv.audit.Listen(listener, "pm "+listen, "", dst)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					log.Println("Error accept:", err.Error())
+					return
+				}
+				go RelayUDP(conn, strings.TrimPrefix(dst, "udp:"), DefaultUDPIdle)
+			}
+		}()
+		return
+	}
+
+	pc, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		log.Fatalf("error listening: %v", err)
+	}
+	pc = serv.guard.ListenPacket(pc, "pm "+listen)
+	log.Printf("Listen on udp %s -> %s\n", listen, dst)
+	dial := func() (io.ReadWriteCloser, error) {
+		c, err := net.Dial("tcp", dst)
+		if err == nil && serv.dial_secret != "" {
+			if err = WriteSecret(c, serv.dial_secret); err != nil {
+				c.Close()
+			}
+		}
+		return c, err
+	}
+	if strings.HasPrefix(dst, "udp:") {
+		dial = func() (io.ReadWriteCloser, error) {
+			c1, c2 := net.Pipe()
+			go RelayUDP(c2, dst[4:], DefaultUDPIdle)
+			return c1, nil
+		}
+	}
+	go ServeUDP(context.Background(), pc, dial, DefaultUDPIdle)
+}
+
 type arrayFlags []string
 
 func (i *arrayFlags) String() string {
@@ -193,7 +280,10 @@ func PM(args []string) {
 	cmd := flag.NewFlagSet("socks5", flag.ExitOnError)
 	//log.Printf("------- [%s] [%s] --\n", os.Args[1], os.Args[2])
 	var arr arrayFlags
-	cmd.Var(&arr, "b", "bind port item: listen;dst_host:dst_port")
+	cmd.Var(&arr, "b", "bind port item: listen;dst_host:dst_port, either side can be udp:, see udp.go")
+	gconf := GuardFlags(cmd)
+	aconf := AuditFlags(cmd)
+	dial_secret := cmd.String("dial-secret", "", "send this line first to the targets, for a pm -secret on the other side")
 	cmd.Parse(args)
 
 	if len(arr) < 1 {
@@ -201,7 +291,24 @@ func PM(args []string) {
 		return
 	}
 	serv := NewServ()
+	var err error
+	if serv.guard, err = NewGuard(gconf); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if serv.audit, err = OpenAudit(aconf); err != nil {
+		log.Fatalf("audit: %v", err)
+	}
+	if *dial_secret != "" {
+		if serv.dial_secret, err = vault.Resolve(*dial_secret); err != nil {
+			log.Fatalf("-dial-secret: %v", err)
+		}
+	}
 	for i, b := range arr {
+		if strings.Contains(b, "udp:") {
+			fmt.Printf("%d == %s\n", i, b)
+			serv.bindUDP(b)
+			continue
+		}
 		p := 0
 		d := ""
 		fmt.Sscanf(b, "%d;%s", &p, &d)
@@ -0,0 +1,148 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lulugyf/fkme/logger"
+)
+
+/*
+长时间运行的同步进程(scp -daemon, watch)的状态, 通过 -status-addr 以 HTTP 方式查看
+
+GET  /status          返回 JSON 格式的状态
+POST /sync?path=xxx   强制重新同步 xxx (相对于同步的本地目录), 为空则同步整个目录
+
+curl http://127.0.0.1:8090/status
+curl -X POST 'http://127.0.0.1:8090/sync?path=src/main.go'
+*/
+const maxStatusErrors = 20
+
+type StatusError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+type Status struct {
+	mu         sync.Mutex
+	Name       string               `json:"name"`
+	Local      string               `json:"local"`
+	Remote     string               `json:"remote"`
+	Connected  bool                 `json:"connected"`
+	Started    time.Time            `json:"started"`
+	LastSync   time.Time            `json:"last_sync"`
+	QueueDepth int                  `json:"queue_depth"`
+	Errors     []StatusError        `json:"recent_errors"`
+	Files      map[string]time.Time `json:"files"` // 每个文件最后一次上传成功的时间
+
+	resync func(path string) error
+}
+
+func NewStatus(name, local, remote string) *Status {
+	return &Status{
+		Name:    name,
+		Local:   local,
+		Remote:  remote,
+		Started: time.Now(),
+		Errors:  []StatusError{},
+		Files:   make(map[string]time.Time),
+	}
+}
+
+func (s *Status) SetConnected(connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Connected = connected
+}
+
+func (s *Status) SetQueue(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.QueueDepth = n
+}
+
+// 文件 fpath 同步成功
+func (s *Status) Synced(fpath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastSync = time.Now()
+	s.Files[fpath] = s.LastSync
+}
+
+// 记录错误, 只保留最近的 maxStatusErrors 条
+func (s *Status) Error(format string, v ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Errors = append(s.Errors, StatusError{Time: time.Now(), Message: fmt.Sprintf(format, v...)})
+	if len(s.Errors) > maxStatusErrors {
+		s.Errors = s.Errors[len(s.Errors)-maxStatusErrors:]
+	}
+}
+
+// root 下的路径, p 为相对于 root 的路径, 不允许 .. 跳出 root, 用于 POST /sync 和解压
+func JoinUnder(root, p string) (string, error) {
+	fpath := filepath.Join(root, filepath.FromSlash(p))
+	rel, err := filepath.Rel(root, fpath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", p, root)
+	}
+	return fpath, nil
+}
+
+// 设置 POST /sync 的处理函数
+func (s *Status) OnSync(fn func(path string) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resync = fn
+}
+
+func (s *Status) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *Status) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	fn := s.resync
+	s.mu.Unlock()
+	if fn == nil {
+		http.Error(w, "resync not supported", http.StatusNotImplemented)
+		return
+	}
+	fpath := r.URL.Query().Get("path")
+	logger.Info("status: resync [%s]", fpath)
+	if err := fn(fpath); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// 在 addr 上启动状态服务, 不阻塞
+func (s *Status) Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/sync", s.handleSync)
+	go func() {
+		logger.Info("status server listen on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("status server on %s failed: %v", addr, err)
+		}
+	}()
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestJoinUnder(t *testing.T) {
+	root := filepath.FromSlash("/data/proj")
+	cases := []struct {
+		p    string
+		want string // 空为应当拒绝
+	}{
+		{"", "/data/proj"},
+		{".", "/data/proj"},
+		{"src/main.go", "/data/proj/src/main.go"},
+		{"src/../README", "/data/proj/README"},
+		{"/etc/passwd", "/data/proj/etc/passwd"},
+		{"..", ""},
+		{"../proj2/x", ""},
+		{"../proj/x", "/data/proj/x"},
+		{"src/../../proj2", ""},
+		{"a/b/../../../x", ""},
+		{"..foo", "/data/proj/..foo"},
+	}
+	for _, c := range cases {
+		got, err := JoinUnder(root, c.p)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("JoinUnder(%q) = %q, want error", c.p, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(c.want) {
+			t.Errorf("JoinUnder(%q) = %q, %v, want %q", c.p, got, err, c.want)
+		}
+	}
+}
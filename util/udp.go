@@ -0,0 +1,231 @@
+package util
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+UDP 转发: 数据报加上 2 字节(大端)的长度帧头, 在 tcp 连接, ssh 通道或者 websocket 中传输
+本地一侧 ServeUDP: 每个来源地址一个会话, 各自打开一个流, 空闲超时后关闭
+远端一侧 RelayUDP: 从流中读出数据报发往目标, 目标的回复加上帧头写回流, 空闲超时或者流关闭时结束
+
+	fkme pm -b "udp:5353;udp:8.8.8.8:53"   # 直接转发 udp
+	fkme pm -b "udp:5353;10.0.0.5:7053"     # 数据报经 tcp 发往 10.0.0.5:7053
+	fkme pm -b "7053;udp:8.8.8.8:53"        # 在 10.0.0.5 上: tcp 中的数据报发往 8.8.8.8:53
+*/
+const DefaultUDPIdle = 60 * time.Second
+
+const maxDatagram = 65535
+
+// 写一个数据报, 帧头和数据一次写入, websocket 中为一个消息
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > maxDatagram {
+		return fmt.Errorf("datagram too large: %d", len(p))
+	}
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+	_, err := w.Write(buf)
+	return err
+}
+
+// 读一个数据报到 buf, buf 至少 65535 字节
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(h[:]))
+	if n > len(buf) {
+		return 0, fmt.Errorf("datagram too large: %d", n)
+	}
+	return io.ReadFull(r, buf[:n])
+}
+
+type udpSession struct {
+	stream io.ReadWriteCloser
+	out    chan []byte // 发往流的数据报, 满时丢弃
+	done   chan struct{}
+	last   int64 // 最后活动时间, unix nano
+	once   sync.Once
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.last)))
+}
+
+func (s *udpSession) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.stream.Close()
+	})
+}
+
+/*
+从 pc 接收数据报, 每个来源地址用 dial 打开一个流, 回复按来源地址发回
+会话空闲超过 idle(0 为 DefaultUDPIdle)时关闭, ctx 结束时关闭 pc 和全部会话
+*/
+func ServeUDP(ctx context.Context, pc net.PacketConn, dial func() (io.ReadWriteCloser, error), idle time.Duration) error {
+	if idle <= 0 {
+		idle = DefaultUDPIdle
+	}
+	var mu sync.Mutex
+	sessions := map[string]*udpSession{}
+	remove := func(key string, s *udpSession) {
+		mu.Lock()
+		if sessions[key] == s {
+			delete(sessions, key)
+		}
+		mu.Unlock()
+		s.close()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		mu.Lock()
+		for k, s := range sessions {
+			delete(sessions, k)
+			s.close()
+		}
+		mu.Unlock()
+	}()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		key := addr.String()
+		mu.Lock()
+		s := sessions[key]
+		mu.Unlock()
+		if s == nil {
+			stream, err := dial()
+			if err != nil {
+				log.Printf("udp %s: %v\n", key, err)
+				continue
+			}
+			s = &udpSession{stream: stream, out: make(chan []byte, 64), done: make(chan struct{})}
+			s.touch()
+			mu.Lock()
+			sessions[key] = s
+			mu.Unlock()
+			go func(key string, addr net.Addr, s *udpSession) {
+				defer remove(key, s)
+				rbuf := make([]byte, maxDatagram)
+				for {
+					n, err := ReadDatagram(s.stream, rbuf)
+					if err != nil {
+						return
+					}
+					s.touch()
+					if _, err := pc.WriteTo(rbuf[:n], addr); err != nil {
+						return
+					}
+				}
+			}(key, addr, s)
+			go func(key string, s *udpSession) {
+				defer remove(key, s)
+				t := time.NewTicker(idle / 4)
+				defer t.Stop()
+				for {
+					select {
+					case <-s.done:
+						return
+					case p := <-s.out:
+						if err := WriteDatagram(s.stream, p); err != nil {
+							return
+						}
+					case <-t.C:
+						if s.idle() > idle {
+							return
+						}
+					}
+				}
+			}(key, s)
+		}
+		s.touch()
+		select {
+		case s.out <- append([]byte(nil), buf[:n]...):
+		default: // 流写不过来或者会话已经关闭, 和 udp 一样丢弃
+		}
+	}
+}
+
+/*
+把 stream 中的数据报发往 target(host:port), target 的回复写回 stream
+stream 关闭, 出错或者空闲超过 idle(0 为 DefaultUDPIdle)时返回, 返回时关闭 stream
+*/
+func RelayUDP(stream io.ReadWriteCloser, target string, idle time.Duration) error {
+	defer stream.Close()
+	if idle <= 0 {
+		idle = DefaultUDPIdle
+	}
+	uc, err := net.Dial("udp", target)
+	if err != nil {
+		return err
+	}
+	defer uc.Close()
+
+	var last int64
+	touch := func() { atomic.StoreInt64(&last, time.Now().UnixNano()) }
+	touch()
+	go func() {
+		defer uc.Close()
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := ReadDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			touch()
+			if _, err := uc.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		uc.SetReadDeadline(time.Now().Add(idle / 4))
+		n, err := uc.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if time.Since(time.Unix(0, atomic.LoadInt64(&last))) > idle {
+					return nil
+				}
+				continue
+			}
+			// 目标端口不可达(ICMP)时继续等待, 其它错误为 uc 已关闭
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			return nil
+		}
+		touch()
+		if err := WriteDatagram(stream, buf[:n]); err != nil {
+			return err
+		}
+	}
+}
@@ -1,5 +1,5 @@
-//go:build linux
-// +build linux
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
 
 package util
 
@@ -1,8 +1,9 @@
-//go:build windows
-// +build windows
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
 
 package util
 
+// 其他平台不支持, sftp statvfs 返回 unsupported
 func DiskUsage(path string) *DiskStatus {
 	return nil
 }
@@ -0,0 +1,216 @@
+package vault
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/awnumar/memguard"
+	"github.com/lulugyf/fkme/logger"
+	"golang.org/x/term"
+)
+
+/*
+-- 添加, 值在终端中输入(不回显), 或者来自参数, 文件, 管道
+fkme vault add od
+fkme vault add od 'app/secret@10.1.1.5'
+fkme vault add -file ~/.ssh/id_rsa prodkey
+echo -n secret | fkme vault add s5pass
+-- 导入原来 sftpcli -serv 使用的加密地址, 值为 host:port:user:pass
+fkme vault add -serv 'U2FsdGVk...' models
+-- 查看, 列出, 删除, 修改主密码
+fkme vault get od
+fkme vault list
+fkme vault rm od
+fkme vault passwd
+
+-- 使用
+fkme scp -pw vault:od fkme app@10.1.1.5:gosrc/fkme
+fkme scp fkme app/vault:od@10.1.1.5:gosrc/fkme
+fkme scp -i vault:prodkey fkme app@10.1.1.5:gosrc/fkme
+fkme artifact pull -serv vault:models resnet ./model
+fkme s5 -user me -pass vault:s5pass
+tunnel 配置中的 "keyfile": "vault:prodkey"
+*/
+func Run(args []string) {
+	if len(args) < 1 {
+		usage()
+		os.Exit(2)
+	}
+	op := args[0]
+	cmd := flag.NewFlagSet("vault "+op, flag.ExitOnError)
+	file := cmd.String("file", "", "add: read value from file, e.g. a private key")
+	serv := cmd.String("serv", "", "add: decode an encoded sftpcli server address as value")
+	cmd.Parse(args[1:])
+
+	if op == "passwd" {
+		if err := changePass(); err != nil {
+			logger.Error("%v", err)
+			os.Exit(3)
+		}
+		return
+	}
+	v, err := openForCmd(op == "add")
+	if err != nil {
+		logger.Error("%v", err)
+		os.Exit(3)
+	}
+
+	switch {
+	case op == "list" && cmd.NArg() == 0:
+		for _, name := range v.Names() {
+			fmt.Println(name)
+		}
+	case op == "get" && cmd.NArg() == 1:
+		buf, err := v.Get(cmd.Arg(0))
+		if err != nil {
+			logger.Error("%v", err)
+			os.Exit(3)
+		}
+		os.Stdout.Write(buf.Bytes())
+		fmt.Println()
+		buf.Destroy()
+	case op == "add" && (cmd.NArg() == 1 || cmd.NArg() == 2):
+		value, err := readValue(cmd.Arg(1), *file, *serv)
+		if err != nil {
+			logger.Error("%v", err)
+			os.Exit(3)
+		}
+		if err := v.Set(cmd.Arg(0), value); err != nil {
+			logger.Error("%v", err)
+			os.Exit(2)
+		}
+		saveOrExit(v)
+	case op == "rm" && cmd.NArg() == 1:
+		if err := v.Remove(cmd.Arg(0)); err != nil {
+			logger.Error("%v", err)
+			os.Exit(3)
+		}
+		saveOrExit(v)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Println("fkme vault add [-file f | -serv encoded] <name> [value]")
+	fmt.Println("fkme vault get <name>")
+	fmt.Println("fkme vault list")
+	fmt.Println("fkme vault rm <name>")
+	fmt.Println("fkme vault passwd")
+	fmt.Printf("  vault file: $%s or ~/.fkme/vault, passphrase: $%s or prompt\n", PathEnv, PassEnv)
+}
+
+func saveOrExit(v *Vault) {
+	if err := v.Save(); err != nil {
+		logger.Error("save %s failed: %v", v.Path(), err)
+		os.Exit(3)
+	}
+}
+
+// 库不存在时, add 创建新的库, 需要输入两次主密码
+func openForCmd(create bool) (*Vault, error) {
+	path := DefaultPath()
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) && !create {
+		return nil, fmt.Errorf("vault %s not found, use `fkme vault add` to create it", path)
+	}
+	pass, err := Passphrase(os.IsNotExist(err))
+	if err != nil {
+		return nil, err
+	}
+	defer pass.Destroy()
+	return Open(path, pass.Bytes())
+}
+
+func changePass() error {
+	v, err := openForCmd(false)
+	if err != nil {
+		return err
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return errors.New("passwd needs a terminal")
+	}
+	fmt.Fprintln(os.Stderr, "new passphrase")
+	pass, err := prompt(true)
+	if err != nil {
+		return err
+	}
+	defer pass.Destroy()
+	if err := v.SetPass(pass.Bytes()); err != nil {
+		return err
+	}
+	return v.Save()
+}
+
+/*
+主密码: 环境变量 FKME_VAULT_PASS, 否则在终端输入, confirm 时输入两次
+*/
+func Passphrase(confirm bool) (*memguard.LockedBuffer, error) {
+	if s := os.Getenv(PassEnv); s != "" {
+		return memguard.NewBufferFromBytes([]byte(s)), nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("vault passphrase required, set %s", PassEnv)
+	}
+	return prompt(confirm)
+}
+
+func prompt(confirm bool) (*memguard.LockedBuffer, error) {
+	fmt.Fprint(os.Stderr, "vault passphrase: ")
+	p1, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(p1) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	pass := memguard.NewBufferFromBytes(p1)
+	if !confirm {
+		return pass, nil
+	}
+	fmt.Fprint(os.Stderr, "repeat passphrase: ")
+	p2, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		pass.Destroy()
+		return nil, err
+	}
+	p2buf := memguard.NewBufferFromBytes(p2)
+	defer p2buf.Destroy()
+	if !pass.EqualTo(p2buf.Bytes()) {
+		pass.Destroy()
+		return nil, errors.New("passphrases do not match")
+	}
+	return pass, nil
+}
+
+// 值的来源: 参数, -file, -serv, 终端输入, 标准输入
+func readValue(arg, file, serv string) ([]byte, error) {
+	switch {
+	case arg != "":
+		return []byte(arg), nil
+	case file != "":
+		return ioutil.ReadFile(file)
+	case serv != "":
+		s := DecodeServ(serv)
+		if strings.Count(s, ":") < 3 {
+			return nil, errors.New("invalid encoded server address")
+		}
+		return []byte(s), nil
+	case term.IsTerminal(int(os.Stdin.Fd())):
+		fmt.Fprint(os.Stderr, "value: ")
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return b, err
+	}
+	b, err := ioutil.ReadAll(bufio.NewReader(os.Stdin))
+	return bytes.TrimRight(b, "\r\n"), err
+}
@@ -0,0 +1,32 @@
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+)
+
+/*
+解码原来 sftpcli -serv 使用的服务器地址: base64(aes("host:port:user:pass"))
+密钥和 iv 是固定写在程序中的, 只用于导入到凭据库(fkme vault add -serv)和兼容旧的参数, 失败时返回空串
+*/
+func DecodeServ(addr string) string {
+	key := []byte("thisis32bitlongpassphraseimusing")
+	iv := []byte("1234567890abcdef")
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return ""
+	}
+	bb, err := base64.StdEncoding.DecodeString(addr)
+	if err != nil || len(bb) == 0 || len(bb)%aes.BlockSize != 0 {
+		return ""
+	}
+	decrypted := make([]byte, len(bb))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, bb)
+	b := int(decrypted[len(decrypted)-1])
+	if b == 0 || b > aes.BlockSize {
+		return ""
+	}
+	return string(decrypted[:len(decrypted)-b])
+}
@@ -0,0 +1,361 @@
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/scrypt"
+)
+
+/*
+加密的凭据库, 保存服务器密码, 私钥, 地址等, 命令行和配置中用 vault:<name> 引用
+
+文件: $FKME_VAULT, 默认 ~/.fkme/vault, 内容为 json:
+  {"version":1, "kdf":"scrypt", "n":32768, "r":8, "p":1, "salt":..., "nonce":..., "data":...}
+data 为 AES-256-GCM 加密的 {name: base64(value)}, 密钥由主密码经 scrypt 生成
+(version 1 中 value 是 json 字符串, 读取时只能经过 string, Save 后升级为 version 2)
+主密码来自环境变量 FKME_VAULT_PASS, 未设置时在终端输入
+解密后的密钥和每个值都放在 memguard 中, 不会被换出到磁盘, Get 返回的 buffer 用完后由调用者 Destroy
+
+	v, err := vault.Open(vault.DefaultPath(), pass)
+	v.Set("od", []byte("app/secret@10.1.1.5:22"))
+	v.Save()
+	buf, err := v.Get("od")
+	defer buf.Destroy()
+	s, err := vault.Resolve("vault:od")
+*/
+const (
+	Prefix  = "vault:"
+	PassEnv = "FKME_VAULT_PASS"
+	PathEnv = "FKME_VAULT"
+
+	fileVersion = 2
+	scryptN     = 1 << 15
+	scryptR     = 8
+	scryptP     = 1
+)
+
+var (
+	ErrNotFound  = errors.New("no such vault entry")
+	ErrWrongPass = errors.New("wrong vault passphrase or corrupted vault")
+)
+
+type vaultFile struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+type Vault struct {
+	path    string
+	file    vaultFile
+	key     *memguard.Enclave
+	entries map[string]*memguard.Enclave
+}
+
+func DefaultPath() string {
+	if p := os.Getenv(PathEnv); p != "" {
+		return p
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".fkme", "vault")
+}
+
+func IsRef(s string) bool {
+	return strings.HasPrefix(s, Prefix)
+}
+
+func deriveKey(pass []byte, f *vaultFile) (*memguard.Enclave, error) {
+	key, err := scrypt.Key(pass, f.Salt, f.N, f.R, f.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	return memguard.NewEnclave(key), nil // key 会被清零
+}
+
+func (v *Vault) aead() (cipher.AEAD, *memguard.LockedBuffer, error) {
+	key, err := v.key.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key.Bytes())
+	if err != nil {
+		key.Destroy()
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		key.Destroy()
+		return nil, nil, err
+	}
+	return gcm, key, nil
+}
+
+// 附加数据, 防止文件头被篡改
+func (f *vaultFile) ad() []byte {
+	return []byte(fmt.Sprintf("fkme-vault:%d:%s:%d:%d:%d", f.Version, f.KDF, f.N, f.R, f.P))
+}
+
+/*
+打开凭据库, 文件不存在时返回空的库, Save 时创建
+*/
+func Open(path string, pass []byte) (*Vault, error) {
+	v := &Vault{path: path, entries: map[string]*memguard.Enclave{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		v.file = vaultFile{Version: fileVersion, KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP,
+			Salt: make([]byte, 16)}
+		if _, err := rand.Read(v.file.Salt); err != nil {
+			return nil, err
+		}
+		v.key, err = deriveKey(pass, &v.file)
+		return v, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &v.file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if (v.file.Version != 1 && v.file.Version != fileVersion) || v.file.KDF != "scrypt" {
+		return nil, fmt.Errorf("%s: unsupported vault version %d / %s", path, v.file.Version, v.file.KDF)
+	}
+	if v.key, err = deriveKey(pass, &v.file); err != nil {
+		return nil, err
+	}
+	gcm, key, err := v.aead()
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+	plain, err := gcm.Open(nil, v.file.Nonce, v.file.Data, v.file.ad())
+	if err != nil {
+		return nil, ErrWrongPass
+	}
+	buf := memguard.NewBufferFromBytes(plain) // plain 会被清零
+	defer buf.Destroy()
+	if v.file.Version == 1 {
+		m := map[string]string{}
+		if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+			return nil, err
+		}
+		for name, value := range m {
+			v.entries[name] = memguard.NewEnclave([]byte(value))
+		}
+		return v, nil
+	}
+	m := map[string][]byte{} // base64 解码到新的 []byte, NewEnclave 后清零
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		return nil, err
+	}
+	for name, value := range m {
+		v.entries[name] = memguard.NewEnclave(value)
+	}
+	return v, nil
+}
+
+// 修改主密码, Save 后生效
+func (v *Vault) SetPass(pass []byte) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	v.file.Salt = salt
+	key, err := deriveKey(pass, &v.file)
+	if err != nil {
+		return err
+	}
+	v.key = key
+	return nil
+}
+
+func (v *Vault) Path() string {
+	return v.path
+}
+
+func (v *Vault) Names() []string {
+	names := make([]string, 0, len(v.entries))
+	for name := range v.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 返回解密后的值, 调用者用完后 Destroy
+func (v *Vault) Get(name string) (*memguard.LockedBuffer, error) {
+	e, ok := v.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	if e == nil { // 空值, NewEnclave 返回 nil
+		return memguard.NewBuffer(0), nil
+	}
+	return e.Open()
+}
+
+// value 会被清零
+func (v *Vault) Set(name string, value []byte) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("invalid vault entry name: %q", name)
+	}
+	v.entries[name] = memguard.NewEnclave(value)
+	return nil
+}
+
+func (v *Vault) Remove(name string) error {
+	if _, ok := v.entries[name]; !ok {
+		return fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	delete(v.entries, name)
+	return nil
+}
+
+/*
+加密后写入文件, 先写临时文件再改名, 权限 0600
+*/
+func (v *Vault) Save() error {
+	buf, err := v.plain()
+	if err != nil {
+		return err
+	}
+	defer buf.Destroy()
+
+	v.file.Version = fileVersion
+	gcm, key, err := v.aead()
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+	v.file.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(v.file.Nonce); err != nil {
+		return err
+	}
+	v.file.Data = gcm.Seal(nil, v.file.Nonce, buf.Bytes(), v.file.ad())
+	b, err := json.MarshalIndent(&v.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(v.path), 0700); err != nil {
+		return err
+	}
+	tmp := v.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.path)
+}
+
+/*
+明文 {name: base64(value)}, 直接写入 LockedBuffer, 值不经过 string 和 json.Marshal 的缓冲
+*/
+func (v *Vault) plain() (*memguard.LockedBuffer, error) {
+	names := v.Names()
+	keys := make([][]byte, len(names))
+	bufs := make([]*memguard.LockedBuffer, len(names))
+	defer func() {
+		for _, b := range bufs {
+			if b != nil {
+				b.Destroy()
+			}
+		}
+	}()
+	size := 2 // {}
+	for i, name := range names {
+		k, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = k
+		if bufs[i], err = v.Get(name); err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			size++ // ,
+		}
+		size += len(k) + 3 + base64.StdEncoding.EncodedLen(bufs[i].Size()) // "name":"value"
+	}
+	out := memguard.NewBuffer(size)
+	b := out.Bytes()
+	n := copy(b, "{")
+	for i := range names {
+		if i > 0 {
+			n += copy(b[n:], ",")
+		}
+		n += copy(b[n:], keys[i])
+		n += copy(b[n:], `:"`)
+		base64.StdEncoding.Encode(b[n:], bufs[i].Bytes())
+		n += base64.StdEncoding.EncodedLen(bufs[i].Size())
+		n += copy(b[n:], `"`)
+	}
+	copy(b[n:], "}")
+	return out, nil
+}
+
+var (
+	defaultMu    sync.Mutex
+	defaultVault *Vault
+)
+
+/*
+打开默认的凭据库, 只打开一次, 主密码来自 FKME_VAULT_PASS 或终端输入
+*/
+func Default() (*Vault, error) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultVault != nil {
+		return defaultVault, nil
+	}
+	path := DefaultPath()
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("vault %s: %v", path, err)
+	}
+	pass, err := Passphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	defer pass.Destroy()
+	v, err := Open(path, pass.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defaultVault = v
+	return v, nil
+}
+
+/*
+s 为 vault:<name> 时返回默认凭据库中的值, 否则原样返回
+返回 string 用于 ssh 密码等只接受 string 的参数, 不需要 string 时用 Get
+*/
+func Resolve(s string) (string, error) {
+	if !IsRef(s) {
+		return s, nil
+	}
+	v, err := Default()
+	if err != nil {
+		return "", err
+	}
+	buf, err := v.Get(strings.TrimPrefix(s, Prefix))
+	if err != nil {
+		return "", err
+	}
+	defer buf.Destroy()
+	return string(buf.Bytes()), nil
+}
@@ -0,0 +1,148 @@
+package vault
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempVault(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "vault")
+}
+
+func TestVaultRoundTrip(t *testing.T) {
+	path := tempVault(t)
+	values := map[string]string{
+		"od":    "app/secret@10.1.1.5:22",
+		"key":   "-----BEGIN KEY-----\n\"quoted\"\x00\xff\n",
+		"empty": "",
+		"中文名":   "值",
+	}
+	v, err := Open(path, []byte("pw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range values {
+		if err := v.Set(name, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("vault file mode: %v, %v", fi, err)
+	}
+
+	v, err = Open(path, []byte("pw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Names()) != len(values) {
+		t.Errorf("names: %v", v.Names())
+	}
+	for name, value := range values {
+		buf, err := v.Get(name)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", name, err)
+		}
+		if string(buf.Bytes()) != value {
+			t.Errorf("Get(%q) = %q, want %q", name, buf.Bytes(), value)
+		}
+		buf.Destroy()
+	}
+	if _, err := v.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(missing) = %v, want ErrNotFound", err)
+	}
+	if err := v.Set("bad name", []byte("x")); err == nil {
+		t.Errorf("Set(bad name) should fail")
+	}
+
+	// 删除后再保存
+	v.Remove("od")
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	v, err = Open(path, []byte("pw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Get("od"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("od not removed: %v", err)
+	}
+}
+
+func TestVaultWrongPass(t *testing.T) {
+	path := tempVault(t)
+	v, err := Open(path, []byte("pw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Set("od", []byte("secret"))
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, []byte("wrong")); err != ErrWrongPass {
+		t.Errorf("Open with wrong passphrase = %v, want ErrWrongPass", err)
+	}
+
+	// 修改文件头也无法解密
+	b, _ := ioutil.ReadFile(path)
+	f := vaultFile{}
+	json.Unmarshal(b, &f)
+	f.N = 1 << 14
+	b, _ = json.Marshal(&f)
+	ioutil.WriteFile(path, b, 0600)
+	if _, err := Open(path, []byte("pw")); err != ErrWrongPass {
+		t.Errorf("Open with changed header = %v, want ErrWrongPass", err)
+	}
+}
+
+func TestVaultVersion1(t *testing.T) {
+	path := tempVault(t)
+	v := &Vault{path: path, file: vaultFile{Version: 1, KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP,
+		Salt: make([]byte, 16)}}
+	rand.Read(v.file.Salt)
+	var err error
+	if v.key, err = deriveKey([]byte("pw"), &v.file); err != nil {
+		t.Fatal(err)
+	}
+	gcm, key, err := v.aead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := json.Marshal(map[string]string{"od": "secret"})
+	v.file.Nonce = make([]byte, gcm.NonceSize())
+	rand.Read(v.file.Nonce)
+	v.file.Data = gcm.Seal(nil, v.file.Nonce, plain, v.file.ad())
+	key.Destroy()
+	b, _ := json.Marshal(&v.file)
+	ioutil.WriteFile(path, b, 0600)
+
+	for i := 0; i < 2; i++ { // 第二次读取 Save 升级后的 version 2
+		v, err = Open(path, []byte("pw"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := v.Get("od")
+		if err != nil || string(buf.Bytes()) != "secret" {
+			t.Fatalf("version %d: Get(od) = %v", v.file.Version, err)
+		}
+		buf.Destroy()
+		if err := v.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v.file.Version != fileVersion {
+		t.Errorf("version %d after Save", v.file.Version)
+	}
+}
@@ -0,0 +1,154 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+/*
+http(s) 只读端点
+  - 目录: 以 / 结尾的地址, 或者请求后被重定向到以 / 结尾的地址
+  - 目录列表: 解析 html 中指向下一级的链接(nginx autoindex, python -m http.server, go http.FileServer 等)
+  - 文件大小和修改时间: HEAD 请求的 Content-Length 和 Last-Modified
+*/
+type HTTP struct {
+	base   *url.URL // scheme, host, 认证
+	client *http.Client
+}
+
+func NewHTTP(u *url.URL) *HTTP {
+	base := *u
+	base.Path, base.RawQuery, base.Fragment = "", "", ""
+	return &HTTP{base: &base, client: &http.Client{}}
+}
+
+func (h *HTTP) url(name string) string {
+	u := *h.base
+	u.User = nil
+	u.Path = name
+	return u.String()
+}
+
+func (h *HTTP) do(method, name string) (*http.Response, error) {
+	req, err := http.NewRequest(method, h.url(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.base.User != nil {
+		pass, _ := h.base.User.Password()
+		req.SetBasicAuth(h.base.User.Username(), pass)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: method, Path: name, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, name, resp.Status)
+	}
+	return resp, nil
+}
+
+func (h *HTTP) Stat(name string) (os.FileInfo, error) {
+	resp, err := h.do("HEAD", name)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return respInfo(path.Base(name), resp), nil
+}
+
+func respInfo(name string, resp *http.Response) *fileInfo {
+	info := &fileInfo{name: name, size: resp.ContentLength}
+	if strings.HasSuffix(resp.Request.URL.Path, "/") {
+		info.dir, info.size = true, 0
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.mtime = t
+	}
+	return info
+}
+
+var hrefPattern = regexp.MustCompile(`(?i)href\s*=\s*["']([^"'?#]+)["']`)
+
+func (h *HTTP) ReadDir(name string) ([]os.FileInfo, error) {
+	dir := strings.TrimSuffix(name, "/") + "/"
+	resp, err := h.do("GET", dir)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	files := []os.FileInfo{}
+	for _, m := range hrefPattern.FindAllStringSubmatch(string(body), -1) {
+		link, err := url.PathUnescape(m[1])
+		if err != nil || strings.Contains(link, "://") {
+			continue
+		}
+		link = strings.TrimPrefix(link, dir) // 有些服务生成绝对路径
+		isDir := strings.HasSuffix(link, "/")
+		link = strings.TrimSuffix(link, "/")
+		if link == "" || link == "." || link == ".." || strings.Contains(link, "/") || seen[link] {
+			continue
+		}
+		seen[link] = true
+		if isDir {
+			files = append(files, &fileInfo{name: link, dir: true})
+			continue
+		}
+		info, err := h.Stat(dir + link)
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+func (h *HTTP) Open(name string) (io.ReadCloser, error) {
+	resp, err := h.do("GET", name)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (h *HTTP) Create(name string) (io.WriteCloser, error) {
+	return nil, ErrReadOnly
+}
+
+func (h *HTTP) MkdirAll(name string) error {
+	return ErrReadOnly
+}
+
+func (h *HTTP) Remove(name string) error {
+	return ErrReadOnly
+}
+
+func (h *HTTP) Rename(oldname, newname string) error {
+	return ErrReadOnly
+}
+
+func (h *HTTP) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+func (h *HTTP) String() string {
+	return h.base.Redacted()
+}
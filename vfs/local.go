@@ -0,0 +1,52 @@
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 本地磁盘
+type Local struct{}
+
+func (Local) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(filepath.FromSlash(name))
+}
+
+func (Local) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(filepath.FromSlash(name))
+}
+
+func (Local) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.FromSlash(name))
+}
+
+func (Local) Create(name string) (io.WriteCloser, error) {
+	return os.Create(filepath.FromSlash(name))
+}
+
+func (Local) MkdirAll(name string) error {
+	return os.MkdirAll(filepath.FromSlash(name), 0755)
+}
+
+func (Local) Remove(name string) error {
+	return os.Remove(filepath.FromSlash(name))
+}
+
+func (Local) Rename(oldname, newname string) error {
+	return os.Rename(filepath.FromSlash(oldname), filepath.FromSlash(newname))
+}
+
+func (Local) Chtimes(name string, mtime time.Time) error {
+	return os.Chtimes(filepath.FromSlash(name), mtime, mtime)
+}
+
+func (Local) Close() error {
+	return nil
+}
+
+func (Local) String() string {
+	return "local"
+}
@@ -0,0 +1,68 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+/*
+sftp 端点, 连接由调用者建立和关闭
+*/
+type SFTP struct {
+	Client *sftp.Client
+	Name   string // 用于显示, 如 user@host
+}
+
+func NewSFTP(client *sftp.Client, name string) *SFTP {
+	return &SFTP{Client: client, Name: name}
+}
+
+func (s *SFTP) Stat(name string) (os.FileInfo, error) {
+	return s.Client.Stat(name)
+}
+
+func (s *SFTP) ReadDir(name string) ([]os.FileInfo, error) {
+	return s.Client.ReadDir(name)
+}
+
+func (s *SFTP) Open(name string) (io.ReadCloser, error) {
+	return s.Client.Open(name)
+}
+
+func (s *SFTP) Create(name string) (io.WriteCloser, error) {
+	return s.Client.Create(name)
+}
+
+func (s *SFTP) MkdirAll(name string) error {
+	return s.Client.MkdirAll(name)
+}
+
+func (s *SFTP) Remove(name string) error {
+	return s.Client.Remove(name)
+}
+
+// 服务端支持时使用 posix-rename, 可以覆盖已存在的文件
+func (s *SFTP) Rename(oldname, newname string) error {
+	if _, ok := s.Client.HasExtension("posix-rename@openssh.com"); ok {
+		return s.Client.PosixRename(oldname, newname)
+	}
+	if _, err := s.Client.Stat(newname); err == nil {
+		s.Client.Remove(newname)
+	}
+	return s.Client.Rename(oldname, newname)
+}
+
+func (s *SFTP) Chtimes(name string, mtime time.Time) error {
+	return s.Client.Chtimes(name, mtime, mtime)
+}
+
+func (s *SFTP) Close() error {
+	return nil
+}
+
+func (s *SFTP) String() string {
+	return "sftp://" + s.Name
+}
@@ -0,0 +1,401 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+/*
+在任意两个文件系统之间同步, 数据经过本进程中转(远端到远端也可以)
+
+  Plan    比较源和目标, 生成需要执行的操作
+  Apply   执行操作
+  Sync    Plan + Apply
+  Copy    按 scp 的规则确定目标路径后全部复制
+  Verify  检查目标与源是否一致
+
+	src, spath, _ := vfs.OpenURL("https://mirror.example.com/pub/data/")
+	dst := vfs.NewSFTP(client, "user@host")
+	actions, _ := vfs.Plan(src, spath, dst, "/data/mirror", &vfs.Options{Delete: true})
+	stats, err := vfs.Apply(src, dst, actions, nil)
+*/
+type Options struct {
+	Delete   bool // 删除目标中源没有的文件
+	ModTime  bool // 大小相同时, 源文件比目标新也复制
+	Force    bool // 不比较, 全部复制
+	Checksum bool // Verify 时比较文件内容的 sha256
+
+	Match    func(rel string, info os.FileInfo) bool // 返回 false 的文件或目录不处理, rel 为相对路径
+	Before   func(a Action) error                    // 覆盖或删除目标文件之前调用, 例如保留旧版本
+	Progress func(a Action, err error)               // 每个操作完成后调用
+}
+
+const (
+	OpMkdir  = "mkdir"
+	OpCopy   = "copy"
+	OpDelete = "delete"
+)
+
+type Action struct {
+	Op     string
+	Src    string // 源路径, delete 时为空
+	Dst    string
+	Size   int64
+	Exists bool   // 目标已经存在
+	Reason string // 复制或删除的原因, 用于显示
+}
+
+func (a Action) String() string {
+	switch a.Op {
+	case OpCopy:
+		return fmt.Sprintf("copy   %s -> %s (%d bytes, %s)", a.Src, a.Dst, a.Size, a.Reason)
+	case OpDelete:
+		return fmt.Sprintf("delete %s (%s)", a.Dst, a.Reason)
+	}
+	return fmt.Sprintf("mkdir  %s", a.Dst)
+}
+
+type Stats struct {
+	Files   int
+	Bytes   int64
+	Dirs    int
+	Deleted int
+	Errors  int
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("%d files (%d bytes) copied, %d dirs created, %d deleted, %d errors",
+		s.Files, s.Bytes, s.Dirs, s.Deleted, s.Errors)
+}
+
+func (o *Options) match(rel string, info os.FileInfo) bool {
+	return o.Match == nil || o.Match(rel, info)
+}
+
+// 是否需要复制, 返回原因
+func (o *Options) changed(s, d os.FileInfo) string {
+	switch {
+	case d == nil:
+		return "new"
+	case o.Force:
+		return "force"
+	case d.IsDir():
+		return "replace dir"
+	case s.Size() < 0: // 大小未知(http chunked), 只能比较修改时间, 复制后目标的时间与源相同
+		if s.ModTime().IsZero() || s.ModTime().After(d.ModTime()) {
+			return "size unknown"
+		}
+		return ""
+	case s.Size() != d.Size():
+		return "size"
+	case o.ModTime && !s.ModTime().IsZero() && s.ModTime().After(d.ModTime()):
+		return "newer"
+	}
+	return ""
+}
+
+/*
+比较 srcPath 与 dstPath(目录或文件), 生成操作列表
+目标目录中的文件按目录一次列出, 远端时比逐个 Stat 快
+*/
+func Plan(src FS, srcPath string, dst FS, dstPath string, opts *Options) ([]Action, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	sinfo, err := src.Stat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	dinfo, err := dst.Stat(dstPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if !sinfo.IsDir() {
+		actions := []Action{}
+		if reason := opts.changed(sinfo, dinfo); reason != "" {
+			actions = append(actions, Action{Op: OpCopy, Src: srcPath, Dst: dstPath,
+				Size: sinfo.Size(), Exists: dinfo != nil, Reason: reason})
+		}
+		return actions, nil
+	}
+	p := &planner{src: src, dst: dst, opts: opts}
+	if dinfo == nil {
+		p.add(Action{Op: OpMkdir, Dst: dstPath})
+	}
+	err = p.dir(srcPath, dstPath, "", dinfo != nil)
+	return p.actions, err
+}
+
+type planner struct {
+	src, dst FS
+	opts     *Options
+	actions  []Action
+}
+
+func (p *planner) add(a Action) {
+	p.actions = append(p.actions, a)
+}
+
+func (p *planner) dir(srcDir, dstDir, rel string, dstExists bool) error {
+	sfiles, err := p.src.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+	dfiles := map[string]os.FileInfo{}
+	if dstExists {
+		list, err := p.dst.ReadDir(dstDir)
+		if err != nil {
+			return err
+		}
+		for _, f := range list {
+			dfiles[f.Name()] = f
+		}
+	}
+	seen := map[string]bool{}
+	subdirs := []os.FileInfo{}
+	for _, s := range sfiles {
+		seen[s.Name()] = true // 不处理的文件也不删除
+		if !p.opts.match(path.Join(rel, s.Name()), s) {
+			continue
+		}
+		d := dfiles[s.Name()]
+		dpath := path.Join(dstDir, s.Name())
+		if s.IsDir() {
+			if d != nil && !d.IsDir() {
+				p.add(Action{Op: OpDelete, Dst: dpath, Exists: true, Reason: "replace file with dir"})
+				d = nil
+			}
+			if d == nil {
+				p.add(Action{Op: OpMkdir, Dst: dpath})
+			}
+			subdirs = append(subdirs, s)
+			continue
+		}
+		if reason := p.opts.changed(s, d); reason != "" {
+			if d != nil && d.IsDir() {
+				p.add(Action{Op: OpDelete, Dst: dpath, Exists: true, Reason: reason})
+			}
+			p.add(Action{Op: OpCopy, Src: path.Join(srcDir, s.Name()), Dst: dpath,
+				Size: s.Size(), Exists: d != nil && !d.IsDir(), Reason: reason})
+		}
+	}
+	if p.opts.Delete {
+		for name, d := range dfiles {
+			if !seen[name] && p.opts.match(path.Join(rel, name), d) {
+				p.add(Action{Op: OpDelete, Dst: path.Join(dstDir, name), Exists: true, Reason: "not in source"})
+			}
+		}
+	}
+	for _, s := range subdirs {
+		d := dfiles[s.Name()]
+		err := p.dir(path.Join(srcDir, s.Name()), path.Join(dstDir, s.Name()), path.Join(rel, s.Name()),
+			d != nil && d.IsDir())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 执行操作, 单个文件失败时继续, 返回最后一个错误
+func Apply(src, dst FS, actions []Action, opts *Options) (*Stats, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	stats := &Stats{}
+	var last error
+	for _, a := range actions {
+		var err error
+		switch a.Op {
+		case OpMkdir:
+			if err = dst.MkdirAll(a.Dst); err == nil {
+				stats.Dirs++
+			}
+		case OpCopy:
+			if a.Exists && opts.Before != nil {
+				err = opts.Before(a)
+			}
+			if err == nil {
+				var n int64
+				if n, err = CopyFile(src, a.Src, dst, a.Dst); err == nil {
+					stats.Files++
+					stats.Bytes += n
+				}
+			}
+		case OpDelete:
+			if opts.Before != nil {
+				err = opts.Before(a)
+			}
+			if err == nil {
+				if err = RemoveAll(dst, a.Dst); err == nil {
+					stats.Deleted++
+				}
+			}
+		}
+		if err != nil {
+			stats.Errors++
+			last = fmt.Errorf("%s %s: %v", a.Op, a.Dst, err)
+		}
+		if opts.Progress != nil {
+			opts.Progress(a, err)
+		}
+	}
+	return stats, last
+}
+
+func Sync(src FS, srcPath string, dst FS, dstPath string, opts *Options) (*Stats, error) {
+	actions, err := Plan(src, srcPath, dst, dstPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	return Apply(src, dst, actions, opts)
+}
+
+// 复制单个文件, 目标支持 Chtimer 时保留修改时间
+func CopyFile(src FS, srcPath string, dst FS, dstPath string) (int64, error) {
+	r, err := src.Open(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	w, err := dst.Create(dstPath)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, r)
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return n, err
+	}
+	if ct, ok := dst.(Chtimer); ok {
+		if info, err := src.Stat(srcPath); err == nil && !info.ModTime().IsZero() {
+			ct.Chtimes(dstPath, info.ModTime())
+		}
+	}
+	return n, nil
+}
+
+/*
+按 scp 的规则确定目标路径:
+  [dir]  -> <path> 不存在 => <path>/
+  [dir]  -> <path> 目录   => <path>/basename([dir])/
+  [file] -> <path> 不存在或文件 => <path>
+  [file] -> <path> 目录   => <path>/basename([file])
+*/
+func Target(src FS, srcPath string, dst FS, dstPath string) (string, error) {
+	if _, err := src.Stat(srcPath); err != nil {
+		return "", err
+	}
+	dinfo, err := dst.Stat(dstPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dstPath, nil
+		}
+		return "", err
+	}
+	if dinfo.IsDir() {
+		return path.Join(dstPath, path.Base(srcPath)), nil
+	}
+	return dstPath, nil
+}
+
+// 按 Target 的规则复制, opts 为空时全部覆盖
+func Copy(src FS, srcPath string, dst FS, dstPath string, opts *Options) (*Stats, error) {
+	if opts == nil {
+		opts = &Options{Force: true}
+	}
+	target, err := Target(src, srcPath, dst, dstPath)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := src.Stat(srcPath); err == nil && !info.IsDir() {
+		dst.MkdirAll(path.Dir(target))
+	}
+	return Sync(src, srcPath, dst, target, opts)
+}
+
+type Mismatch struct {
+	Path   string // 相对路径
+	Reason string
+}
+
+/*
+检查目标中的文件与源是否一致: 缺少、大小不同, Checksum 时比较内容的 sha256
+*/
+func Verify(src FS, srcPath string, dst FS, dstPath string, opts *Options) ([]Mismatch, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	ret := []Mismatch{}
+	err := Walk(src, srcPath, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := relPath(srcPath, name)
+		if rel != "" {
+			if !opts.match(rel, info) {
+				if info.IsDir() {
+					return SkipDir
+				}
+				return nil
+			}
+		}
+		if info.IsDir() {
+			return nil
+		}
+		dpath := path.Join(dstPath, rel)
+		dinfo, err := dst.Stat(dpath)
+		switch {
+		case err != nil:
+			ret = append(ret, Mismatch{rel, err.Error()})
+		case dinfo.IsDir():
+			ret = append(ret, Mismatch{rel, "is a directory"})
+		case info.Size() >= 0 && dinfo.Size() != info.Size():
+			ret = append(ret, Mismatch{rel, fmt.Sprintf("size %d != %d", dinfo.Size(), info.Size())})
+		case opts.Checksum:
+			s1, err := checksum(src, name)
+			if err != nil {
+				return err
+			}
+			s2, err := checksum(dst, dpath)
+			if err != nil {
+				ret = append(ret, Mismatch{rel, err.Error()})
+			} else if !bytes.Equal(s1, s2) {
+				ret = append(ret, Mismatch{rel, "sha256 differs"})
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func relPath(root, name string) string {
+	root, name = path.Clean(root), path.Clean(name)
+	switch {
+	case root == name:
+		return ""
+	case root == ".":
+		return name
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+}
+
+func checksum(fs FS, name string) ([]byte, error) {
+	r, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,206 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func tempDirs(t *testing.T) (string, string) {
+	src, err := ioutil.TempDir("", "vfs-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := ioutil.TempDir("", "vfs-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(src)
+		os.RemoveAll(dst)
+	})
+	return filepath.ToSlash(src), filepath.ToSlash(dst)
+}
+
+// 操作简写为 "op rel", 按顺序
+func actionList(actions []Action, dst string) string {
+	ret := []string{}
+	for _, a := range actions {
+		ret = append(ret, a.Op+" "+strings.TrimPrefix(strings.TrimPrefix(a.Dst, dst), "/"))
+	}
+	return strings.Join(ret, ", ")
+}
+
+func TestPlan(t *testing.T) {
+	cases := []struct {
+		name string
+		src  map[string]string
+		dst  map[string]string
+		opts Options
+		want string
+	}{
+		{"empty dst", map[string]string{"a": "1", "d/b": "2"}, nil, Options{},
+			"copy a, mkdir d, copy d/b"},
+		{"same size", map[string]string{"a": "1", "b": "22"}, map[string]string{"a": "x", "b": "2"}, Options{},
+			"copy b"},
+		{"force", map[string]string{"a": "1"}, map[string]string{"a": "x"}, Options{Force: true},
+			"copy a"},
+		{"delete", map[string]string{"a": "1"}, map[string]string{"a": "1", "old": "x", "d/c": "y"},
+			Options{Delete: true}, "delete d, delete old"},
+		{"no delete", map[string]string{"a": "1"}, map[string]string{"old": "x"}, Options{},
+			"copy a"},
+		{"file to dir", map[string]string{"a/b": "1"}, map[string]string{"a": "x"}, Options{},
+			"delete a, mkdir a, copy a/b"},
+		{"match", map[string]string{"a": "1", "skip/b": "2", "c.tmp": "3"}, map[string]string{"c.tmp": "old"},
+			Options{Delete: true, Match: func(rel string, info os.FileInfo) bool {
+				return rel != "skip" && !strings.HasSuffix(rel, ".tmp")
+			}}, "copy a"},
+	}
+	for _, c := range cases {
+		src, dst := tempDirs(t)
+		writeFiles(t, src, c.src)
+		writeFiles(t, dst, c.dst)
+		actions, err := Plan(Local{}, src, Local{}, dst, &c.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		// delete 的顺序来自 map, 排序后比较
+		sort.SliceStable(actions, func(i, j int) bool {
+			return actions[i].Op == OpDelete && actions[j].Op == OpDelete && actions[i].Dst < actions[j].Dst
+		})
+		if got := actionList(actions, dst); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPlanNewDir(t *testing.T) {
+	src, dst := tempDirs(t)
+	writeFiles(t, src, map[string]string{"a": "1"})
+	actions, err := Plan(Local{}, src, Local{}, dst+"/new", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actionList(actions, dst); got != "mkdir new, copy new/a" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	src, dst := tempDirs(t)
+	writeFiles(t, src, map[string]string{"a": "1", "d/b": "22", "d/e/c": "333"})
+	writeFiles(t, dst, map[string]string{"a": "x", "d/b": "old", "gone": "x"})
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(filepath.Join(src, "d", "b"), mtime, mtime)
+
+	before := []string{}
+	opts := &Options{Delete: true, Before: func(a Action) error {
+		before = append(before, a.Op+" "+strings.TrimPrefix(a.Dst, dst+"/"))
+		return nil
+	}}
+	stats, err := Sync(Local{}, src, Local{}, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 2 || stats.Bytes != 5 || stats.Dirs != 1 || stats.Deleted != 1 || stats.Errors != 0 {
+		t.Errorf("stats: %v", stats)
+	}
+	sort.Strings(before)
+	if got := strings.Join(before, ", "); got != "copy d/b, delete gone" {
+		t.Errorf("Before called for %q", got)
+	}
+	for name, want := range map[string]string{"a": "x", "d/b": "22", "d/e/c": "333"} {
+		data, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "gone")); !os.IsNotExist(err) {
+		t.Errorf("gone not deleted: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "d", "b")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("d/b mtime not kept: %v, %v", info.ModTime(), err)
+	}
+
+	// 再次同步没有操作
+	actions, err := Plan(Local{}, src, Local{}, dst, opts)
+	if err != nil || len(actions) != 0 {
+		t.Errorf("second plan: %v, %v", actions, err)
+	}
+}
+
+func TestApplyError(t *testing.T) {
+	src, dst := tempDirs(t)
+	writeFiles(t, src, map[string]string{"a": "1", "b": "2"})
+	actions := []Action{
+		{Op: OpCopy, Src: src + "/missing", Dst: dst + "/missing"},
+		{Op: OpCopy, Src: src + "/b", Dst: dst + "/b"},
+	}
+	failed := 0
+	stats, err := Apply(Local{}, Local{}, actions, &Options{Progress: func(a Action, err error) {
+		if err != nil {
+			failed++
+		}
+	}})
+	if err == nil || stats.Errors != 1 || stats.Files != 1 || failed != 1 {
+		t.Errorf("stats %v, err %v, failed %d", stats, err, failed)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "b")); err != nil {
+		t.Errorf("b not copied after an error: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	src, dst := tempDirs(t)
+	writeFiles(t, src, map[string]string{"a": "1", "d/b": "22", "c": "333", "e": "4"})
+	writeFiles(t, dst, map[string]string{"a": "1", "d/b": "2", "c": "xyz", "extra": "x"})
+	os.MkdirAll(filepath.Join(dst, "e"), 0755)
+
+	cases := []struct {
+		opts Options
+		want string
+	}{
+		{Options{}, "d/b: size, e: is a directory"},
+		{Options{Checksum: true}, "c: sha256 differs, d/b: size, e: is a directory"},
+		{Options{Match: func(rel string, info os.FileInfo) bool { return rel != "d" }}, "e: is a directory"},
+	}
+	for _, c := range cases {
+		diffs, err := Verify(Local{}, src, Local{}, dst, &c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret := []string{}
+		for _, d := range diffs {
+			reason := d.Reason
+			if strings.HasPrefix(reason, "size") {
+				reason = "size"
+			}
+			ret = append(ret, d.Path+": "+reason)
+		}
+		sort.Strings(ret)
+		if got := strings.Join(ret, ", "); got != c.want {
+			t.Errorf("%+v: got %q, want %q", c.opts, got, c.want)
+		}
+	}
+
+	// 缺少的文件
+	os.Remove(filepath.Join(dst, "a"))
+	diffs, _ := Verify(Local{}, src, Local{}, dst, nil)
+	if len(diffs) == 0 || diffs[0].Path != "a" {
+		t.Errorf("missing a: %v", diffs)
+	}
+}
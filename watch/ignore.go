@@ -0,0 +1,70 @@
+package watch
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// 常用的忽略规则: 版本库和 IDE 目录, python 缓存, 编辑器备份文件
+func DefaultIgnores() []Matcher {
+	return []Matcher{
+		IgnoreNames(".git", ".svn", ".idea", "__pycache__"),
+		IgnoreSuffix("~"),
+	}
+}
+
+// 文件名或目录名等于 names 之一
+func IgnoreNames(names ...string) Matcher {
+	return func(path string, isDir bool) bool {
+		base := filepath.Base(path)
+		for _, n := range names {
+			if base == n {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// 文件名(不含目录)以 suffixes 之一结尾
+func IgnoreSuffix(suffixes ...string) Matcher {
+	return func(path string, isDir bool) bool {
+		if isDir {
+			return false
+		}
+		for _, s := range suffixes {
+			if strings.HasSuffix(path, s) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// 以 . 开头的文件, 不含目录(.xxx 目录中的文件不忽略)
+func IgnoreHidden() Matcher {
+	return func(path string, isDir bool) bool {
+		return !isDir && strings.HasPrefix(filepath.Base(path), ".")
+	}
+}
+
+// root 下以 prefixes 之一开头的相对路径, 例如 IgnorePrefix(root, "build", "vendor/")
+// 事件中的路径都是绝对路径, root 可以是相对路径
+func IgnorePrefix(root string, prefixes ...string) Matcher {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	return func(path string, isDir bool) bool {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return false
+		}
+		rel = filepath.ToSlash(rel)
+		for _, p := range prefixes {
+			if strings.HasPrefix(rel, filepath.ToSlash(p)) {
+				return true
+			}
+		}
+		return false
+	}
+}
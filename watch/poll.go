@@ -0,0 +1,243 @@
+package watch
+
+import (
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/*
+事件来源, fsnotify 或者定时扫描
+*/
+type backend interface {
+	Add(path string) error
+	Remove(path string) error
+	Close() error
+	events() <-chan fsnotify.Event
+	errors() <-chan error
+}
+
+type notifyBackend struct {
+	*fsnotify.Watcher
+}
+
+func (n notifyBackend) events() <-chan fsnotify.Event { return n.Events }
+func (n notifyBackend) errors() <-chan error          { return n.Errors }
+
+/*
+定时扫描目录, 用于 fsnotify 不可用的情况(NFS / CIFS, 部分容器, 超过 max_user_watches)
+每个目录保存文件名、大小、修改时间、权限的 hash, hash 不变时不比较文件列表
+目录的修改时间没有变化时(没有增删和改名)不重新列目录, 只 Lstat 已知的文件, 检查内容的修改
+修改时间的精度可能只有 1 秒, 修改时间在上次扫描前 mtimeSlack 之内的目录总是重新列出
+无法识别重命名, 重命名表现为 Remove + Create
+*/
+type poller struct {
+	interval time.Duration
+	mu       sync.Mutex
+	dirs     map[string]*dirState
+	ev       chan fsnotify.Event
+	err      chan error
+	done     chan struct{}
+	once     sync.Once
+}
+
+type dirState struct {
+	hash    uint64
+	entries map[string]entry
+	mtime   time.Time // 目录的修改时间
+	at      time.Time // 扫描时间
+}
+
+const mtimeSlack = 2 * time.Second
+
+type entry struct {
+	size  int64
+	mtime int64
+	mode  os.FileMode
+}
+
+func newPoller(interval time.Duration) *poller {
+	p := &poller{
+		interval: interval,
+		dirs:     map[string]*dirState{},
+		ev:       make(chan fsnotify.Event),
+		err:      make(chan error),
+		done:     make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *poller) events() <-chan fsnotify.Event { return p.ev }
+func (p *poller) errors() <-chan error          { return p.err }
+
+// 加入时记录当前状态, 不产生事件
+func (p *poller) Add(dir string) error {
+	st, err := readState(dir)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.dirs[dir] = st
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *poller) Remove(dir string) error {
+	p.mu.Lock()
+	delete(p.dirs, dir)
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *poller) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+func readState(dir string) (*dirState, error) {
+	at := time.Now()
+	di, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	st := &dirState{entries: make(map[string]entry, len(files)), mtime: di.ModTime(), at: at}
+	for _, f := range files {
+		st.entries[f.Name()] = newEntry(f)
+	}
+	st.hash = st.sum()
+	return st, nil
+}
+
+func newEntry(f os.FileInfo) entry {
+	return entry{size: f.Size(), mtime: f.ModTime().UnixNano(), mode: f.Mode()}
+}
+
+// 目录的修改时间没有变化时只 Lstat 已知的文件, 否则重新列出目录
+func (old *dirState) rescan(dir string) (*dirState, error) {
+	at := time.Now()
+	di, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !di.ModTime().Equal(old.mtime) || di.ModTime().After(old.at.Add(-mtimeSlack)) {
+		return readState(dir)
+	}
+	st := &dirState{entries: make(map[string]entry, len(old.entries)), mtime: old.mtime, at: at}
+	for name := range old.entries {
+		f, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			return readState(dir) // 文件已经不在, 目录的修改时间不可信
+		}
+		st.entries[name] = newEntry(f)
+	}
+	st.hash = st.sum()
+	return st, nil
+}
+
+func (st *dirState) sum() uint64 {
+	names := make([]string, 0, len(st.entries))
+	for n := range st.entries {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	h := fnv.New64a()
+	b := make([]byte, 8)
+	put := func(v uint64) {
+		for i := 0; i < 8; i++ {
+			b[i] = byte(v >> (8 * i))
+		}
+		h.Write(b)
+	}
+	for _, n := range names {
+		e := st.entries[n]
+		h.Write([]byte(n))
+		put(uint64(e.size))
+		put(uint64(e.mtime))
+		put(uint64(e.mode))
+	}
+	return h.Sum64()
+}
+
+func (p *poller) loop() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		for _, ev := range p.scan() {
+			select {
+			case p.ev <- ev:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+// 扫描所有目录, 返回变化产生的事件
+func (p *poller) scan() []fsnotify.Event {
+	p.mu.Lock()
+	dirs := make([]string, 0, len(p.dirs))
+	for d := range p.dirs {
+		dirs = append(dirs, d)
+	}
+	p.mu.Unlock()
+	sort.Strings(dirs)
+
+	events := []fsnotify.Event{}
+	for _, dir := range dirs {
+		p.mu.Lock()
+		old, ok := p.dirs[dir]
+		p.mu.Unlock()
+		if !ok {
+			continue
+		}
+		st, err := old.rescan(dir)
+		if err != nil {
+			continue // 目录已删除, 由上级目录的扫描产生 Remove
+		}
+		p.mu.Lock()
+		_, ok = p.dirs[dir]
+		if ok {
+			p.dirs[dir] = st
+		}
+		p.mu.Unlock()
+		if !ok || old.hash == st.hash {
+			continue
+		}
+		for name, e := range st.entries {
+			path := filepath.Join(dir, name)
+			o, ok := old.entries[name]
+			switch {
+			case !ok:
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+			case o.size != e.size || o.mtime != e.mtime:
+				if !e.mode.IsDir() {
+					events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+				}
+			case o.mode != e.mode:
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Chmod})
+			}
+		}
+		for name := range old.entries {
+			if _, ok := st.entries[name]; !ok {
+				events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove})
+			}
+		}
+	}
+	return events
+}
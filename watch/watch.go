@@ -0,0 +1,466 @@
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/lulugyf/fkme/logger"
+)
+
+/*
+递归监视目录下的文件变更
+
+- 新建的子目录自动加入监视, 其中已经存在的文件补发 Create 事件
+- 重命名: fsnotify 的 Rename(旧路径) + Create(新路径) 合并为一个 Rename 事件, 移出监视目录的作为 Remove
+- 防抖: 最后一个事件之后 Debounce 时间内没有新事件时一起交给 handler, 持续有事件时最多等待 MaxWait
+- 合并: Coalesce 时同一路径的多个事件合并为一个, 例如 Create+Write => Create, Create+Remove => 丢弃
+- 忽略: Ignore 中任一 Matcher 返回 true 的文件或目录不处理, 被忽略的目录不会加入监视
+- 轮询: Poll 为 true, 或者 fsnotify 无法使用(如超过 max_user_watches)时, 每 PollInterval 扫描一次目录, 见 poll.go
+
+	w, err := watch.New("/data/src", &watch.Options{
+		Debounce: 2 * time.Second,
+		Coalesce: true,
+		Ignore:   watch.DefaultIgnores(),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go w.Run(ctx, func(events []watch.Event) {
+		for _, e := range events {
+			fmt.Println(e)
+		}
+	})
+	cancel() // 停止监视
+
+只关心文件内容变化时, 使用 Files:
+	watch.Files(ctx, "/data/src", &watch.Options{Debounce: time.Second}, func(fpath string) error { ... })
+*/
+
+type Op uint32
+
+const (
+	Create Op = 1 << iota
+	Write
+	Remove
+	Rename
+	Chmod
+)
+
+func (op Op) Has(o Op) bool {
+	return op&o != 0
+}
+
+func (op Op) String() string {
+	names := []string{}
+	for i, n := range []string{"CREATE", "WRITE", "REMOVE", "RENAME", "CHMOD"} {
+		if op&(1<<uint(i)) != 0 {
+			names = append(names, n)
+		}
+	}
+	if len(names) == 0 {
+		return "NONE"
+	}
+	return strings.Join(names, "|")
+}
+
+type Event struct {
+	Path    string // 绝对路径
+	OldPath string // Rename 时的原路径
+	Op      Op
+	IsDir   bool
+}
+
+func (e Event) String() string {
+	if e.OldPath != "" {
+		return e.Op.String() + " " + e.OldPath + " => " + e.Path
+	}
+	return e.Op.String() + " " + e.Path
+}
+
+// 返回 true 表示忽略此路径
+type Matcher func(path string, isDir bool) bool
+
+type Options struct {
+	Debounce time.Duration // 0 时每个事件立即交给 handler
+	MaxWait  time.Duration // 持续有事件时最长等待时间, 默认 Debounce 的 5 倍
+	Coalesce bool          // 合并同一路径的事件
+	Ops      Op            // 需要的事件类型, 0 表示全部
+	Ignore   []Matcher
+	Queue    func(n int) // 待处理事件数变化时调用, 可用于状态显示
+
+	Poll         bool          // 强制使用轮询, 用于 NFS / CIFS 等 fsnotify 没有事件的文件系统
+	PollInterval time.Duration // 轮询间隔, 默认 2 秒
+}
+
+type Watcher struct {
+	root string
+	opts Options
+	b    backend
+	dirs map[string]bool // 已监视的目录
+	gone map[string]bool // 已删除或移走的目录, 忽略目录自身随后的重复事件
+
+	pending map[string]*Event // 等待 debounce 的事件
+	order   []string
+	out     []Event // Coalesce 为 false 时按顺序保存
+}
+
+func New(root string, opts *Options) (*Watcher, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+	w := &Watcher{root: root, dirs: map[string]bool{}, gone: map[string]bool{}, pending: map[string]*Event{}}
+	if opts != nil {
+		w.opts = *opts
+	}
+	if w.opts.MaxWait == 0 {
+		w.opts.MaxWait = w.opts.Debounce * 5
+	}
+	if w.opts.PollInterval <= 0 {
+		w.opts.PollInterval = 2 * time.Second
+	}
+	if w.opts.Poll {
+		w.b = newPoller(w.opts.PollInterval)
+	} else if fw, err := fsnotify.NewWatcher(); err != nil {
+		logger.Warn("fsnotify unavailable: %v, polling %s every %v", err, root, w.opts.PollInterval)
+		w.b = newPoller(w.opts.PollInterval)
+	} else {
+		w.b = notifyBackend{fw}
+	}
+	w.addTree(root, nil)
+	return w, nil
+}
+
+// 是否在使用轮询
+func (w *Watcher) Polling() bool {
+	_, ok := w.b.(*poller)
+	return ok
+}
+
+// fsnotify 添加监视失败时改为轮询, 已监视的目录全部转到轮询
+func (w *Watcher) fallback(err error) {
+	logger.Warn("fsnotify failed: %v, fallback to polling %s every %v", err, w.root, w.opts.PollInterval)
+	w.b.Close()
+	w.b = newPoller(w.opts.PollInterval)
+	for d := range w.dirs {
+		w.b.Add(d)
+	}
+}
+
+func (w *Watcher) Root() string {
+	return w.root
+}
+
+func (w *Watcher) ignored(path string, isDir bool) bool {
+	for _, m := range w.opts.Ignore {
+		if m(path, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// 监视目录及其子目录, found 不为空时对其中的文件调用 found
+func (w *Watcher) addTree(dir string, found func(path string, isDir bool)) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info == nil {
+			return nil
+		}
+		if path != w.root && w.ignored(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			err := w.b.Add(path)
+			if err != nil && !w.Polling() {
+				w.fallback(err)
+				err = w.b.Add(path)
+			}
+			if err != nil {
+				logger.Error("watch %s failed: %v", path, err)
+				return nil
+			}
+			w.dirs[path] = true
+			logger.Info("Watching path: %s", path)
+		}
+		if found != nil && path != dir {
+			found(path, info.IsDir())
+		}
+		return nil
+	})
+}
+
+// 目录被删除或移走, 取消它及子目录的监视
+func (w *Watcher) removeTree(dir string) {
+	prefix := dir + string(filepath.Separator)
+	for d := range w.dirs {
+		if d == dir || strings.HasPrefix(d, prefix) {
+			w.b.Remove(d)
+			delete(w.dirs, d)
+		}
+	}
+}
+
+func (w *Watcher) Close() error {
+	return w.b.Close()
+}
+
+/*
+处理事件直到 ctx 结束, handler 每次收到一批事件(Debounce 为 0 时每批一个)
+*/
+func (w *Watcher) Run(ctx context.Context, handler func(events []Event)) error {
+	defer func() { w.b.Close() }()
+
+	var (
+		renamed  *Event // 等待配对的 Rename
+		debounce <-chan time.Time
+		deadline <-chan time.Time
+		pairing  <-chan time.Time
+	)
+	flushRename := func() {
+		if renamed != nil {
+			w.push(Event{Path: renamed.Path, Op: Remove, IsDir: renamed.IsDir})
+			renamed, pairing = nil, nil
+		}
+	}
+	flush := func() {
+		events := w.take()
+		debounce, deadline = nil, nil
+		if len(events) > 0 {
+			handler(events)
+		}
+		w.queue()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err, ok := <-w.b.errors():
+			if !ok {
+				return nil
+			}
+			logger.Error("File Watch Error: %v", err)
+			continue
+		case <-pairing:
+			flushRename()
+		case <-debounce:
+			flushRename()
+			flush()
+			continue
+		case <-deadline:
+			flushRename()
+			flush()
+			continue
+		case ev, ok := <-w.b.events():
+			if !ok {
+				return nil
+			}
+			e := w.convert(ev)
+			if e == nil {
+				break
+			}
+			if e.Op == Rename {
+				flushRename()
+				renamed = e
+				pairing = time.After(100 * time.Millisecond)
+				break
+			}
+			if renamed != nil && e.Op == Create && renamed.IsDir == e.IsDir {
+				e.Op, e.OldPath = Rename, renamed.Path
+				renamed, pairing = nil, nil
+			} else {
+				flushRename()
+			}
+			w.push(*e)
+			if e.IsDir && e.Op.Has(Create|Rename) {
+				// 新目录中已有的文件(在加入监视之前创建的)
+				w.addTree(e.Path, func(path string, isDir bool) {
+					w.push(Event{Path: path, Op: Create, IsDir: isDir})
+				})
+			}
+		}
+		if w.size() == 0 {
+			continue
+		}
+		if w.opts.Debounce == 0 {
+			flush()
+			continue
+		}
+		debounce = time.After(w.opts.Debounce)
+		if deadline == nil {
+			deadline = time.After(w.opts.MaxWait)
+		}
+		w.queue()
+	}
+}
+
+// fsnotify 事件转换, 返回 nil 表示忽略
+func (w *Watcher) convert(ev fsnotify.Event) *Event {
+	path := ev.Name
+	if path == "" {
+		return nil // 已移走目录的 IN_MOVE_SELF
+	}
+	e := &Event{Path: path}
+	if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		if w.gone[path] {
+			delete(w.gone, path)
+			return nil
+		}
+		e.IsDir = w.dirs[path]
+		if e.IsDir {
+			w.removeTree(path)
+			w.gone[path] = true
+		}
+		if w.ignored(path, e.IsDir) {
+			return nil
+		}
+		e.Op = Remove
+		if ev.Op&fsnotify.Rename != 0 {
+			e.Op = Rename
+		}
+		return e
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil // 已经不存在, 后面会有 Remove 事件
+	}
+	delete(w.gone, path)
+	e.IsDir = info.IsDir()
+	if w.ignored(path, e.IsDir) {
+		return nil
+	}
+	switch {
+	case ev.Op&fsnotify.Create != 0:
+		e.Op = Create
+	case ev.Op&fsnotify.Write != 0:
+		e.Op = Write
+	case ev.Op&fsnotify.Chmod != 0:
+		e.Op = Chmod
+	default:
+		return nil
+	}
+	return e
+}
+
+func (w *Watcher) push(e Event) {
+	if !w.opts.Coalesce {
+		w.out = append(w.out, e)
+		return
+	}
+	if prev, ok := w.pending[e.OldPath]; ok && e.OldPath != "" {
+		// 重命名之前的事件转到新路径上
+		delete(w.pending, e.OldPath)
+		switch {
+		case prev.Op.Has(Create):
+			e.Op, e.OldPath = Create, ""
+		case prev.OldPath != "": // 连续重命名 A => B => C
+			e.Op, e.OldPath = prev.Op|Rename, prev.OldPath
+		case prev.Op.Has(Write):
+			e.Op |= Write
+		}
+	}
+	old, ok := w.pending[e.Path]
+	if !ok {
+		w.pending[e.Path] = &e
+		w.order = append(w.order, e.Path)
+		return
+	}
+	switch {
+	case e.Op == Remove && old.Op.Has(Create):
+		delete(w.pending, e.Path) // 临时文件
+	case e.Op == Remove && old.OldPath != "":
+		old.Path, old.OldPath, old.Op = old.OldPath, "", Remove
+		delete(w.pending, e.Path)
+		w.pending[old.Path] = old
+		w.order = append(w.order, old.Path)
+	case e.Op == Remove:
+		old.Op = Remove
+	case old.Op == Remove:
+		old.Op, old.IsDir = Write, e.IsDir // 删除后重建
+	case old.Op.Has(Create):
+		// 新文件, 之后的修改不再单独列出
+	default:
+		old.Op |= e.Op
+		if e.OldPath != "" {
+			old.OldPath = e.OldPath
+		}
+	}
+}
+
+func (w *Watcher) size() int {
+	if w.opts.Coalesce {
+		return len(w.pending)
+	}
+	return len(w.out)
+}
+
+func (w *Watcher) queue() {
+	if w.opts.Queue != nil {
+		w.opts.Queue(w.size())
+	}
+}
+
+// 取出待处理的事件, 过滤 Ops
+func (w *Watcher) take() []Event {
+	events := w.out
+	if w.opts.Coalesce {
+		events = []Event{}
+		for _, p := range w.order {
+			if e, ok := w.pending[p]; ok && e.Path == p {
+				events = append(events, *e)
+				delete(w.pending, p)
+			}
+		}
+		w.order = nil
+	}
+	w.out = nil
+	if w.opts.Ops == 0 {
+		return events
+	}
+	ret := events[:0]
+	for _, e := range events {
+		if e.Op&w.opts.Ops != 0 {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+/*
+只关心文件内容的变化: 对新建、修改、重命名后的文件(不含目录)调用 callback
+callback 中的路径总是绝对路径
+*/
+func Files(ctx context.Context, root string, opts *Options, callback func(fpath string) error) error {
+	o := Options{Coalesce: true}
+	if opts != nil {
+		o = *opts
+		o.Coalesce = true
+	}
+	o.Ops = Create | Write | Rename
+	queue := o.Queue
+	w, err := New(root, &o)
+	if err != nil {
+		return err
+	}
+	return w.Run(ctx, func(events []Event) {
+		left := len(events)
+		for _, e := range events {
+			left--
+			if !e.IsDir {
+				if err := callback(e.Path); err != nil {
+					logger.Error("callback on %s failed %v", e.Path, err)
+				}
+			}
+			if queue != nil {
+				queue(left)
+			}
+		}
+	})
+}
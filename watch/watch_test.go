@@ -0,0 +1,298 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/lulugyf/fkme/logger"
+)
+
+func init() {
+	logger.InitLogger("")
+}
+
+// 事件简写: "CREATE a", "RENAME a => b"
+func eventList(events []Event) string {
+	ret := []string{}
+	for _, e := range events {
+		ret = append(ret, e.String())
+	}
+	return strings.Join(ret, ", ")
+}
+
+func TestCoalesce(t *testing.T) {
+	cases := []struct {
+		name   string
+		events []Event
+		ops    Op
+		want   string
+	}{
+		{"create+write", []Event{{Path: "a", Op: Create}, {Path: "a", Op: Write}}, 0, "CREATE a"},
+		{"temp file", []Event{{Path: "a", Op: Create}, {Path: "a", Op: Write}, {Path: "a", Op: Remove}}, 0, ""},
+		{"write twice", []Event{{Path: "a", Op: Write}, {Path: "a", Op: Write}}, 0, "WRITE a"},
+		{"write+chmod", []Event{{Path: "a", Op: Write}, {Path: "a", Op: Chmod}}, 0, "WRITE|CHMOD a"},
+		{"write+remove", []Event{{Path: "a", Op: Write}, {Path: "a", Op: Remove}}, 0, "REMOVE a"},
+		{"remove+create", []Event{{Path: "a", Op: Remove}, {Path: "a", Op: Create}}, 0, "WRITE a"},
+		{"save via rename", []Event{{Path: "a.tmp", Op: Create}, {Path: "a", OldPath: "a.tmp", Op: Rename}}, 0,
+			"CREATE a"},
+		{"rename twice", []Event{{Path: "b", OldPath: "a", Op: Rename}, {Path: "c", OldPath: "b", Op: Rename}}, 0,
+			"RENAME a => c"},
+		{"write+rename", []Event{{Path: "a", Op: Write}, {Path: "b", OldPath: "a", Op: Rename}}, 0,
+			"WRITE|RENAME a => b"},
+		{"rename+remove", []Event{{Path: "b", OldPath: "a", Op: Rename}, {Path: "b", Op: Remove}}, 0, "REMOVE a"},
+		{"order", []Event{{Path: "b", Op: Write}, {Path: "a", Op: Write}, {Path: "b", Op: Write}}, 0,
+			"WRITE b, WRITE a"},
+		{"ops", []Event{{Path: "a", Op: Write}, {Path: "b", Op: Remove}, {Path: "c", Op: Chmod}}, Create | Write,
+			"WRITE a"},
+	}
+	for _, c := range cases {
+		w := &Watcher{pending: map[string]*Event{}, opts: Options{Coalesce: true, Ops: c.ops}}
+		for _, e := range c.events {
+			w.push(e)
+		}
+		if got := eventList(w.take()); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+		if w.size() != 0 {
+			t.Errorf("%s: %d events left after take", c.name, w.size())
+		}
+	}
+
+	// 不合并时按顺序原样输出
+	w := &Watcher{pending: map[string]*Event{}}
+	w.push(Event{Path: "a", Op: Create})
+	w.push(Event{Path: "a", Op: Write})
+	if got := eventList(w.take()); got != "CREATE a, WRITE a" {
+		t.Errorf("no coalesce: got %q", got)
+	}
+}
+
+// 由测试直接发送 fsnotify 事件的 backend
+type fakeBackend struct {
+	ev     chan fsnotify.Event
+	err    chan error
+	addErr error
+	added  []string
+}
+
+func newFake() *fakeBackend {
+	return &fakeBackend{ev: make(chan fsnotify.Event), err: make(chan error)}
+}
+
+func (f *fakeBackend) Add(path string) error {
+	if f.addErr != nil {
+		return f.addErr
+	}
+	f.added = append(f.added, path)
+	return nil
+}
+func (f *fakeBackend) Remove(path string) error      { return nil }
+func (f *fakeBackend) Close() error                  { return nil }
+func (f *fakeBackend) events() <-chan fsnotify.Event { return f.ev }
+func (f *fakeBackend) errors() <-chan error          { return f.err }
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	dir, _ = filepath.EvalSymlinks(dir)
+	return dir
+}
+
+// 用 fakeBackend 运行 Watcher, 返回收到的事件
+func runFake(t *testing.T, w *Watcher, send func(f *fakeBackend)) []Event {
+	f := newFake()
+	w.b = f
+	got := make(chan []Event, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx, func(events []Event) { got <- events })
+		close(done)
+	}()
+	send(f)
+	events := []Event{}
+	timeout := time.After(2 * time.Second)
+	for len(events) == 0 {
+		select {
+		case e := <-got:
+			events = append(events, e...)
+		case <-timeout:
+			t.Fatal("no events")
+		}
+	}
+	cancel()
+	<-done
+	return events
+}
+
+func TestRenamePairing(t *testing.T) {
+	dir := tempDir(t)
+	p := func(name string) string { return filepath.Join(dir, name) }
+	ioutil.WriteFile(p("new"), []byte("x"), 0644)
+	os.Mkdir(p("newdir"), 0755)
+
+	cases := []struct {
+		name string
+		evs  []fsnotify.Event
+		dirs []string // 已监视的目录
+		want string
+	}{
+		{"paired", []fsnotify.Event{{Name: p("old"), Op: fsnotify.Rename}, {Name: p("new"), Op: fsnotify.Create}},
+			nil, "RENAME " + p("old") + " => " + p("new")},
+		{"moved out", []fsnotify.Event{{Name: p("old"), Op: fsnotify.Rename}}, nil, "REMOVE " + p("old")},
+		{"moved in", []fsnotify.Event{{Name: p("new"), Op: fsnotify.Create}}, nil, "CREATE " + p("new")},
+		{"file and dir", []fsnotify.Event{{Name: p("old"), Op: fsnotify.Rename}, {Name: p("newdir"), Op: fsnotify.Create}},
+			nil, "REMOVE " + p("old") + ", CREATE " + p("newdir")},
+		{"dir", []fsnotify.Event{{Name: p("olddir"), Op: fsnotify.Rename}, {Name: p("newdir"), Op: fsnotify.Create}},
+			[]string{p("olddir")}, "RENAME " + p("olddir") + " => " + p("newdir")},
+	}
+	for _, c := range cases {
+		w := &Watcher{root: dir, dirs: map[string]bool{}, gone: map[string]bool{}, pending: map[string]*Event{},
+			opts: Options{Coalesce: true, Debounce: 200 * time.Millisecond, MaxWait: time.Second}}
+		for _, d := range c.dirs {
+			w.dirs[d] = true
+		}
+		events := runFake(t, w, func(f *fakeBackend) {
+			for _, ev := range c.evs {
+				f.ev <- ev
+			}
+		})
+		if got := eventList(events); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestFallbackToPoll(t *testing.T) {
+	dir := tempDir(t)
+	os.MkdirAll(filepath.Join(dir, "a", "b"), 0755)
+	os.MkdirAll(filepath.Join(dir, ".git"), 0755)
+	w := &Watcher{root: dir, dirs: map[string]bool{}, gone: map[string]bool{}, pending: map[string]*Event{},
+		opts: Options{PollInterval: time.Hour, Ignore: DefaultIgnores()}}
+	w.b = &fakeBackend{addErr: errors.New("no space left on device")}
+	w.addTree(dir, nil)
+	defer w.Close()
+	if !w.Polling() {
+		t.Fatal("not polling after fsnotify Add failed")
+	}
+	got := []string{}
+	for d := range w.b.(*poller).dirs {
+		rel, _ := filepath.Rel(dir, d)
+		got = append(got, filepath.ToSlash(rel))
+	}
+	sort.Strings(got)
+	if strings.Join(got, " ") != ". a a/b" {
+		t.Errorf("polled dirs: %v", got)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	dir := tempDir(t)
+	p := func(name string) string { return filepath.Join(dir, filepath.FromSlash(name)) }
+	ioutil.WriteFile(p("keep"), []byte("x"), 0644)
+	ioutil.WriteFile(p("gone"), []byte("x"), 0644)
+
+	w, err := New(dir, &Options{Poll: true, PollInterval: 50 * time.Millisecond, Coalesce: true,
+		Debounce: 300 * time.Millisecond, Ignore: DefaultIgnores()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.Polling() {
+		t.Fatal("Poll option ignored")
+	}
+	got := make(chan []Event, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx, func(events []Event) { got <- events })
+
+	time.Sleep(100 * time.Millisecond)
+	ioutil.WriteFile(p("new"), []byte("x"), 0644)
+	ioutil.WriteFile(p("keep"), []byte("changed"), 0644)
+	os.Remove(p("gone"))
+	os.MkdirAll(p("sub"), 0755)
+	ioutil.WriteFile(p("sub/f"), []byte("x"), 0644)
+	ioutil.WriteFile(p("skip~"), []byte("x"), 0644)
+
+	want := map[string]string{"new": "CREATE", "keep": "WRITE", "gone": "REMOVE", "sub": "CREATE", "sub/f": "CREATE"}
+	seen := map[string]string{}
+	timeout := time.After(5 * time.Second)
+	for len(seen) < len(want) {
+		select {
+		case events := <-got:
+			for _, e := range events {
+				rel, _ := filepath.Rel(dir, e.Path)
+				seen[filepath.ToSlash(rel)] = e.Op.String()
+			}
+		case <-timeout:
+			t.Fatalf("got %v, want %v", seen, want)
+		}
+	}
+	for name, op := range want {
+		if seen[name] != op {
+			t.Errorf("%s: got %s, want %s", name, seen[name], op)
+		}
+	}
+	if op, ok := seen["skip~"]; ok {
+		t.Errorf("ignored file reported: %s", op)
+	}
+
+	// 目录中新建的文件也能被扫描到
+	time.Sleep(100 * time.Millisecond)
+	ioutil.WriteFile(p("sub/g"), []byte("x"), 0644)
+	select {
+	case events := <-got:
+		if eventList(events) != "CREATE "+p("sub/g") {
+			t.Errorf("sub/g: got %q", eventList(events))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("sub/g not reported")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := tempDir(t)
+	os.Mkdir(filepath.Join(dir, "d"), 0755)
+	got := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Files(ctx, dir, &Options{Poll: true, PollInterval: 50 * time.Millisecond,
+			Debounce: 100 * time.Millisecond}, func(fpath string) error {
+			got <- fpath
+			return nil
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ioutil.WriteFile(filepath.Join(dir, "d", "a"), []byte("x"), 0644)
+	os.Mkdir(filepath.Join(dir, "e"), 0755) // 目录不回调
+	select {
+	case p := <-got:
+		if p != filepath.Join(dir, "d", "a") {
+			t.Errorf("callback on %s", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no callback")
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Files returned %v, want context.Canceled", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("extra callback on %s", <-got)
+	}
+
+	if err := Files(context.Background(), filepath.Join(dir, "missing"), nil, nil); err == nil {
+		t.Error("Files on a missing dir should fail")
+	}
+}
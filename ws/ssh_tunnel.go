@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/lulugyf/fkme/util"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -29,14 +30,18 @@ type _port struct {
 	mode     byte // '>' for forward, '<' for reverse
 	bindAddr string
 	dialAddr string
+	guard    *util.Guard // 本地监听的访问控制, 见 util/guard.go
+	audit    *util.AuditLog
+	server   string // ws 地址, 用于审计
 }
 type tunnel struct {
-	auth          []ssh.AuthMethod
-	hostKeys      ssh.HostKeyCallback
-	user          string
-	hostAddr      string
-	retryInterval time.Duration
-	keepAlive     KeepAliveConfig
+	auth      []ssh.AuthMethod
+	hostKeys  ssh.HostKeyCallback
+	user      string
+	hostAddr  string
+	retryMin  time.Duration // 重连的指数退避, 见 util/backoff.go
+	retryMax  time.Duration
+	keepAlive KeepAliveConfig
 
 	//mode     byte // '>' for forward, '<' for reverse
 	//bindAddr string
@@ -54,16 +59,24 @@ func (t _port) bind(ctx context.Context, wg *sync.WaitGroup, cl *ssh.Client) {
 
 	defer wg.Done()
 
+	if IsUDPAddr(t.bindAddr) {
+		t.bindUDP(ctx, cl)
+		return
+	}
+
 	switch t.mode {
 	case '>':
-		ln, err = net.Listen("tcp", t.bindAddr)
+		if ln, err = ListenLocal(t.bindAddr, 0); err == nil {
+			ln = t.guard.Listen(ln, t.String())
+		}
 	case '<':
-		ln, err = cl.Listen("tcp", t.bindAddr)
+		ln, err = ListenRemote(cl, t.bindAddr)
 	}
 	if err != nil {
 		once.Do(func() { fmt.Printf("(%v) bind error: %v\n", t, err) })
 		return
 	}
+	ln = t.audit.Listen(ln, t.String(), t.server, t.dialAddr)
 
 	// The socket is binded. Make sure we close it eventually.
 	bindCtx, cancel := context.WithCancel(ctx)
@@ -93,28 +106,65 @@ func (t _port) bind(ctx context.Context, wg *sync.WaitGroup, cl *ssh.Client) {
 	}
 }
 
+// udp 端口映射, 见 udp.go
+func (t _port) bindUDP(ctx context.Context, cl *ssh.Client) {
+	if t.mode != '>' {
+		fmt.Printf("(%v) bind error: udp is only supported on the local side\n", t)
+		return
+	}
+	pc, err := ListenUDP(t.bindAddr)
+	if err != nil {
+		fmt.Printf("(%v) bind error: %v\n", t, err)
+		return
+	}
+	pc = t.guard.ListenPacket(pc, t.String())
+	bindCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		cl.Wait()
+		cancel()
+	}()
+
+	fmt.Printf("(%v) binded tunnel\n", t)
+	defer fmt.Printf("(%v) collapsed tunnel\n", t)
+	if err := ServeUDP(bindCtx, pc, cl, t.dialAddr); err != nil {
+		fmt.Printf("(%v) accept error: %v\n", t, err)
+	}
+}
+
 func (t _port) dialTunnel(ctx context.Context, wg *sync.WaitGroup, client *ssh.Client, cn1 net.Conn) {
 	defer wg.Done()
 
 	// The inbound connection is established. Make sure we close it eventually.
 	connCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	ac := util.AuditOf(cn1)
 	go func() {
 		<-connCtx.Done()
+		if ctx.Err() != nil {
+			ac.SetReason("tunnel closed")
+		}
 		cn1.Close()
 	}()
 
+	// 连接中是加帧头的数据报, 由本地转发到 udp 目标
+	if t.mode == '<' && IsUDPAddr(t.dialAddr) {
+		util.RelayUDP(cn1, t.dialAddr[len(udpPrefix):], 0)
+		return
+	}
+
 	// Establish the outbound connection.
-	var cn2 net.Conn
+	var cn2 io.ReadWriteCloser
 	var err error
 	switch t.mode {
 	case '>':
-		cn2, err = client.Dial("tcp", t.dialAddr)
+		cn2, err = DialRemoteStream(client, t.dialAddr)
 	case '<':
-		cn2, err = net.Dial("tcp", t.dialAddr)
+		cn2, err = DialLocal(t.dialAddr)
 	}
 	if err != nil {
 		fmt.Printf("(%v) dial error: %v\n", t, err)
+		ac.SetReason("dial error: " + err.Error())
 		return
 	}
 
@@ -133,10 +183,14 @@ func (t _port) dialTunnel(ctx context.Context, wg *sync.WaitGroup, client *ssh.C
 	go func() {
 		defer wg2.Done()
 		defer cancel()
-		if _, err := io.Copy(cn1, cn2); err != nil {
+		_, err := io.Copy(cn1, cn2)
+		if err != nil {
 			once.Do(func() { fmt.Printf("(%v) connection error: %v", t, err) })
 		}
 		once.Do(func() {}) // Suppress future errors
+		if err == nil {
+			ac.SetReason("dst closed")
+		}
 	}()
 	go func() {
 		defer wg2.Done()
@@ -149,6 +203,17 @@ func (t _port) dialTunnel(ctx context.Context, wg *sync.WaitGroup, client *ssh.C
 	wg2.Wait()
 }
 
+// 端口号加上 host, unix:/path 不变, udp:port 为 udp:host:port
+func portAddr(host, port string) string {
+	if IsUnixAddr(port) {
+		return port
+	}
+	if IsUDPAddr(port) {
+		return udpPrefix + portAddr(host, port[len(udpPrefix):])
+	}
+	return fmt.Sprintf("%s:%s", host, port)
+}
+
 func (t _port) String() string {
 	var left, right string
 	mode := "<?>"
@@ -173,56 +238,55 @@ func (t _port) String() string {
 //	return fmt.Sprintf("%s@%s | %s %s %s", t.user, t.hostAddr, left, mode, right)
 //}
 
+/*
+连接 ssh 服务, addr 为 host:port, 或者 ws:// wss:// 地址(服务端为 fkme ws -addr sshd 或映射到 sshd 的端口)
+wss 不校验证书
+*/
+func DialSSH(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if !strings.HasPrefix(addr, "ws://") && !strings.HasPrefix(addr, "wss://") {
+		return ssh.Dial("tcp", addr, config)
+	}
+	// 通过 ws 连接产生 ssh.Client
+	var InsecureWSDialer = &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	conn, _, err := InsecureWSDialer.Dial(addr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("websocket dial failed %s, %v", addr, err)
+	}
+	ws := &WS{c: conn}
+	c, chans, reqs, err := ssh.NewClientConn(ws, "127.0.0.1:22", config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ssh.NewClientConn failed: %v", err)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
 func (t tunnel) bindTunnel(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
+	bo := &util.Backoff{Min: t.retryMin, Max: t.retryMax}
 	for {
 		var once sync.Once // Only print errors once per session
+		var connected time.Time
 		func() {
 			// Connect to the server host via SSH.
-			var cl *ssh.Client = nil
-			var err error
-
-			if strings.HasPrefix(t.hostAddr, "ws://") || strings.HasPrefix(t.hostAddr, "wss://") {
-
-				// 通过 ws 连接产生 ssh.Client
-				var InsecureWSDialer = &websocket.Dialer{
-					Proxy:            http.ProxyFromEnvironment,
-					HandshakeTimeout: 45 * time.Second,
-					TLSClientConfig: &tls.Config{
-						InsecureSkipVerify: true,
-					},
-				}
-				conn, _, err := InsecureWSDialer.Dial(t.hostAddr, nil)
-				if err != nil {
-					fmt.Printf("websocket dial failed %s, %v\n", t.hostAddr, err)
-					return
-				}
-				config := &ssh.ClientConfig{
-					User:            t.user,
-					Auth:            t.auth,
-					HostKeyCallback: t.hostKeys,
-					Timeout:         5 * time.Second,
-				}
-				ws := &WS{c: conn}
-				c, chans, reqs, err := ssh.NewClientConn(ws, "127.0.0.1:22", config)
-				if err != nil {
-					fmt.Printf("ssh.NewClientConn failed: %v\n", err)
-					return
-				}
-				cl = ssh.NewClient(c, chans, reqs)
-			} else {
-				cl, err = ssh.Dial("tcp", t.hostAddr, &ssh.ClientConfig{
-					User:            t.user,
-					Auth:            t.auth,
-					HostKeyCallback: t.hostKeys,
-					Timeout:         5 * time.Second,
-				})
-				if err != nil {
-					once.Do(func() { fmt.Printf("(%v) SSH dial error: %v\n", t, err) })
-					return
-				}
+			cl, err := DialSSH(t.hostAddr, &ssh.ClientConfig{
+				User:            t.user,
+				Auth:            t.auth,
+				HostKeyCallback: t.hostKeys,
+				Timeout:         5 * time.Second,
+			})
+			if err != nil {
+				once.Do(func() { fmt.Printf("(%v) SSH dial error: %v\n", t, err) })
+				return
 			}
+			connected = time.Now()
 			wg.Add(1)
 			go t.keepAliveMonitor(&once, wg, cl)
 			defer cl.Close()
@@ -234,11 +298,17 @@ func (t tunnel) bindTunnel(ctx context.Context, wg *sync.WaitGroup) {
 			t.ports[0].bind(ctx, wg, cl)
 		}()
 
-		select {
-		case <-ctx.Done():
+		if ctx.Err() != nil {
+			return
+		}
+		// 连接保持了一段时间才断开, 不是连续的失败, 从最短的等待开始
+		if !connected.IsZero() && time.Since(connected) > time.Minute {
+			bo.Reset()
+		}
+		d := bo.Next()
+		fmt.Printf("(%v) retrying in %v...\n", t, d.Round(100*time.Millisecond))
+		if !util.Sleep(ctx, d) {
 			return
-		case <-time.After(t.retryInterval):
-			fmt.Printf("(%v) retrying...\n", t)
 		}
 	}
 }
@@ -372,8 +442,11 @@ ports 格式：
 
 	“{lport}.>.{rport}”  (local)
 	"{lport}.<.{rport}"  (remote)
+
+端口也可以是 unix:/path, 见 streamlocal.go, 或者 udp:port, 见 udp.go
+guard 用于本地监听的端口(tcp, unix 和 udp, udp 只检查来源地址), audit 记录全部端口的连接, 都可以为 nil
 */
-func WSTunnel_M(ws_url string, ports []string) {
+func WSTunnel_M(ws_url string, ports []string, guard *util.Guard, audit *util.AuditLog) {
 	var tunn tunnel
 
 	var auth []ssh.AuthMethod
@@ -388,18 +461,20 @@ func WSTunnel_M(ws_url string, ports []string) {
 	}
 	tunn.user = "_base_"
 	tunn.hostAddr = ws_url
-	tunn.retryInterval = 300 * time.Second
+	tunn.retryMin, tunn.retryMax = 5*time.Second, 300*time.Second
+	tunn.keepAlive = KeepAliveConfig{Interval: 30, CountMax: 2}
 	for _, pp := range ports {
 		var _p _port
+		_p.guard, _p.audit, _p.server = guard, audit, ws_url
 		ps := strings.Split(pp, ";")
 		_p.mode = ps[1][0] // '>' for forward, '<' for reverse
 		if _p.mode == '>' {
-			_p.bindAddr = fmt.Sprintf(":%s", ps[0]) // 监听的本地端口改为在全部IP上
-			_p.dialAddr = fmt.Sprintf("localhost:%s", ps[2])
+			_p.bindAddr = portAddr("", ps[0]) // 监听的本地端口改为在全部IP上
+			_p.dialAddr = portAddr("localhost", ps[2])
 
 		} else if _p.mode == '<' {
-			_p.bindAddr = fmt.Sprintf("localhost:%s", ps[2])
-			_p.dialAddr = fmt.Sprintf("localhost:%s", ps[0])
+			_p.bindAddr = portAddr("localhost", ps[2])
+			_p.dialAddr = portAddr("localhost", ps[0])
 		}
 		tunn.ports = append(tunn.ports, _p)
 	}
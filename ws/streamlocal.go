@@ -0,0 +1,103 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+端口映射的地址, 除了 host:port 之外也可以是 unix:/path (unix domain socket)
+本地一侧: 监听时删除残留的 socket 文件, 按 mode 设置权限, 关闭时删除
+ssh 一侧: 连接使用 direct-streamlocal@openssh.com 通道, 监听使用 streamlocal-forward@openssh.com
+远端 socket 文件由服务端创建, openssh 需要 StreamLocalBindUnlink yes 才会覆盖残留的文件
+
+	fkme tunnel: "unix:/tmp/docker.sock -> unix:/var/run/docker.sock"
+	fkme tunnel: "127.0.0.1:15432 -> unix:/var/run/postgresql/.s.PGSQL.5432"
+	fkme ws -port "unix:/tmp/docker.sock;>;unix:/var/run/docker.sock"
+*/
+const unixPrefix = "unix:"
+
+// 默认的本地 socket 权限, 只有当前用户可以连接
+const DefaultUnixMode os.FileMode = 0600
+
+// 地址对应的 network 和 address, unix:/path 为 ("unix", "/path"), 其它为 ("tcp", addr)
+func SplitAddr(addr string) (string, string) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "unix", addr[len(unixPrefix):]
+	}
+	return "tcp", addr
+}
+
+func IsUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, unixPrefix)
+}
+
+/*
+在本地监听 addr, unix socket 的权限为 mode(0 为 DefaultUnixMode)
+已经存在的 socket 文件没有进程监听时删除, 有进程监听或者不是 socket 时报错
+*/
+func ListenLocal(addr string, mode os.FileMode) (net.Listener, error) {
+	network, address := SplitAddr(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+	if mode == 0 {
+		mode = DefaultUnixMode
+	}
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", address)
+	if err != nil {
+		return nil, err
+	}
+	// net.Listen 创建的 UnixListener 在 Close 时删除 socket 文件
+	if err := os.Chmod(address, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("chmod %s: %v", address, err)
+	}
+	return ln, nil
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return errors.New(path + " is in use")
+	}
+	return os.Remove(path)
+}
+
+// 连接本地的 addr
+func DialLocal(addr string) (net.Conn, error) {
+	return net.Dial(SplitAddr(addr))
+}
+
+// 通过 ssh 连接 addr, unix socket 使用 direct-streamlocal@openssh.com
+func DialRemote(cl *ssh.Client, addr string) (net.Conn, error) {
+	return cl.Dial(SplitAddr(addr))
+}
+
+// 在 ssh 服务端监听 addr, unix socket 使用 streamlocal-forward@openssh.com
+func ListenRemote(cl *ssh.Client, addr string) (net.Listener, error) {
+	network, address := SplitAddr(addr)
+	if network == "unix" {
+		return cl.ListenUnix(address)
+	}
+	return cl.Listen(network, address)
+}
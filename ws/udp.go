@@ -0,0 +1,70 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/lulugyf/fkme/sshd"
+	"github.com/lulugyf/fkme/util"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+udp 端口映射, 地址为 udp:host:port, 数据报加上长度帧头在 ssh 通道中传输, 见 util/udp.go
+本地监听 udp 时每个来源地址打开一个通道, 空闲超时后关闭
+目标为 udp: 时使用 direct-udp@fkme 通道, 服务端需要是 fkme sshd(或者 fkme ws -addr sshd)
+目标为 tcp 地址时使用 direct-tcpip, 由目标上的 fkme pm -b "7053;udp:127.0.0.1:53" 转发, 可用于 openssh
+
+	fkme tunnel: "udp:127.0.0.1:5353 -> udp:10.0.0.2:53"
+	fkme tunnel: "udp:127.0.0.1:8125 -> 127.0.0.1:7125"   # 远端: fkme pm -b "7125;udp:127.0.0.1:8125"
+	fkme ws -port "udp:5353;>;udp:53"
+*/
+const udpPrefix = "udp:"
+
+func IsUDPAddr(addr string) bool {
+	return strings.HasPrefix(addr, udpPrefix)
+}
+
+// 通过 ssh 打开 addr 的流, udp: 地址为 direct-udp@fkme 通道, 其它同 DialRemote
+func DialRemoteStream(cl *ssh.Client, addr string) (io.ReadWriteCloser, error) {
+	if !IsUDPAddr(addr) {
+		return DialRemote(cl, addr)
+	}
+	host, port, err := net.SplitHostPort(addr[len(udpPrefix):])
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+	// 与 direct-tcpip 的格式相同, RFC 4254 7.2
+	payload := ssh.Marshal(&struct {
+		DestAddr string
+		DestPort uint32
+		OrigAddr string
+		OrigPort uint32
+	}{host, uint32(p), "127.0.0.1", 0})
+	ch, reqs, err := cl.OpenChannel(sshd.UDPChannelType, payload)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return ch, nil
+}
+
+// 在本地监听 udp 地址
+func ListenUDP(addr string) (net.PacketConn, error) {
+	return net.ListenPacket("udp", strings.TrimPrefix(addr, udpPrefix))
+}
+
+// 从 pc 接收的数据报经 cl 发往 dialAddr, 直到 ctx 结束或者 cl 断开
+func ServeUDP(ctx context.Context, pc net.PacketConn, cl *ssh.Client, dialAddr string) error {
+	return util.ServeUDP(ctx, pc, func() (io.ReadWriteCloser, error) {
+		return DialRemoteStream(cl, dialAddr)
+	}, 0)
+}
@@ -20,6 +20,9 @@ import (
 	"github.com/armon/go-socks5"
 	"github.com/gorilla/websocket"
 	"github.com/lulugyf/fkme/logger"
+	"github.com/lulugyf/fkme/sshconfig"
+	"github.com/lulugyf/fkme/sshd"
+	"github.com/lulugyf/fkme/util"
 	"go.uber.org/ratelimit"
 )
 
@@ -79,7 +82,7 @@ func (ws *WS) Read(p []byte) (int, error) {
 	} else {
 		_, message, err = ws.c.ReadMessage()
 		if err != nil {
-			return -1, err
+			return 0, err
 		}
 	}
 
@@ -94,7 +97,7 @@ func (ws *WS) Read(p []byte) (int, error) {
 func (ws *WS) Write(p []byte) (int, error) {
 	err := ws.c.WriteMessage(websocket.BinaryMessage, p)
 	if err != nil {
-		return -1, err
+		return 0, err
 	}
 	return len(p), nil
 }
@@ -138,12 +141,15 @@ func connCopy(conn net.Conn, w *websocket.Conn) {
 
 /*
 运行在 nginx 后端的 websocket server程序， 将连接转发到其后的端口或者自己启动的 socks5 服务
+ssh_srv 不为空时(-addr sshd), 连接直接由内置的 ssh 服务处理, 不需要另外监听 tcp 端口
 */
-func serveServer(port int, dst_addr string, uri_prefix string) {
+func serveServer(port int, dst_addr string, uri_prefix string, ssh_srv *sshd.Server) {
 	logger.Info("run ws server on %d  to %s", port, dst_addr)
 	var s5 *socks5.Server = nil
 	var err error
-	if dst_addr == "" || dst_addr == "s5" { // 如果目标地址为空或者 "s5", 则将连接直接转接到socks5服务, 这样这个客户端连接就直接是一个socks5代理连接
+	if ssh_srv != nil {
+		dst_addr = "sshd"
+	} else if dst_addr == "" || dst_addr == "s5" { // 如果目标地址为空或者 "s5", 则将连接直接转接到socks5服务, 这样这个客户端连接就直接是一个socks5代理连接
 		conf := &socks5.Config{}
 		s5, err = socks5.New(conf)
 		if err != nil {
@@ -170,7 +176,9 @@ func serveServer(port int, dst_addr string, uri_prefix string) {
 			return
 		}
 		logger.Info("new income ws connection, %v", conn.RemoteAddr())
-		if s5 != nil {
+		if ssh_srv != nil {
+			ssh_srv.ServeConn(&WS{c: conn})
+		} else if s5 != nil {
 			s5.ServeConn(&WS{c: conn})
 		} else {
 			cr, err := net.Dial("tcp", dst_addr)
@@ -392,6 +400,11 @@ func Run(args []string) {
 	socks := cmd.Int("socks", 0, "socks listen port")
 	http_port := cmd.Int("http", 0, "http proxy listen port")
 	cmd.Var(&ports, "port", "")
+	auth := cmd.String("auth", "", "authorized_keys file for -addr sshd")
+	host_key := cmd.String("hostkey", "~/.fkme/sftpd_host_ed25519_key", "host private key for -addr sshd")
+	gateway := cmd.Bool("gateway-ports", false, "-addr sshd: reverse ports bind the address the client asks for, default 127.0.0.1 only")
+	gconf := util.GuardFlags(cmd) // 用于 -port 的本地监听和 -http(-http 不检查 -secret)
+	aconf := util.AuditFlags(cmd) // 记录 -port 的连接
 
 	cmd.Parse(args)
 
@@ -410,10 +423,37 @@ func Run(args []string) {
 	if *svrport > 0 { // running server endpoint
 		// 启动 web-socket 服务器, 可以在 nginx 之后, 作为端口转发服务器
 		// ./fkme -p 8899 -prefix /yt -addr 127.0.0.1:9022
+		// 内置 ssh 服务: ./fkme ws -p 8899 -prefix /yt -addr sshd -auth ~/.ssh/authorized_keys
+		var ssh_srv *sshd.Server
+		if *servaddr == "sshd" {
+			conf := sshd.DefaultAuth(&sshd.Config{
+				HostKey:        sshconfig.ExpandHome(*host_key),
+				AuthorizedKeys: sshconfig.ExpandHome(*auth),
+				Root:           "/",
+				Shell:          true,
+				Forward:        true,
+				GatewayPorts:   *gateway,
+			})
+			var err error
+			if ssh_srv, err = sshd.NewServer(conf); err != nil {
+				logger.Error("ssh server: %v", err)
+				os.Exit(2)
+			}
+		}
 		dir, _ := os.Getwd()
 		go ReadAll(dir)
-		serveServer(*svrport, *servaddr, *prefix)
+		serveServer(*svrport, *servaddr, *prefix, ssh_srv)
 	} else if len(ports) > 0 {
+		guard, err := util.NewGuard(gconf)
+		if err != nil {
+			logger.Error("%v", err)
+			os.Exit(2)
+		}
+		audit, err := util.OpenAudit(aconf)
+		if err != nil {
+			logger.Error("audit: %v", err)
+			os.Exit(2)
+		}
 		if *socks > 0 {
 			// 启动 socks5 server
 			conf := &socks5.Config{}
@@ -425,7 +465,13 @@ func Run(args []string) {
 			proxy.Verbose = true
 
 			svraddr := fmt.Sprintf(":%d", *http_port)
-			go http.ListenAndServe(svraddr, proxy)
+			ln, err := net.Listen("tcp", svraddr)
+			if err != nil {
+				logger.Error("http proxy: %v", err)
+				os.Exit(2)
+			}
+			// 浏览器等代理客户端不会先发送 secret, 只检查 -allow -deny -max-conn
+			go http.Serve(guard.NoSecret().Listen(ln, "http "+svraddr), proxy)
 		}
 		// 一个连接多端口映射， 样例
 		// fkme ws -addr wss://121.43.230.103:443/yt/ws -port "7022;>;2022" -port "31080;>;21080" -port "15900;>;5900"
@@ -434,7 +480,7 @@ func Run(args []string) {
 			fmt.Printf(" --%d = [%s]\n", i, p)
 		}
 		//fmt.Printf("todo something\n")
-		WSTunnel_M(*servaddr, ports)
+		WSTunnel_M(*servaddr, ports, guard, audit)
 	} else {
 		//ServeClient(*svrport, *servaddr)
 		fmt.Printf("Nothing to do!!!!!\n")
@@ -46,6 +46,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/lulugyf/fkme/go-socks5"
 	"github.com/lulugyf/fkme/logger"
+	"github.com/lulugyf/fkme/util"
 	"go.uber.org/ratelimit"
 	"io"
 	"net"
@@ -508,6 +509,8 @@ type CliClient struct {
 	ser_no_seed uint16
 	listen_port int
 	target_addr string
+	guard       *util.Guard // 监听的访问控制, 见 util/guard.go
+	audit       *util.AuditLog
 }
 
 func (s *CliClient) Serv() {
@@ -516,6 +519,8 @@ func (s *CliClient) Serv() {
 		logger.Error("listen on %d failed, %v", s.listen_port, err)
 		return
 	}
+	listener = s.guard.Listen(listener, fmt.Sprintf("wsmid %d", s.listen_port))
+	listener = s.audit.Listen(listener, fmt.Sprintf("wsmid %s %d", s.slot_name, s.listen_port), s.ws_addr, s.target_addr)
 	defer listener.Close()
 
 	running := true
@@ -534,8 +539,10 @@ func (s *CliClient) Serv() {
 }
 
 func (s *CliClient) connCopy(conn net.Conn, ser_no string) {
+	ac := util.AuditOf(conn)
 	ws := ws_connect(s.ws_addr, fmt.Sprintf("client-data,%s,%s,%s", s.slot_name, ser_no, s.target_addr))
 	if ws == nil {
+		ac.SetReason("connect client-data failed")
 		conn.Close()
 		logger.Error("connect server-data failed, close it")
 		return
@@ -550,6 +557,7 @@ func (s *CliClient) connCopy(conn net.Conn, ser_no string) {
 	}
 	go func() {
 		io.Copy(conn, ws)
+		ac.SetReason("dst closed")
 		once.Do(close)
 	}()
 
@@ -598,6 +606,8 @@ func WSMidServ(args []string) {
 	ws_addr := cmd.String("ws", "", "WS server address")
 	slot := cmd.String("slot", "", "choose a slot name")
 	to := cmd.String("to", "", "target address")
+	gconf := util.GuardFlags(cmd) // 用于 client-client 的监听
+	aconf := util.AuditFlags(cmd)
 	cmd.Parse(args)
 
 	m := *mode
@@ -613,7 +623,17 @@ func WSMidServ(args []string) {
 		// fkme wsmid -mode client-client -ws ws://127.0.0.1:8899/yt/ws -slot slot1 -p 7711 -to 127.0.0.1:9191
 		// start fkme w
 		// curl http://127.0.0.1:7711/hello
-		ws := &CliClient{ws_addr: *ws_addr, slot_name: *slot, listen_port: *port, target_addr: *to}
+		guard, err := util.NewGuard(gconf)
+		if err != nil {
+			logger.Error("%v", err)
+			return
+		}
+		audit, err := util.OpenAudit(aconf)
+		if err != nil {
+			logger.Error("audit: %v", err)
+			return
+		}
+		ws := &CliClient{ws_addr: *ws_addr, slot_name: *slot, listen_port: *port, target_addr: *to, guard: guard, audit: audit}
 		ws.Serv()
 	}
 }